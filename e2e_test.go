@@ -3,15 +3,17 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
 	"math"
 	"math/rand"
 	"os"
-	"sync"
 	"testing"
 
+	"plain-rdiff/rdiff"
+
 	"github.com/stretchr/testify/assert"
 )
 
@@ -48,40 +50,24 @@ func TestRdiffFile(t *testing.T) {
 			func(t *testing.T) {
 				t.Log("generating old and ref files")
 				refFileName := "__test_reference_file"
-				refFileChan := make(chan []byte)
-				wg := sync.WaitGroup{}
 				oldFileName := "__test_old_file"
-				oldFileChan := make(chan []byte)
-				wg.Add(1)
-				go func() {
-					err := CreateAndFillFile(refFileName, refFileChan)
-					if err != nil {
-						panic(err)
-					}
-					wg.Done()
-				}()
-				wg.Add(1)
-				go func() {
-					err := CreateAndFillFile(oldFileName, oldFileChan)
-					if err != nil {
-						panic(err)
-					}
-					wg.Done()
-				}()
 
 				bytes := make([]byte, tc.filesLen)
 				rand.Read(bytes)
-				refFileChan <- bytes
+				err := os.WriteFile(refFileName, bytes, 0666)
+				if err != nil {
+					t.Fatal(err)
+				}
 				oldFileContent := make([]byte, tc.filesLen)
 				copy(oldFileContent, bytes)
 				for i := 0; i < tc.noOfDifferences; i++ {
 					index := rand.Intn(int(tc.filesLen))
 					oldFileContent[index] = byte(rand.Int())
 				}
-				oldFileChan <- oldFileContent
-				close(refFileChan)
-				close(oldFileChan)
-				wg.Wait()
+				err = os.WriteFile(oldFileName, oldFileContent, 0666)
+				if err != nil {
+					t.Fatal(err)
+				}
 				defer func() {
 					err := os.Remove(refFileName)
 					if err != nil {
@@ -96,7 +82,10 @@ func TestRdiffFile(t *testing.T) {
 				// signature
 				signatureFileName := "__test_signature_file"
 				t.Log("calculating signature")
-				signatureFlow(oldFileName, signatureFileName, tc.windowSize)
+				err = signatureFlow(context.Background(), oldFileName, signatureFileName, rdiff.SignatureOptions{BlockLength: tc.windowSize})
+				if err != nil {
+					t.Fatal(err)
+				}
 				defer func() {
 					err := os.Remove(signatureFileName)
 					if err != nil {
@@ -107,7 +96,10 @@ func TestRdiffFile(t *testing.T) {
 				// delta
 				deltaFileName := "__test_delta_file"
 				t.Log("calculating delta")
-				deltaFlow(signatureFileName, refFileName, deltaFileName, tc.windowSize)
+				err = deltaFlow(context.Background(), signatureFileName, refFileName, deltaFileName, rdiff.DeltaOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
 				defer func() {
 					err := os.Remove(deltaFileName)
 					if err != nil {
@@ -118,7 +110,10 @@ func TestRdiffFile(t *testing.T) {
 				// patch
 				newFileName := "__test_new_file"
 				t.Log("applying patch")
-				patchFlow(oldFileName, deltaFileName, newFileName)
+				err = patchFlow(context.Background(), oldFileName, deltaFileName, newFileName, rdiff.PatchOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
 				defer func() {
 					err := os.Remove(newFileName)
 					if err != nil {
@@ -126,6 +121,13 @@ func TestRdiffFile(t *testing.T) {
 					}
 				}()
 
+				// verify
+				t.Log("verifying delta")
+				err = verifyFlow(context.Background(), oldFileName, deltaFileName, refFileName, rdiff.PatchOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+
 				// compare
 				t.Log("comparing file hashes")
 				refFile, err := os.Open(refFileName)
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+
+	"plain-rdiff/rdiff"
+)
+
+// Exit codes per class of failure.
+const (
+	EXIT_FAILURE = 1
+	// EXIT_USAGE matches the exit code of invalid flags.
+	EXIT_USAGE         = 2
+	EXIT_IO            = 3
+	EXIT_INVALID_INPUT = 4
+	EXIT_MISMATCH      = 5
+	EXIT_INTERRUPTED   = 130
+)
+
+// usageError is returned for invalid command lines.
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+func exitCode(err error) int {
+	var usageErr usageError
+	var pathErr *fs.PathError
+	switch {
+	case errors.As(err, &usageErr):
+		return EXIT_USAGE
+	case errors.Is(err, context.Canceled):
+		return EXIT_INTERRUPTED
+	case errors.Is(err, rdiff.ErrBasisMismatch), errors.Is(err, rdiff.ErrTargetMismatch), errors.Is(err, rdiff.ErrTargetDiffers):
+		return EXIT_MISMATCH
+	case errors.As(err, &pathErr), errors.Is(err, fs.ErrNotExist):
+		return EXIT_IO
+	case rdiff.IsInvalidInput(err), errors.Is(err, errUnknownFileType):
+		return EXIT_INVALID_INPUT
+	}
+	return EXIT_FAILURE
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"plain-rdiff/rdiff"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitCode(t *testing.T) {
+	_, openErr := os.Open("__missing_file")
+	tcs := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{name: "usage", err: usageError(USAGE_TEXT), expected: EXIT_USAGE},
+		{name: "missing file", err: openErr, expected: EXIT_IO},
+		{name: "corrupted delta", err: fmt.Errorf("%w: 7", rdiff.ErrUnknownOpcode), expected: EXIT_INVALID_INPUT},
+		{name: "wrong basis", err: rdiff.ErrBasisMismatch, expected: EXIT_MISMATCH},
+		{name: "different target", err: fmt.Errorf("%w at offset 4", rdiff.ErrTargetDiffers), expected: EXIT_MISMATCH},
+		{name: "interrupted", err: context.Canceled, expected: EXIT_INTERRUPTED},
+		{name: "other", err: errors.New("other"), expected: EXIT_FAILURE},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, exitCode(tc.err))
+		})
+	}
+}
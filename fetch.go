@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"plain-rdiff/rdiff"
+	"plain-rdiff/remote"
+)
+
+// SIGNATURE_URL_SUFFIX follows the URL of a file in the URL fetch reads its
+// signature from by default.
+const SIGNATURE_URL_SUFFIX = ".sig"
+
+func isHTTPURL(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// fetchFlow replaces the file at localFilePath with the file at url, reading
+// only the blocks it does not hold from url. signatureLocation is the URL or
+// path of the signature of the file at url.
+func fetchFlow(ctx context.Context, url, localFilePath, signatureLocation string, opts rdiff.FetchOptions) error {
+	if !isHTTPURL(url) {
+		return usageError(fmt.Sprintf("invalid URL, expected http:// or https://: %s", url))
+	}
+	if signatureLocation == "" {
+		signatureLocation = url + SIGNATURE_URL_SUFFIX
+	}
+	signature, err := openSignature(ctx, signatureLocation)
+	if err != nil {
+		return err
+	}
+	defer signature.Close()
+
+	local, closeLocal, err := openBasis(localFilePath)
+	if err != nil {
+		return err
+	}
+	defer closeLocal()
+
+	return CreateAndFillFile(localFilePath, func(w io.Writer) error {
+		return rdiff.FetchContext(ctx, signature, local, w, remote.RangeFetcher(http.DefaultClient, url), opts)
+	})
+}
+
+// openSignature opens the signature at location, a URL, a file or "-" for
+// standard input.
+func openSignature(ctx context.Context, location string) (io.ReadCloser, error) {
+	if isHTTPURL(location) {
+		return remote.Get(ctx, http.DefaultClient, location)
+	}
+	return GetInputReader(location)
+}
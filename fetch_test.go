@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"plain-rdiff/rdiff"
+	"plain-rdiff/remote"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetch(t *testing.T) {
+	oldContent := strings.Repeat("Imagine you have two files, A and B. ", 10000)
+	newContent := strings.Replace(oldContent, "two", "three", 7) + "and more"
+
+	published := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(published, "file"), []byte(newContent), 0600))
+	signature := bytes.Buffer{}
+	assert.NoError(t, rdiff.Signature(strings.NewReader(newContent), &signature, rdiff.SignatureOptions{}))
+	assert.NoError(t, os.WriteFile(filepath.Join(published, "file.sig"), signature.Bytes(), 0600))
+
+	var mutex sync.Mutex
+	var ranges []string
+	files := http.FileServer(http.Dir(published))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		if r.Header.Get("Range") != "" {
+			ranges = append(ranges, r.Header.Get("Range"))
+		}
+		mutex.Unlock()
+		if r.URL.Path == "/whole" {
+			w.Write([]byte(newContent))
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	tcs := []struct {
+		name           string
+		local          *string
+		signature      string
+		expectedRanges int
+	}{
+		{name: "should fetch changed blocks of stale copy", local: &oldContent, expectedRanges: 2},
+		{name: "should fetch nothing of up to date copy", local: &newContent, expectedRanges: 0},
+		{name: "should fetch whole file without local copy", expectedRanges: 1},
+		{name: "should read signature from file", local: &oldContent, signature: filepath.Join(published, "file.sig"), expectedRanges: 2},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			ranges = nil
+			local := filepath.Join(t.TempDir(), "local")
+			if tc.local != nil {
+				assert.NoError(t, os.WriteFile(local, []byte(*tc.local), 0600))
+			}
+			err := fetchFlow(context.Background(), server.URL+"/file", local, tc.signature, rdiff.FetchOptions{})
+			assert.NoError(t, err)
+			assertFileContent(t, local, newContent)
+			assert.Len(t, ranges, tc.expectedRanges)
+		})
+	}
+
+	t.Run("should keep local copy if server ignores ranges", func(t *testing.T) {
+		local := filepath.Join(t.TempDir(), "local")
+		assert.NoError(t, os.WriteFile(local, []byte(oldContent), 0600))
+		err := fetchFlow(context.Background(), server.URL+"/whole", local, server.URL+"/file.sig", rdiff.FetchOptions{})
+		assert.ErrorIs(t, err, remote.ErrRangesNotSupported)
+		assertFileContent(t, local, oldContent)
+		assertDirEntries(t, filepath.Dir(local), "local")
+	})
+
+	t.Run("should refuse other URLs", func(t *testing.T) {
+		err := fetchFlow(context.Background(), "ftp://host/file", filepath.Join(t.TempDir(), "local"), "", rdiff.FetchOptions{})
+		assert.Equal(t, EXIT_USAGE, exitCode(err))
+	})
+}
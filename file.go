@@ -1,108 +1,162 @@
 package main
 
 import (
-	"encoding/binary"
-	"errors"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 )
 
-const BUNDLE_SIZE = 20
+// STDIO_OPERAND stands for standard input or output in place of a file path.
+const STDIO_OPERAND = "-"
 
 func GetFileReader(fileName string) (*os.File, error) {
 	f, err := os.Open(fileName)
 	return f, err
 }
 
-func CreateAndFillFile(filePath string, c chan []byte) error {
-	newFile, err := os.Create(filePath)
+// GetInputReader opens fileName or, for STDIO_OPERAND, returns standard
+// input.
+func GetInputReader(fileName string) (io.ReadCloser, error) {
+	if fileName == STDIO_OPERAND {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return GetFileReader(fileName)
+}
+
+// OUTPUT_FILE_MODE is the mode of created output files. Overwritten files
+// keep their mode.
+const OUTPUT_FILE_MODE = 0644
+
+// CreateAndFillFile fills a temporary file in the directory of filePath and
+// renames it to filePath once fill succeeds, so filePath never holds
+// a partial output. For STDIO_OPERAND fill writes to standard output.
+func CreateAndFillFile(filePath string, fill func(io.Writer) error) (err error) {
+	if filePath == STDIO_OPERAND {
+		return fill(os.Stdout)
+	}
+	mode := os.FileMode(OUTPUT_FILE_MODE)
+	if info, err := os.Stat(filePath); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".*.tmp")
 	if err != nil {
 		return err
 	}
 	defer func() {
-		err = newFile.Close()
-	}()
-
-	for bytes := range c {
-		writ, err := newFile.Write(bytes)
 		if err != nil {
-			println(writ)
-			return err
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
 		}
+	}()
+
+	err = fill(tmpFile)
+	if err != nil {
+		return err
 	}
-	return nil
+	err = tmpFile.Chmod(mode)
+	if err != nil {
+		return err
+	}
+	err = tmpFile.Sync()
+	if err != nil {
+		return err
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filePath)
 }
 
-func CreateAndFillDeltaFile(filePath string, c chan DeltaChunk) error {
-	newFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0666)
+// OUTPUT_DIR_MODE is the mode of created output directories.
+const OUTPUT_DIR_MODE = 0755
+
+// CreateAndFillTree fills a temporary directory next to dirPath, passing
+// fill a function creating the files under it, and replaces dirPath with it
+// once fill succeeds, so dirPath never holds a partial tree. Directories are
+// created when given a mode with fs.ModeDir set, which is applied once fill
+// returns so read-only directories can still be filled.
+func CreateAndFillTree(
+	dirPath string,
+	fill func(create func(name string, mode fs.FileMode, fill func(io.Writer) error) error) error,
+) (err error) {
+	tmpDir, err := os.MkdirTemp(filepath.Dir(dirPath), "."+filepath.Base(dirPath)+".*.tmp")
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmpDir)
+		}
+	}()
 
-	for deltaChunk := range c {
-		newFile.Write(deltaChunk.ToBytes())
-		if !deltaChunk.r.empty() {
-			deltaChunk.r.clear()
+	var dirPaths []string
+	dirModes := map[string]fs.FileMode{}
+	err = fill(func(name string, mode fs.FileMode, fillFile func(io.Writer) error) error {
+		filePath := filepath.Join(tmpDir, filepath.FromSlash(name))
+		if mode.IsDir() {
+			dirPaths = append(dirPaths, filePath)
+			dirModes[filePath] = mode.Perm()
+			return os.MkdirAll(filePath, OUTPUT_DIR_MODE)
 		}
+		return createTreeFile(filePath, mode, fillFile)
+	})
+	if err != nil {
+		return err
 	}
-	return newFile.Close()
+	// Children come after their parents, so they are changed first.
+	for i := len(dirPaths) - 1; i >= 0; i-- {
+		err = os.Chmod(dirPaths[i], dirModes[dirPaths[i]])
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Chmod(tmpDir, OUTPUT_DIR_MODE)
+	if err != nil {
+		return err
+	}
+	if !exists(dirPath) {
+		return os.Rename(tmpDir, dirPath)
+	}
+	// Directories cannot be renamed over, so the old one is moved aside.
+	oldDir := tmpDir + ".old"
+	err = os.Rename(dirPath, oldDir)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpDir, dirPath)
+	if err != nil {
+		os.Rename(oldDir, dirPath)
+		return err
+	}
+	return os.RemoveAll(oldDir)
 }
 
-func ReadSignatureFile(filePath string) ([][]byte, error) {
-	contents, err := os.ReadFile(filePath)
+func createTreeFile(filePath string, mode fs.FileMode, fill func(io.Writer) error) error {
+	err := os.MkdirAll(filepath.Dir(filePath), OUTPUT_DIR_MODE)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	slices := make([][]byte, len(contents)/BUNDLE_SIZE)
-	for i := range slices {
-		slices[i] = contents[(i * BUNDLE_SIZE) : (i+1)*BUNDLE_SIZE]
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
 
-	return slices, nil
-}
-
-func DeltaReader(delta *os.File, c chan DeltaChunk) error {
-	defer close(c)
-	for {
-		b := make([]byte, 1)
-		_, err := delta.Read(b)
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				return nil
-			}
-			return err
-		}
-		switch b[0] {
-		case 0:
-			blockLenBytes := make([]byte, 8)
-			_, err := delta.Read(blockLenBytes)
-			if err != nil {
-				return err
-			}
-			blockLen := binary.BigEndian.Uint64(blockLenBytes)
-			rawData := make([]byte, blockLen)
-			_, err = delta.Read(rawData)
-			if err != nil {
-				return err
-			}
-			c <- NewDeltaChunkWithRawData(rawData)
-		case 1:
-			fromBytes := make([]byte, 8)
-			_, err = delta.Read(fromBytes)
-			if err != nil {
-				return err
-			}
-			from := binary.BigEndian.Uint64(fromBytes)
-			toBytes := make([]byte, 8)
-			_, err = delta.Read(toBytes)
-			if err != nil {
-				return err
-			}
-			to := binary.BigEndian.Uint64(toBytes)
-			r := Range{&from, &to}
-			c <- NewDeltaChunkWithRange(r)
-		default:
-			return nil
-		}
+	err = fill(file)
+	if err != nil {
+		return err
+	}
+	// The mode given to OpenFile is reduced by the umask.
+	err = file.Chmod(mode)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if err != nil {
+		return err
 	}
+	return file.Close()
 }
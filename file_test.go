@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateAndFillFile(t *testing.T) {
+	t.Run("should write file", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "out")
+
+		err := CreateAndFillFile(path, func(w io.Writer) error {
+			_, err := w.Write([]byte("content"))
+			return err
+		})
+		assert.NoError(t, err)
+
+		content, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, "content", string(content))
+		assertDirEntries(t, dir, "out")
+	})
+
+	t.Run("should leave no file when fill fails", func(t *testing.T) {
+		dir := t.TempDir()
+		fillErr := errors.New("fill failed")
+
+		err := CreateAndFillFile(filepath.Join(dir, "out"), func(w io.Writer) error {
+			w.Write([]byte("partial"))
+			return fillErr
+		})
+		assert.ErrorIs(t, err, fillErr)
+		assertDirEntries(t, dir)
+	})
+
+	t.Run("should keep overwritten file when fill fails", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "out")
+		err := os.WriteFile(path, []byte("old"), 0600)
+		assert.NoError(t, err)
+
+		err = CreateAndFillFile(path, func(w io.Writer) error {
+			w.Write([]byte("partial"))
+			return errors.New("fill failed")
+		})
+		assert.Error(t, err)
+
+		content, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, "old", string(content))
+		assertDirEntries(t, dir, "out")
+	})
+
+	t.Run("should overwrite file keeping its mode", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "out")
+		err := os.WriteFile(path, []byte("old"), 0600)
+		assert.NoError(t, err)
+
+		err = CreateAndFillFile(path, func(w io.Writer) error {
+			_, err := w.Write([]byte("new"))
+			return err
+		})
+		assert.NoError(t, err)
+
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+		content, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, "new", string(content))
+	})
+}
+
+func assertDirEntries(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	var actual []string
+	for _, e := range entries {
+		actual = append(actual, e.Name())
+	}
+	assert.ElementsMatch(t, names, actual)
+}
@@ -1,11 +1,19 @@
 module plain-rdiff
 
-go 1.17
+go 1.21
+
+require (
+	github.com/klauspost/compress v1.17.2
+	github.com/stretchr/testify v1.7.0
+	github.com/zeebo/blake3 v0.2.4
+	github.com/zeebo/xxh3 v1.0.2
+	golang.org/x/crypto v0.0.0-20220131195533-30dcbda58838
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.12 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.7.0 // indirect
-	golang.org/x/crypto v0.0.0-20220131195533-30dcbda58838 // indirect
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+
+	"plain-rdiff/remote"
+)
+
+// DEFAULT_HTTP_PORT is the TCP port the http command listens on by default.
+const DEFAULT_HTTP_PORT = 8080
+
+// httpHandler serves the remote.Handler endpoints, refusing request bodies
+// longer than maxBodyLength. Files under root are patched only if writable.
+func httpHandler(root string, writable bool, maxBodyLength int64) http.Handler {
+	if !writable {
+		return remote.Handler{MaxBodyLength: maxBodyLength}
+	}
+	return remote.Handler{
+		MaxBodyLength: maxBodyLength,
+		Open: func(name string) (io.ReaderAt, func() error, error) {
+			filePath, err := servedPath(root, name)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%w: %v", remote.ErrBadRequest, err)
+			}
+			basis, closeBasis, err := openBasis(filePath)
+			if err != nil {
+				return nil, nil, withoutServedPath(remote.Request{Path: name}, err)
+			}
+			return basis, closeBasis, nil
+		},
+		Create: func(name string, fill func(io.Writer) error) error {
+			filePath, err := servedPath(root, name)
+			if err != nil {
+				return err
+			}
+			return CreateAndFillFile(filePath, fill)
+		},
+	}
+}
+
+func httpFlow(ctx context.Context, address, root string, writable bool, maxBodyLength int64) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: httpHandler(root, writable, maxBodyLength)}
+	stop := closeOnDone(ctx, server)
+	defer stop()
+	log.Printf("serving %s over HTTP on %s", root, listener.Addr())
+
+	err = server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"plain-rdiff/rdiff"
+	"plain-rdiff/remote"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	content := strings.Repeat("Imagine you have two files, A and B. ", 1000)
+	emptySignature := bytes.Buffer{}
+	assert.NoError(t, rdiff.Signature(bytes.NewReader(nil), &emptySignature, rdiff.SignatureOptions{}))
+	delta := bytes.Buffer{}
+	assert.NoError(t, rdiff.Delta(&emptySignature, strings.NewReader(content), &delta, rdiff.DeltaOptions{}))
+
+	tcs := []struct {
+		name     string
+		path     string
+		expected int
+		created  string
+	}{
+		{name: "should patch new file under root", path: "dir/../file", expected: http.StatusOK, created: "file"},
+		{name: "should keep requests under root", path: "../file", expected: http.StatusOK, created: "file"},
+		{name: "should refuse root itself", path: "", expected: http.StatusBadRequest},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodPost, remote.PATCH_ENDPOINT+tc.path, bytes.NewReader(delta.Bytes()))
+			httpHandler(root, true, 0).ServeHTTP(recorder, request)
+			assert.Equal(t, tc.expected, recorder.Code, recorder.Body.String())
+			if tc.created == "" {
+				assertDirEntries(t, root)
+				return
+			}
+			assertDirEntries(t, root, tc.created)
+			assertFileContent(t, filepath.Join(root, tc.created), content)
+		})
+	}
+
+	t.Run("should refuse patch unless writable", func(t *testing.T) {
+		root := t.TempDir()
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, remote.PATCH_ENDPOINT+"file", bytes.NewReader(delta.Bytes()))
+		httpHandler(root, false, 0).ServeHTTP(recorder, request)
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+		assertDirEntries(t, root)
+	})
+}
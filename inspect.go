@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"plain-rdiff/rdiff"
+)
+
+// errUnknownFileType is returned by inspect for files that are neither
+// signatures nor deltas.
+var errUnknownFileType = errors.New("neither a signature nor a delta")
+
+const (
+	OP_COPY    = "COPY"
+	OP_LITERAL = "LITERAL"
+)
+
+type signatureReport struct {
+	Type             string        `json:"type"`
+	Format           string        `json:"format"`
+	BlockLength      uint32        `json:"block_length"`
+	StrongHash       string        `json:"strong_hash"`
+	StrongHashLength int           `json:"strong_hash_length"`
+	BlockCount       int           `json:"block_count"`
+	Basis            *digestReport `json:"basis,omitempty"`
+	Blocks           []blockReport `json:"blocks"`
+}
+
+type blockReport struct {
+	Offset   uint64 `json:"offset"`
+	Checksum string `json:"checksum"`
+	Hash     string `json:"hash"`
+}
+
+type deltaReport struct {
+	Type         string        `json:"type"`
+	Format       string        `json:"format"`
+	Version      uint16        `json:"version,omitempty"`
+	Compression  string        `json:"compression,omitempty"`
+	Basis        *digestReport `json:"basis,omitempty"`
+	Target       *digestReport `json:"target"`
+	Ops          []opReport    `json:"ops"`
+	Copies       int           `json:"copies"`
+	CopiedBytes  uint64        `json:"copied_bytes"`
+	Literals     int           `json:"literals"`
+	LiteralBytes uint64        `json:"literal_bytes"`
+}
+
+// opReport is an operation of a delta writing length bytes at offset of the
+// new file, copied from the basis file at from or literal.
+type opReport struct {
+	Op     string  `json:"op"`
+	Offset uint64  `json:"offset"`
+	Length uint64  `json:"length"`
+	From   *uint64 `json:"from,omitempty"`
+}
+
+type treeReport struct {
+	Type    string            `json:"type"`
+	Format  string            `json:"format"`
+	Entries []treeEntryReport `json:"entries"`
+}
+
+// treeEntryReport is a file or directory of a tree signature or delta.
+// Kind is "file" or "directory" in signatures and the operation in deltas.
+type treeEntryReport struct {
+	Kind        string        `json:"kind"`
+	Path        string        `json:"path"`
+	Mode        string        `json:"mode,omitempty"`
+	From        string        `json:"from,omitempty"`
+	Digest      *digestReport `json:"digest,omitempty"`
+	DeltaLength uint64        `json:"delta_length,omitempty"`
+}
+
+// treeOpNames are the kinds of tree delta entries in reports.
+var treeOpNames = map[byte]string{
+	rdiff.TREE_OP_UNCHANGED: "unchanged",
+	rdiff.TREE_OP_RENAMED:   "renamed",
+	rdiff.TREE_OP_ADDED:     "added",
+	rdiff.TREE_OP_CHANGED:   "changed",
+	rdiff.TREE_OP_DELETED:   "deleted",
+	rdiff.TREE_OP_DIRECTORY: "directory",
+}
+
+type digestReport struct {
+	Length uint64 `json:"length"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+func newDigestReport(d rdiff.FileDigest) *digestReport {
+	return &digestReport{Length: d.Length, SHA256: hex.EncodeToString(d.Hash)}
+}
+
+func (r *deltaReport) add(chunk rdiff.DeltaChunk) {
+	op := opReport{Op: OP_LITERAL, Length: chunk.Len()}
+	op.Offset = r.Target.Length
+	r.Target.Length += op.Length
+	if chunk.IsLiteral() {
+		r.Literals++
+		r.LiteralBytes += op.Length
+	} else {
+		from, _ := chunk.Range()
+		op.Op = OP_COPY
+		op.From = &from
+		r.Copies++
+		r.CopiedBytes += op.Length
+	}
+	r.Ops = append(r.Ops, op)
+}
+
+// inspectFlow describes the signature or delta at path on out, as text or
+// as JSON.
+func inspectFlow(ctx context.Context, path string, asJSON bool, out io.Writer) error {
+	file, err := GetInputReader(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	magic, err := r.Peek(4)
+	if err != nil {
+		return errUnknownFileType
+	}
+	var report interface{}
+	switch binary.BigEndian.Uint32(magic) {
+	case rdiff.SIGNATURE_MAGIC:
+		report, err = inspectSignature(r)
+	case rdiff.RS_MD4_SIG_MAGIC, rdiff.RS_BLAKE2_SIG_MAGIC, rdiff.RS_RK_MD4_SIG_MAGIC, rdiff.RS_RK_BLAKE2_SIG_MAGIC:
+		report, err = inspectLibrsyncSignature(r)
+	case rdiff.DELTA_MAGIC:
+		report, err = inspectDelta(ctx, r)
+	case rdiff.RS_DELTA_MAGIC:
+		report, err = inspectLibrsyncDelta(ctx, r)
+	case rdiff.TREE_SIGNATURE_MAGIC:
+		report, err = inspectTreeSignature(r)
+	case rdiff.TREE_DELTA_MAGIC:
+		report, err = inspectTreeDelta(r)
+	default:
+		return errUnknownFileType
+	}
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	switch report := report.(type) {
+	case *signatureReport:
+		return writeSignatureReport(out, report)
+	case *deltaReport:
+		return writeDeltaReport(out, report)
+	case *treeReport:
+		return writeTreeReport(out, report)
+	}
+	return nil
+}
+
+func inspectSignature(r io.Reader) (*signatureReport, error) {
+	signatureFile, err := rdiff.ReadSignatureFile(r)
+	if err != nil {
+		return nil, err
+	}
+	strongHash, err := rdiff.StrongHashByType(signatureFile.Header.StrongHash)
+	if err != nil {
+		return nil, err
+	}
+	return &signatureReport{
+		Type:             "signature",
+		Format:           rdiff.FORMAT_PLAIN.String(),
+		BlockLength:      signatureFile.Header.BlockLength,
+		StrongHash:       strongHash.Name(),
+		StrongHashLength: int(signatureFile.Header.StrongHashLength),
+		BlockCount:       signatureFile.Index.Len(),
+		Basis:            newDigestReport(signatureFile.Basis),
+		Blocks:           blockReports(signatureFile.Index, signatureFile.Header.BlockLength),
+	}, nil
+}
+
+func inspectLibrsyncSignature(r io.Reader) (*signatureReport, error) {
+	header, index, err := rdiff.ReadLibrsyncSignatureFile(r)
+	if err != nil {
+		return nil, err
+	}
+	strongHash := "blake2b"
+	if header.Magic == rdiff.RS_MD4_SIG_MAGIC || header.Magic == rdiff.RS_RK_MD4_SIG_MAGIC {
+		strongHash = "md4"
+	}
+	return &signatureReport{
+		Type:             "signature",
+		Format:           rdiff.FORMAT_LIBRSYNC.String(),
+		BlockLength:      header.BlockLength,
+		StrongHash:       strongHash,
+		StrongHashLength: int(header.StrongHashLength),
+		BlockCount:       index.Len(),
+		Blocks:           blockReports(index, header.BlockLength),
+	}, nil
+}
+
+func blockReports(index *rdiff.SignatureIndex, blockLength uint32) []blockReport {
+	blocks := make([]blockReport, index.Len())
+	for i, checksum := range index.Checksums() {
+		blocks[i] = blockReport{
+			Offset:   uint64(i) * uint64(blockLength),
+			Checksum: fmt.Sprintf("%08x", checksum),
+			Hash:     hex.EncodeToString(index.Hash(i)),
+		}
+	}
+	return blocks
+}
+
+func inspectDelta(ctx context.Context, r io.Reader) (*deltaReport, error) {
+	header, err := rdiff.ReadDeltaHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	body, err := header.Body(r)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	report := &deltaReport{
+		Type:        "delta",
+		Format:      rdiff.FORMAT_PLAIN.String(),
+		Version:     header.Version,
+		Compression: header.Compression.String(),
+		Basis:       newDigestReport(header.Basis),
+		Target:      &digestReport{},
+	}
+	var target rdiff.FileDigest
+	err = readDeltaReport(report, func(c chan rdiff.DeltaChunk) error {
+		var err error
+		target, err = rdiff.DeltaReader(ctx, body, header.Version, c, rdiff.DEFAULT_MAX_LITERAL_LENGTH)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.Target = newDigestReport(target)
+	return report, nil
+}
+
+func inspectLibrsyncDelta(ctx context.Context, r io.Reader) (*deltaReport, error) {
+	err := rdiff.ReadLibrsyncDeltaHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	// librsync deltas carry no digests, the target length is counted.
+	report := &deltaReport{Type: "delta", Format: rdiff.FORMAT_LIBRSYNC.String(), Target: &digestReport{}}
+	err = readDeltaReport(report, func(c chan rdiff.DeltaChunk) error {
+		return rdiff.LibrsyncDeltaReader(ctx, r, c, rdiff.DEFAULT_MAX_LITERAL_LENGTH)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func inspectTreeSignature(r io.Reader) (*treeReport, error) {
+	entries, err := rdiff.ReadTreeSignature(r)
+	if err != nil {
+		return nil, err
+	}
+	report := &treeReport{Type: "tree signature", Format: rdiff.FORMAT_PLAIN.String(), Entries: []treeEntryReport{}}
+	for _, entry := range entries {
+		entryReport := treeEntryReport{Kind: "file", Path: entry.Name}
+		if entry.Mode.IsDir() {
+			entryReport.Kind = "directory"
+		} else {
+			entryReport.Digest = newDigestReport(*entry.Digest)
+		}
+		report.Entries = append(report.Entries, entryReport)
+	}
+	return report, nil
+}
+
+func inspectTreeDelta(r io.Reader) (*treeReport, error) {
+	entries, err := rdiff.ReadTreeDelta(r)
+	if err != nil {
+		return nil, err
+	}
+	report := &treeReport{Type: "tree delta", Format: rdiff.FORMAT_PLAIN.String(), Entries: []treeEntryReport{}}
+	for _, entry := range entries {
+		entryReport := treeEntryReport{
+			Kind:        treeOpNames[entry.Op],
+			Path:        entry.Name,
+			From:        entry.From,
+			DeltaLength: entry.Length,
+		}
+		if entry.Op != rdiff.TREE_OP_DELETED {
+			entryReport.Mode = entry.Mode.String()
+		}
+		if entry.Digest != nil {
+			entryReport.Digest = newDigestReport(*entry.Digest)
+		}
+		report.Entries = append(report.Entries, entryReport)
+	}
+	return report, nil
+}
+
+// readDeltaReport adds operations sent by deltaReader to report.
+func readDeltaReport(report *deltaReport, deltaReader func(chan rdiff.DeltaChunk) error) error {
+	c := make(chan rdiff.DeltaChunk)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- deltaReader(c)
+	}()
+	for chunk := range c {
+		report.add(chunk)
+	}
+	return <-errChan
+}
+
+func writeSignatureReport(out io.Writer, report *signatureReport) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "type:\t%s\n", report.Type)
+	fmt.Fprintf(w, "format:\t%s\n", report.Format)
+	fmt.Fprintf(w, "block length:\t%d\n", report.BlockLength)
+	fmt.Fprintf(w, "strong hash:\t%s, %d bytes\n", report.StrongHash, report.StrongHashLength)
+	fmt.Fprintf(w, "blocks:\t%d\n", report.BlockCount)
+	if report.Basis != nil {
+		fmt.Fprintf(w, "basis:\t%d bytes, sha256 %s\n", report.Basis.Length, report.Basis.SHA256)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "OFFSET\tCHECKSUM\tHASH")
+	for _, block := range report.Blocks {
+		fmt.Fprintf(w, "%d\t%s\t%s\n", block.Offset, block.Checksum, block.Hash)
+	}
+	return w.Flush()
+}
+
+func writeDeltaReport(out io.Writer, report *deltaReport) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "type:\t%s\n", report.Type)
+	fmt.Fprintf(w, "format:\t%s\n", report.Format)
+	if report.Version != 0 {
+		fmt.Fprintf(w, "version:\t%d\n", report.Version)
+		fmt.Fprintf(w, "compression:\t%s\n", report.Compression)
+	}
+	if report.Basis != nil {
+		fmt.Fprintf(w, "basis:\t%d bytes, sha256 %s\n", report.Basis.Length, report.Basis.SHA256)
+	}
+	if report.Target.SHA256 != "" {
+		fmt.Fprintf(w, "target:\t%d bytes, sha256 %s\n", report.Target.Length, report.Target.SHA256)
+	} else {
+		fmt.Fprintf(w, "target:\t%d bytes\n", report.Target.Length)
+	}
+	fmt.Fprintf(w, "copies:\t%d, %d bytes\n", report.Copies, report.CopiedBytes)
+	fmt.Fprintf(w, "literals:\t%d, %d bytes\n", report.Literals, report.LiteralBytes)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "OP\tOFFSET\tLENGTH\tFROM")
+	for _, op := range report.Ops {
+		from := "-"
+		if op.From != nil {
+			from = fmt.Sprint(*op.From)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", op.Op, op.Offset, op.Length, from)
+	}
+	return w.Flush()
+}
+
+func writeTreeReport(out io.Writer, report *treeReport) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "type:\t%s\n", report.Type)
+	fmt.Fprintf(w, "format:\t%s\n", report.Format)
+	fmt.Fprintf(w, "entries:\t%d\n", len(report.Entries))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tPATH\tMODE\tFROM\tLENGTH\tSHA256\tDELTA")
+	for _, entry := range report.Entries {
+		mode, from, length, sha256, delta := "-", "-", "-", "-", "-"
+		if entry.Mode != "" {
+			mode = entry.Mode
+		}
+		if entry.From != "" {
+			from = entry.From
+		}
+		if entry.Digest != nil {
+			length, sha256 = fmt.Sprint(entry.Digest.Length), entry.Digest.SHA256
+		}
+		if entry.Kind == treeOpNames[rdiff.TREE_OP_ADDED] || entry.Kind == treeOpNames[rdiff.TREE_OP_CHANGED] {
+			delta = fmt.Sprintf("%d bytes", entry.DeltaLength)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", entry.Kind, entry.Path, mode, from, length, sha256, delta)
+	}
+	return w.Flush()
+}
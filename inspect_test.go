@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"plain-rdiff/rdiff"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// inspectFiles writes a signature of basis and a delta of newFile to dir
+// and returns their paths.
+func inspectFiles(t *testing.T, dir string, format rdiff.Format, basis, newFile string) (string, string) {
+	signature := bytes.Buffer{}
+	err := rdiff.Signature(strings.NewReader(basis), &signature, rdiff.SignatureOptions{Format: format, BlockLength: 4})
+	assert.NoError(t, err)
+	delta := bytes.Buffer{}
+	err = rdiff.Delta(bytes.NewReader(signature.Bytes()), strings.NewReader(newFile), &delta, rdiff.DeltaOptions{Format: format})
+	assert.NoError(t, err)
+
+	signaturePath := filepath.Join(dir, "signature")
+	deltaPath := filepath.Join(dir, "delta")
+	assert.NoError(t, os.WriteFile(signaturePath, signature.Bytes(), 0600))
+	assert.NoError(t, os.WriteFile(deltaPath, delta.Bytes(), 0600))
+	return signaturePath, deltaPath
+}
+
+func TestInspectFlow(t *testing.T) {
+	tcs := []struct {
+		name   string
+		format rdiff.Format
+	}{
+		{name: "plain", format: rdiff.FORMAT_PLAIN},
+		{name: "librsync", format: rdiff.FORMAT_LIBRSYNC},
+	}
+	for _, tc := range tcs {
+		t.Run("should report blocks of "+tc.name+" signature as JSON", func(t *testing.T) {
+			signaturePath, _ := inspectFiles(t, t.TempDir(), tc.format, "abcdefghij", "")
+
+			out := bytes.Buffer{}
+			assert.NoError(t, inspectFlow(context.Background(), signaturePath, true, &out))
+
+			var report signatureReport
+			assert.NoError(t, json.Unmarshal(out.Bytes(), &report))
+			assert.Equal(t, "signature", report.Type)
+			assert.Equal(t, tc.format.String(), report.Format)
+			assert.Equal(t, uint32(4), report.BlockLength)
+			assert.Equal(t, 3, report.BlockCount)
+			assert.Len(t, report.Blocks, 3)
+			assert.Equal(t, uint64(8), report.Blocks[2].Offset)
+			assert.Len(t, report.Blocks[2].Checksum, 8)
+			assert.Len(t, report.Blocks[2].Hash, 2*report.StrongHashLength)
+		})
+
+		t.Run("should report ops of "+tc.name+" delta as JSON", func(t *testing.T) {
+			_, deltaPath := inspectFiles(t, t.TempDir(), tc.format, "abcdefghij", "xyabcdefgh")
+
+			out := bytes.Buffer{}
+			assert.NoError(t, inspectFlow(context.Background(), deltaPath, true, &out))
+
+			var report deltaReport
+			assert.NoError(t, json.Unmarshal(out.Bytes(), &report))
+			assert.Equal(t, "delta", report.Type)
+			assert.Equal(t, tc.format.String(), report.Format)
+			from := uint64(0)
+			assert.Equal(t, []opReport{
+				{Op: OP_LITERAL, Offset: 0, Length: 2},
+				{Op: OP_COPY, Offset: 2, Length: 8, From: &from},
+			}, report.Ops)
+			assert.Equal(t, 1, report.Copies)
+			assert.Equal(t, uint64(8), report.CopiedBytes)
+			assert.Equal(t, 1, report.Literals)
+			assert.Equal(t, uint64(2), report.LiteralBytes)
+			assert.Equal(t, uint64(10), report.Target.Length)
+		})
+	}
+
+	t.Run("should print signature and delta as text", func(t *testing.T) {
+		signaturePath, deltaPath := inspectFiles(t, t.TempDir(), rdiff.FORMAT_PLAIN, "abcdefghij", "xyabcdefgh")
+
+		out := bytes.Buffer{}
+		assert.NoError(t, inspectFlow(context.Background(), signaturePath, false, &out))
+		assert.Contains(t, out.String(), "blocks:        3\n")
+		assert.Contains(t, out.String(), "OFFSET  CHECKSUM")
+
+		out.Reset()
+		assert.NoError(t, inspectFlow(context.Background(), deltaPath, false, &out))
+		assert.Contains(t, out.String(), "copies:       1, 8 bytes\n")
+		assert.Contains(t, out.String(), "LITERAL  0       2       -\n")
+		assert.Contains(t, out.String(), "COPY     2       8       0\n")
+	})
+
+	t.Run("should report entries of tree signature and delta", func(t *testing.T) {
+		dir := t.TempDir()
+		oldDir, newDir := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+		writeTree(t, oldDir, map[string]string{"a": "unchanged", "b": "changed"})
+		writeTree(t, newDir, map[string]string{"a": "unchanged", "b": "changed content", "dir/c": "added"})
+		signaturePath, deltaPath := filepath.Join(dir, "sig"), filepath.Join(dir, "delta")
+		ctx := context.Background()
+		assert.NoError(t, treeSignatureFlow(ctx, oldDir, signaturePath, rdiff.SignatureOptions{}))
+		assert.NoError(t, treeDeltaFlow(ctx, signaturePath, newDir, deltaPath, rdiff.DeltaOptions{}))
+
+		out := bytes.Buffer{}
+		assert.NoError(t, inspectFlow(ctx, signaturePath, true, &out))
+		var report treeReport
+		assert.NoError(t, json.Unmarshal(out.Bytes(), &report))
+		assert.Equal(t, "tree signature", report.Type)
+		assert.Equal(t, []string{"file a", "file b"}, treeEntryKinds(report))
+		assert.Equal(t, uint64(len("unchanged")), report.Entries[0].Digest.Length)
+
+		out.Reset()
+		assert.NoError(t, inspectFlow(ctx, deltaPath, true, &out))
+		report = treeReport{}
+		assert.NoError(t, json.Unmarshal(out.Bytes(), &report))
+		assert.Equal(t, "tree delta", report.Type)
+		assert.Equal(t, []string{"unchanged a", "changed b", "directory dir", "added dir/c"}, treeEntryKinds(report))
+		assert.Equal(t, "-rw-r--r--", report.Entries[0].Mode)
+		assert.NotZero(t, report.Entries[1].DeltaLength)
+
+		out.Reset()
+		assert.NoError(t, inspectFlow(ctx, deltaPath, false, &out))
+		assert.Contains(t, out.String(), "entries:  4\n")
+		assert.Contains(t, out.String(), "directory  dir")
+	})
+
+	t.Run("should reject file of unknown type", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "file")
+		assert.NoError(t, os.WriteFile(path, []byte("not a signature"), 0600))
+
+		err := inspectFlow(context.Background(), path, false, &bytes.Buffer{})
+		assert.ErrorIs(t, err, errUnknownFileType)
+		assert.Equal(t, EXIT_INVALID_INPUT, exitCode(err))
+	})
+}
+
+// treeEntryKinds returns the kind and path of every entry of report.
+func treeEntryKinds(report treeReport) []string {
+	var kinds []string
+	for _, entry := range report.Entries {
+		kinds = append(kinds, entry.Kind+" "+entry.Path)
+	}
+	return kinds
+}
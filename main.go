@@ -1,94 +1,414 @@
 package main
 
 import (
-	"encoding/binary"
+	"context"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"net"
 	"os"
-	"path/filepath"
-	"sync"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"plain-rdiff/rdiff"
 )
 
 const (
 	MODE_SIGNATURE = "signature"
 	MODE_DELTA     = "delta"
 	MODE_PATCH     = "patch"
+	MODE_INSPECT   = "inspect"
+	MODE_VERIFY    = "verify"
+	MODE_SERVE     = "serve"
+	MODE_PUSH      = "push"
+	MODE_PULL      = "pull"
+	MODE_HTTP      = "http"
+	MODE_FETCH     = "fetch"
 )
 
 const (
-	USAGE_TEXT      = "Usage:\n rdiff signature old-file signature-file\n rdiff delta signature-file new-file delta-file\n rdiff patch basis-file delta-file new-file"
-	SIGNATURE_USAGE = "Signature usage:\n rdiff signature old-file signature-file"
-	DELTA_USAGE     = "Delta usage:\n rdiff delta signature-file new-file delta-file"
-	PATCH_USAGE     = "Patch usage:\n rdiff patch basis-file delta-file new-file"
+	// Command lines are wrapped at 72 columns, continuing indented.
+	SIGNATURE_COMMAND = " rdiff signature [--format=plain|librsync] [--force]\n   [-b|--block-size=auto|bytes] [--hash=name] [--strong-length=bytes]\n   [--rollsum=rabinkarp|rollsum] [--jobs=n] old-file|old-dir\n   signature-file|-"
+	DELTA_COMMAND     = " rdiff delta [--format=plain|librsync] [--force]\n   [--compress=none|gzip|zstd] [--jobs=n] [--memory-limit=bytes]\n   signature-file|- new-file|new-dir|- delta-file|-"
+	PATCH_COMMAND     = " rdiff patch [--format=plain|librsync] [--force] basis-file|basis-dir\n   delta-file|- new-file|new-dir|-"
+	INSPECT_COMMAND   = " rdiff inspect [--json] signature-or-delta-file|-"
+	VERIFY_COMMAND    = " rdiff verify [--format=plain|librsync] basis-file delta-file|-\n   [target-file|-]"
+	SERVE_COMMAND     = " rdiff serve [--listen=address] [--writable] [--timeout=duration] root-dir"
+	PUSH_COMMAND      = " rdiff push [--port=n] local-file|- host:path"
+	PULL_COMMAND      = " rdiff pull [--port=n] host:path local-file"
+	HTTP_COMMAND      = " rdiff http [--listen=address] [--writable] [--max-body=bytes] root-dir"
+	FETCH_COMMAND     = " rdiff fetch [--signature=url|file|-] [--jobs=n] [--memory-limit=bytes]\n   url local-file"
+
+	USAGE_TEXT = "Usage:\n" +
+		SIGNATURE_COMMAND + "\n" +
+		DELTA_COMMAND + "\n" +
+		PATCH_COMMAND + "\n" +
+		INSPECT_COMMAND + "\n" +
+		VERIFY_COMMAND + "\n" +
+		SERVE_COMMAND + "\n" +
+		PUSH_COMMAND + "\n" +
+		PULL_COMMAND + "\n" +
+		HTTP_COMMAND + "\n" +
+		FETCH_COMMAND
+	SIGNATURE_USAGE = "Signature usage:\n" + SIGNATURE_COMMAND
+	DELTA_USAGE     = "Delta usage:\n" + DELTA_COMMAND
+	PATCH_USAGE     = "Patch usage:\n" + PATCH_COMMAND
+	INSPECT_USAGE   = "Inspect usage:\n" + INSPECT_COMMAND
+	VERIFY_USAGE    = "Verify usage:\n" + VERIFY_COMMAND
+	SERVE_USAGE     = "Serve usage:\n" + SERVE_COMMAND
+	PUSH_USAGE      = "Push usage:\n" + PUSH_COMMAND
+	PULL_USAGE      = "Pull usage:\n" + PULL_COMMAND
+	HTTP_USAGE      = "HTTP usage:\n" + HTTP_COMMAND
+	FETCH_USAGE     = "Fetch usage:\n" + FETCH_COMMAND
 )
 
-const WINDOW_LENGTH = 5000
+const (
+	FORMAT_FLAG_USAGE     = "file format: plain or librsync"
+	BLOCK_SIZE_FLAG_USAGE = "block size in bytes or auto to pick it from the old file size, 5000 (2048 for librsync) by default, at most 16 MiB"
+	STRONG_LENGTH_USAGE   = "length in bytes strong hashes are truncated to, 0 keeps them whole"
+	ROLLSUM_FLAG_USAGE    = "rolling checksum of librsync signatures: rabinkarp, or rollsum for librsync before 2.2"
+	FORCE_FLAG_USAGE      = "overwrite the output file if it exists"
+	COMPRESS_FLAG_USAGE   = "compression of plain deltas: none, gzip or zstd"
+	JOBS_FLAG_USAGE       = "number of segments processed concurrently, 0 uses all CPUs"
+	MEMORY_LIMIT_USAGE    = "bytes of the new file held in memory at once, 0 keeps the default of 256 MiB"
+	JSON_FLAG_USAGE       = "print the report as JSON"
+	LISTEN_FLAG_USAGE     = "address to listen on, use :port to accept connections from other machines"
+	WRITABLE_FLAG_USAGE   = "let clients replace files under the root directory"
+	TIMEOUT_FLAG_USAGE    = "time every frame of a session has to arrive or be read, such as 30s or 5m"
+	PORT_FLAG_USAGE       = "TCP port of the server"
+	SIGNATURE_FLAG_USAGE  = "URL, file or - for the signature, the URL followed by .sig by default"
+	MAX_BODY_FLAG_USAGE   = "bytes accepted in a request body, 0 keeps the default of 256 MiB"
+)
 
 func main() {
 	log.SetFlags(0)
-	if len(os.Args) < 2 {
-		log.Fatal(USAGE_TEXT)
-		return
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := run(ctx, os.Args[1:])
+	stop()
+	if err != nil {
+		log.Print(err)
+		os.Exit(exitCode(err))
+	}
+}
+
+func run(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return usageError(USAGE_TEXT)
 	}
-	switch os.Args[1] {
+	switch args[0] {
 	case MODE_SIGNATURE:
-		if len(os.Args) != 4 {
-			log.Fatal(SIGNATURE_USAGE)
+		flags := flag.NewFlagSet(MODE_SIGNATURE, flag.ExitOnError)
+		format := flags.String("format", "plain", FORMAT_FLAG_USAGE)
+		force := flags.Bool("force", false, FORCE_FLAG_USAGE)
+		blockSize := flags.String("block-size", "", BLOCK_SIZE_FLAG_USAGE)
+		flags.StringVar(blockSize, "b", "", BLOCK_SIZE_FLAG_USAGE)
+		hash := flags.String("hash", "", "strong hash: "+strings.Join(rdiff.StrongHashNames(), ", "))
+		strongLength := flags.Int("strong-length", 0, STRONG_LENGTH_USAGE)
+		rollsum := flags.String("rollsum", "rabinkarp", ROLLSUM_FLAG_USAGE)
+		jobs := flags.Int("jobs", 0, JOBS_FLAG_USAGE)
+		flags.Parse(args[1:])
+		if flags.NArg() != 2 {
+			return usageError(SIGNATURE_USAGE)
+		}
+		oldFile := flags.Arg(0)
+		signatureFile := flags.Arg(1)
+		if !exists(oldFile) {
+			return fmt.Errorf("provided old file doesn't exist: %w", fs.ErrNotExist)
+		}
+		if signatureFile != STDIO_OPERAND && !*force && exists(signatureFile) {
+			return usageError("provided signature file already exists, use --force to overwrite it")
+		}
+		opts := rdiff.SignatureOptions{StrongHashLength: *strongLength}
+		var err error
+		if opts.Jobs, err = parseJobs(*jobs); err != nil {
+			return err
+		}
+		if opts.Format, err = parseFormat(*format); err != nil {
+			return err
 		}
-		oldFile := os.Args[2]
-		signatureFile := os.Args[3]
-		if !exists(fmt.Sprintf("%s/%s", getExecutionDir(), oldFile)) {
-			log.Fatalf("provided old file doesn't exist")
+		if opts.BlockLength, err = parseBlockSize(*blockSize); err != nil {
+			return err
 		}
-		if exists(fmt.Sprintf("%s/%s", getExecutionDir(), signatureFile)) {
-			log.Fatalf("provided signature file already exists")
+		if opts.StrongHash, err = parseStrongHash(*hash); err != nil {
+			return err
 		}
-		signatureFlow(oldFile, signatureFile, WINDOW_LENGTH)
+		if opts.LibrsyncMagic, err = parseRollsum(*rollsum, opts); err != nil {
+			return err
+		}
+		if isDir(oldFile) {
+			if err = checkTreeFormat(opts.Format); err != nil {
+				return err
+			}
+			return treeSignatureFlow(ctx, oldFile, signatureFile, opts)
+		}
+		return signatureFlow(ctx, oldFile, signatureFile, opts)
 	case MODE_DELTA:
-		if len(os.Args) != 5 {
-			log.Fatal(DELTA_USAGE)
+		flags := flag.NewFlagSet(MODE_DELTA, flag.ExitOnError)
+		format := flags.String("format", "plain", FORMAT_FLAG_USAGE)
+		force := flags.Bool("force", false, FORCE_FLAG_USAGE)
+		compress := flags.String("compress", "none", COMPRESS_FLAG_USAGE)
+		jobs := flags.Int("jobs", 0, JOBS_FLAG_USAGE)
+		memoryLimit := flags.Int("memory-limit", 0, MEMORY_LIMIT_USAGE)
+		flags.Parse(args[1:])
+		if flags.NArg() != 3 {
+			return usageError(DELTA_USAGE)
+		}
+		signatureFile := flags.Arg(0)
+		newFile := flags.Arg(1)
+		deltaFile := flags.Arg(2)
+		if signatureFile == STDIO_OPERAND && newFile == STDIO_OPERAND {
+			return usageError("only one of signature file and new file can be read from standard input")
+		}
+		if signatureFile != STDIO_OPERAND && !exists(signatureFile) {
+			return fmt.Errorf("provided signature file doesn't exist: %w", fs.ErrNotExist)
+		}
+		if newFile != STDIO_OPERAND && !exists(newFile) {
+			return fmt.Errorf("provided new file doesn't exist: %w", fs.ErrNotExist)
+		}
+		if deltaFile != STDIO_OPERAND && !*force && exists(deltaFile) {
+			return usageError("provided delta file already exists, use --force to overwrite it")
 		}
-		signatureFile := os.Args[2]
-		newFile := os.Args[3]
-		deltaFile := os.Args[4]
-		if !exists(fmt.Sprintf("%s/%s", getExecutionDir(), signatureFile)) {
-			log.Fatalf("provided signature file doesn't exist")
+		if *memoryLimit < 0 {
+			return usageError(fmt.Sprintf("invalid memory limit: %d", *memoryLimit))
 		}
-		if !exists(fmt.Sprintf("%s/%s", getExecutionDir(), newFile)) {
-			log.Fatalf("provided new file doesn't exist")
+		opts := rdiff.DeltaOptions{MemoryLimit: *memoryLimit}
+		var err error
+		if opts.Jobs, err = parseJobs(*jobs); err != nil {
+			return err
 		}
-		if exists(fmt.Sprintf("%s/%s", getExecutionDir(), deltaFile)) {
-			log.Fatalf("provided delta file already exists")
+		if opts.Format, err = parseFormat(*format); err != nil {
+			return err
 		}
-		deltaFlow(signatureFile, newFile, deltaFile, WINDOW_LENGTH)
+		if opts.Compression, err = parseCompression(*compress); err != nil {
+			return err
+		}
+		if isDir(newFile) {
+			if err = checkTreeFormat(opts.Format); err != nil {
+				return err
+			}
+			return treeDeltaFlow(ctx, signatureFile, newFile, deltaFile, opts)
+		}
+		return deltaFlow(ctx, signatureFile, newFile, deltaFile, opts)
 	case MODE_PATCH:
-		if len(os.Args) != 5 {
-			log.Fatal(PATCH_USAGE)
+		flags := flag.NewFlagSet(MODE_PATCH, flag.ExitOnError)
+		format := flags.String("format", "plain", FORMAT_FLAG_USAGE)
+		force := flags.Bool("force", false, FORCE_FLAG_USAGE)
+		flags.Parse(args[1:])
+		if flags.NArg() != 3 {
+			return usageError(PATCH_USAGE)
+		}
+		basisFile := flags.Arg(0)
+		deltaFile := flags.Arg(1)
+		newFile := flags.Arg(2)
+		if !exists(basisFile) {
+			return fmt.Errorf("provided basis file doesn't exist: %w", fs.ErrNotExist)
+		}
+		if deltaFile != STDIO_OPERAND && !exists(deltaFile) {
+			return fmt.Errorf("provided delta file doesn't exist: %w", fs.ErrNotExist)
+		}
+		if newFile != STDIO_OPERAND && !*force && exists(newFile) {
+			return usageError("provided new file already exists, use --force to overwrite it")
+		}
+		f, err := parseFormat(*format)
+		if err != nil {
+			return err
+		}
+		if isDir(basisFile) {
+			if newFile == STDIO_OPERAND {
+				return usageError("a new tree cannot be written to standard output")
+			}
+			if err = checkTreeFormat(f); err != nil {
+				return err
+			}
+			return treePatchFlow(ctx, basisFile, deltaFile, newFile, rdiff.PatchOptions{Format: f})
+		}
+		return patchFlow(ctx, basisFile, deltaFile, newFile, rdiff.PatchOptions{Format: f})
+	case MODE_INSPECT:
+		flags := flag.NewFlagSet(MODE_INSPECT, flag.ExitOnError)
+		asJSON := flags.Bool("json", false, JSON_FLAG_USAGE)
+		flags.Parse(args[1:])
+		if flags.NArg() != 1 {
+			return usageError(INSPECT_USAGE)
+		}
+		file := flags.Arg(0)
+		if file != STDIO_OPERAND && !exists(file) {
+			return fmt.Errorf("provided file doesn't exist: %w", fs.ErrNotExist)
+		}
+		return inspectFlow(ctx, file, *asJSON, os.Stdout)
+	case MODE_VERIFY:
+		flags := flag.NewFlagSet(MODE_VERIFY, flag.ExitOnError)
+		format := flags.String("format", "plain", FORMAT_FLAG_USAGE)
+		flags.Parse(args[1:])
+		if flags.NArg() != 2 && flags.NArg() != 3 {
+			return usageError(VERIFY_USAGE)
+		}
+		basisFile := flags.Arg(0)
+		deltaFile := flags.Arg(1)
+		targetFile := flags.Arg(2)
+		if deltaFile == STDIO_OPERAND && targetFile == STDIO_OPERAND {
+			return usageError("only one of delta file and target file can be read from standard input")
+		}
+		if !exists(basisFile) {
+			return fmt.Errorf("provided basis file doesn't exist: %w", fs.ErrNotExist)
+		}
+		if deltaFile != STDIO_OPERAND && !exists(deltaFile) {
+			return fmt.Errorf("provided delta file doesn't exist: %w", fs.ErrNotExist)
+		}
+		if targetFile != "" && targetFile != STDIO_OPERAND && !exists(targetFile) {
+			return fmt.Errorf("provided target file doesn't exist: %w", fs.ErrNotExist)
+		}
+		f, err := parseFormat(*format)
+		if err != nil {
+			return err
+		}
+		return verifyFlow(ctx, basisFile, deltaFile, targetFile, rdiff.PatchOptions{Format: f})
+	case MODE_SERVE:
+		flags := flag.NewFlagSet(MODE_SERVE, flag.ExitOnError)
+		listen := flags.String("listen", net.JoinHostPort(DEFAULT_LISTEN_HOST, strconv.Itoa(DEFAULT_PORT)), LISTEN_FLAG_USAGE)
+		writable := flags.Bool("writable", false, WRITABLE_FLAG_USAGE)
+		timeout := flags.Duration("timeout", DEFAULT_TIMEOUT, TIMEOUT_FLAG_USAGE)
+		flags.Parse(args[1:])
+		if flags.NArg() != 1 {
+			return usageError(SERVE_USAGE)
 		}
-		basisFile := os.Args[2]
-		deltaFile := os.Args[3]
-		newFile := os.Args[4]
-		if !exists(fmt.Sprintf("%s/%s", getExecutionDir(), basisFile)) {
-			log.Fatalf("provided basis file doesn't exist")
+		root := flags.Arg(0)
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			return fmt.Errorf("provided root directory doesn't exist: %w", fs.ErrNotExist)
 		}
-		if !exists(fmt.Sprintf("%s/%s", getExecutionDir(), deltaFile)) {
-			log.Fatalf("provided delta file doesn't exist")
+		if *timeout <= 0 {
+			return usageError(fmt.Sprintf("invalid timeout: %s", *timeout))
 		}
-		if exists(fmt.Sprintf("%s/%s", getExecutionDir(), newFile)) {
-			log.Fatalf("provided new file already exists")
+		return serveFlow(ctx, *listen, root, *writable, *timeout)
+	case MODE_PUSH:
+		flags := flag.NewFlagSet(MODE_PUSH, flag.ExitOnError)
+		port := flags.Int("port", DEFAULT_PORT, PORT_FLAG_USAGE)
+		flags.Parse(args[1:])
+		if flags.NArg() != 2 {
+			return usageError(PUSH_USAGE)
 		}
-		patchFlow(basisFile, deltaFile, newFile)
-	default:
-		fmt.Println(USAGE_TEXT)
+		localFile := flags.Arg(0)
+		if localFile != STDIO_OPERAND && !exists(localFile) {
+			return fmt.Errorf("provided local file doesn't exist: %w", fs.ErrNotExist)
+		}
+		return pushFlow(ctx, localFile, flags.Arg(1), *port)
+	case MODE_PULL:
+		flags := flag.NewFlagSet(MODE_PULL, flag.ExitOnError)
+		port := flags.Int("port", DEFAULT_PORT, PORT_FLAG_USAGE)
+		flags.Parse(args[1:])
+		if flags.NArg() != 2 {
+			return usageError(PULL_USAGE)
+		}
+		return pullFlow(ctx, flags.Arg(0), flags.Arg(1), *port)
+	case MODE_HTTP:
+		flags := flag.NewFlagSet(MODE_HTTP, flag.ExitOnError)
+		listen := flags.String("listen", net.JoinHostPort(DEFAULT_LISTEN_HOST, strconv.Itoa(DEFAULT_HTTP_PORT)), LISTEN_FLAG_USAGE)
+		writable := flags.Bool("writable", false, WRITABLE_FLAG_USAGE)
+		maxBody := flags.Int64("max-body", 0, MAX_BODY_FLAG_USAGE)
+		flags.Parse(args[1:])
+		if flags.NArg() != 1 {
+			return usageError(HTTP_USAGE)
+		}
+		root := flags.Arg(0)
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			return fmt.Errorf("provided root directory doesn't exist: %w", fs.ErrNotExist)
+		}
+		if *maxBody < 0 {
+			return usageError(fmt.Sprintf("invalid maximum body length: %d", *maxBody))
+		}
+		return httpFlow(ctx, *listen, root, *writable, *maxBody)
+	case MODE_FETCH:
+		flags := flag.NewFlagSet(MODE_FETCH, flag.ExitOnError)
+		signature := flags.String("signature", "", SIGNATURE_FLAG_USAGE)
+		jobs := flags.Int("jobs", 0, JOBS_FLAG_USAGE)
+		memoryLimit := flags.Int("memory-limit", 0, MEMORY_LIMIT_USAGE)
+		flags.Parse(args[1:])
+		if flags.NArg() != 2 {
+			return usageError(FETCH_USAGE)
+		}
+		if *signature != "" && *signature != STDIO_OPERAND && !isHTTPURL(*signature) && !exists(*signature) {
+			return fmt.Errorf("provided signature file doesn't exist: %w", fs.ErrNotExist)
+		}
+		if *memoryLimit < 0 {
+			return usageError(fmt.Sprintf("invalid memory limit: %d", *memoryLimit))
+		}
+		opts := rdiff.FetchOptions{MemoryLimit: *memoryLimit}
+		var err error
+		if opts.Jobs, err = parseJobs(*jobs); err != nil {
+			return err
+		}
+		return fetchFlow(ctx, flags.Arg(0), flags.Arg(1), *signature, opts)
 	}
+	return usageError(USAGE_TEXT)
 }
 
-func getExecutionDir() string {
-	ex, err := os.Executable()
+func parseBlockSize(blockSize string) (int, error) {
+	switch blockSize {
+	case "":
+		return 0, nil
+	case "auto":
+		return rdiff.AUTO_BLOCK_LENGTH, nil
+	}
+	b, err := strconv.Atoi(blockSize)
+	if err != nil || b <= 0 || b > rdiff.MAX_BLOCK_LENGTH {
+		return 0, usageError(fmt.Sprintf("invalid block size: %s", blockSize))
+	}
+	return b, nil
+}
+
+func parseStrongHash(hash string) (rdiff.StrongHashType, error) {
+	if hash == "" {
+		return 0, nil
+	}
+	h, err := rdiff.ParseStrongHash(hash)
+	if err != nil {
+		return 0, usageError(err.Error())
+	}
+	return h, nil
+}
+
+// parseRollsum returns the librsync magic selected by rollsum, or 0 to keep
+// the default.
+func parseRollsum(rollsum string, opts rdiff.SignatureOptions) (uint32, error) {
+	switch {
+	case rollsum == "rabinkarp":
+		return 0, nil
+	case rollsum != "rollsum":
+		return 0, usageError(fmt.Sprintf("invalid rolling checksum: %s", rollsum))
+	case opts.Format != rdiff.FORMAT_LIBRSYNC:
+		return 0, usageError("--rollsum applies only to librsync signatures")
+	}
+	magic, err := rdiff.LibrsyncSignatureMagic(opts.StrongHash, false)
+	if err != nil {
+		return 0, usageError(err.Error())
+	}
+	return magic, nil
+}
+
+func parseFormat(format string) (rdiff.Format, error) {
+	f, err := rdiff.ParseFormat(format)
+	if err != nil {
+		return 0, usageError(err.Error())
+	}
+	return f, nil
+}
+
+func parseCompression(compression string) (rdiff.Compression, error) {
+	c, err := rdiff.ParseCompression(compression)
 	if err != nil {
-		panic(err)
+		return 0, usageError(err.Error())
+	}
+	return c, nil
+}
+
+func parseJobs(jobs int) (int, error) {
+	if jobs < 0 {
+		return 0, usageError(fmt.Sprintf("invalid number of jobs: %d", jobs))
 	}
-	return filepath.Dir(ex)
+	return jobs, nil
 }
 
 // exists returns whether the given file or directory exists
@@ -103,113 +423,77 @@ func exists(path string) bool {
 	return false
 }
 
-func signatureFlow(oldFilePath, signatureFilePath string, windowSize int) {
-	c := make(chan []byte)
-
-	go func() {
-		reader, err := GetFileReader(oldFilePath)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		bufferedReader := NewBufferedReader(windowSize, reader)
-		err = CalculateAndSendChecksums(bufferedReader, c, CalculateChecksumWithoutPreviousCompounds)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}()
-
-	err := CreateAndFillFile(signatureFilePath, c)
+func signatureFlow(ctx context.Context, oldFilePath, signatureFilePath string, opts rdiff.SignatureOptions) error {
+	oldFile, err := GetFileReader(oldFilePath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer oldFile.Close()
+
+	return CreateAndFillFile(signatureFilePath, func(w io.Writer) error {
+		return rdiff.SignatureContext(ctx, oldFile, w, opts)
+	})
 }
 
-func deltaFlow(signatureFilePath, newFilePath, deltaFilePath string, windowSize int) {
-	bundles, err := ReadSignatureFile(signatureFilePath)
+func deltaFlow(ctx context.Context, signatureFilePath, newFilePath, deltaFilePath string, opts rdiff.DeltaOptions) error {
+	signatureFile, err := GetInputReader(signatureFilePath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer signatureFile.Close()
 
-	reader, err := GetFileReader(newFilePath)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer reader.Close()
-
-	c := make(chan DeltaChunk)
-	go func() {
-		checksums, hashes := getRollingChecksumAndHashes(bundles)
-		br := NewBufferedReader(windowSize, reader)
-		err := CalculateAndSendDeltaChunks(
-			br,
-			c,
-			checksums,
-			hashes,
-			findMatchingOffset,
-			CalculateChecksum,
-		)
-		if err != nil {
-			panic(err)
-		}
-	}()
-
-	err = CreateAndFillDeltaFile(deltaFilePath, c)
+	newFile, err := GetInputReader(newFilePath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-}
+	defer newFile.Close()
 
-func patchFlow(basisFilePath, deltaFilePath, newFilePath string) {
-	c := make(chan DeltaChunk)
-	newFileWriterChan := make(chan []byte)
+	return CreateAndFillFile(deltaFilePath, func(w io.Writer) error {
+		return rdiff.DeltaContext(ctx, signatureFile, newFile, w, opts)
+	})
+}
 
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
-		f, err := GetFileReader(deltaFilePath)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer f.Close()
+func patchFlow(ctx context.Context, basisFilePath, deltaFilePath, newFilePath string, opts rdiff.PatchOptions) error {
+	basisFile, err := GetFileReader(basisFilePath)
+	if err != nil {
+		return err
+	}
+	defer basisFile.Close()
 
-		err = DeltaReader(f, c)
-		if err != nil {
-			panic(err)
-		}
-		wg.Done()
-	}()
+	deltaFile, err := GetInputReader(deltaFilePath)
+	if err != nil {
+		return err
+	}
+	defer deltaFile.Close()
 
-	wg.Add(1)
-	go func() {
-		err := CreateAndFillFile(newFilePath, newFileWriterChan)
-		if err != nil {
-			panic(err)
-		}
-		wg.Done()
-	}()
+	return CreateAndFillFile(newFilePath, func(w io.Writer) error {
+		return rdiff.PatchContext(ctx, basisFile, deltaFile, w, opts)
+	})
+}
 
-	f, err := GetFileReader(basisFilePath)
+// verifyFlow checks that the delta recreates the target file, or the file
+// recorded in the delta if targetFilePath is empty.
+func verifyFlow(ctx context.Context, basisFilePath, deltaFilePath, targetFilePath string, opts rdiff.PatchOptions) error {
+	basisFile, err := GetFileReader(basisFilePath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer f.Close()
+	defer basisFile.Close()
 
-	err = Patch(c, f, newFileWriterChan)
+	deltaFile, err := GetInputReader(deltaFilePath)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	wg.Wait()
-}
+	defer deltaFile.Close()
 
-func getRollingChecksumAndHashes(bundles [][]byte) (map[uint32]int, [][]byte) {
-	rollingChecksumsToIndexes := make(map[uint32]int, len(bundles))
-	hashes := make([][]byte, len(bundles))
-	for i, b := range bundles {
-		checksum := b[:4]
-		uintChecksum := binary.BigEndian.Uint32(checksum)
-		rollingChecksumsToIndexes[uintChecksum] = i
-		hashes[i] = b[4:]
+	if targetFilePath == "" {
+		return rdiff.VerifyContext(ctx, basisFile, deltaFile, nil, opts)
 	}
-	return rollingChecksumsToIndexes, hashes
+	targetFile, err := GetInputReader(targetFilePath)
+	if err != nil {
+		return err
+	}
+	defer targetFile.Close()
+
+	return rdiff.VerifyContext(ctx, basisFile, deltaFile, targetFile, opts)
 }
@@ -0,0 +1,94 @@
+package rdiff
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the algorithm compressing operations of a delta, recorded
+// in its header.
+type Compression uint8
+
+const (
+	COMPRESSION_NONE Compression = 0
+	COMPRESSION_GZIP Compression = 1
+	COMPRESSION_ZSTD Compression = 2
+)
+
+// ZSTD_MAX_WINDOW limits the memory a zstd compressed delta can make Patch
+// allocate.
+const ZSTD_MAX_WINDOW = 64 << 20
+
+var ErrUnsupportedCompression = errors.New("unsupported compression")
+
+func ParseCompression(s string) (Compression, error) {
+	switch s {
+	case "none":
+		return COMPRESSION_NONE, nil
+	case "gzip":
+		return COMPRESSION_GZIP, nil
+	case "zstd":
+		return COMPRESSION_ZSTD, nil
+	}
+	return 0, fmt.Errorf("%w: %s", ErrUnsupportedCompression, s)
+}
+
+func (c Compression) String() string {
+	switch c {
+	case COMPRESSION_NONE:
+		return "none"
+	case COMPRESSION_GZIP:
+		return "gzip"
+	case COMPRESSION_ZSTD:
+		return "zstd"
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+func (c Compression) valid() bool {
+	return c <= COMPRESSION_ZSTD
+}
+
+// writer returns a writer compressing data written to it into w. Closing it
+// flushes the compressed data without closing w. zstd uses a single encoder
+// so its buffers stay within a few windows.
+func (c Compression) writer(w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case COMPRESSION_NONE:
+		return nopWriteCloser{w}, nil
+	case COMPRESSION_GZIP:
+		return gzip.NewWriter(w), nil
+	case COMPRESSION_ZSTD:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("%w: %d", ErrUnsupportedCompression, c)
+}
+
+// reader returns a reader decompressing data read from r.
+func (c Compression) reader(r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case COMPRESSION_NONE:
+		return io.NopCloser(r), nil
+	case COMPRESSION_GZIP:
+		return gzip.NewReader(r)
+	case COMPRESSION_ZSTD:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(ZSTD_MAX_WINDOW))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("%w: %d", ErrUnsupportedCompression, c)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,535 @@
+package rdiff
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sync"
+)
+
+const (
+	OPCODE_LITERAL byte = 0
+	OPCODE_COPY    byte = 1
+	OPCODE_END     byte = 2
+	// OPCODE_COMPACT_LITERAL is followed by the varint length of data.
+	OPCODE_COMPACT_LITERAL byte = 3
+	// OPCODE_COMPACT_COPY is followed by the signed varint offset of the range
+	// relative to the end of the previous copy and its varint length.
+	OPCODE_COMPACT_COPY byte = 4
+)
+
+// LITERAL_CHUNK_LENGTH is the maximal length of literals written by Delta,
+// longer unmatched data is split into several literals.
+const LITERAL_CHUNK_LENGTH = 1 << 20
+
+// DELTA_SEGMENT_LENGTH is the length of the segments of the new file
+// searched concurrently by CalculateAndSendDeltaChunksConcurrently, unless
+// blocks are so long that a segment has to be longer.
+const DELTA_SEGMENT_LENGTH = 8 << 20
+
+type Range struct {
+	from *uint64
+	to   *uint64
+}
+
+func (r *Range) empty() bool {
+	return r.from == nil && r.to == nil
+}
+
+func (r *Range) clear() {
+	r.from = nil
+	r.to = nil
+}
+
+func (r *Range) set(from int, to int) {
+	f := uint64(from)
+	t := uint64(to)
+	r.from = &f
+	r.to = &t
+}
+
+func (r *Range) shiftToBy(shiftLen int) {
+	*r.to += uint64(shiftLen)
+}
+
+type DeltaChunk struct {
+	r       Range
+	d       []byte
+	rawData bool
+}
+
+func NewDeltaChunkWithRange(r Range) DeltaChunk {
+	return DeltaChunk{
+		r: r,
+	}
+}
+
+func NewDeltaChunkWithRawData(data []byte) DeltaChunk {
+	return DeltaChunk{
+		d:       data,
+		rawData: true,
+	}
+}
+
+func (c DeltaChunk) ToBytes() []byte {
+	if !c.rawData {
+		bytes := make([]byte, 1+8+8)
+		bytes[0] = OPCODE_COPY
+
+		binary.BigEndian.PutUint64(bytes[1:9], *c.r.from)
+		binary.BigEndian.PutUint64(bytes[9:17], *c.r.to)
+		return bytes
+	}
+	unmatchedDataLen := len(c.d)
+	bytes := make([]byte, 1+8+unmatchedDataLen)
+	bytes[0] = OPCODE_LITERAL
+	binary.BigEndian.PutUint64(bytes[1:9], uint64(unmatchedDataLen))
+	for i, ii := 9, 0; i < len(bytes); i++ {
+		bytes[i] = c.d[ii]
+		ii++
+	}
+	return bytes
+}
+
+// IsLiteral returns whether c carries literal data rather than a range of
+// the basis file.
+func (c DeltaChunk) IsLiteral() bool {
+	return c.rawData
+}
+
+// Data returns the literal data of c.
+func (c DeltaChunk) Data() []byte {
+	return c.d
+}
+
+// Range returns the range of the basis file copied by c.
+func (c DeltaChunk) Range() (from, to uint64) {
+	return *c.r.from, *c.r.to
+}
+
+// Len returns the number of bytes c adds to the new file.
+func (c DeltaChunk) Len() uint64 {
+	if c.rawData {
+		return uint64(len(c.d))
+	}
+	return *c.r.to - *c.r.from
+}
+
+// slice returns the part of c between from and to, relative to its start.
+func (c DeltaChunk) slice(from, to uint64) DeltaChunk {
+	if c.rawData {
+		return NewDeltaChunkWithRawData(c.d[from:to])
+	}
+	r := Range{}
+	r.set(int(*c.r.from+from), int(*c.r.from+to))
+	return NewDeltaChunkWithRange(r)
+}
+
+// compactEncoder returns a function encoding chunks with compact operations,
+// which have to be written in order as copy offsets are relative to the
+// previous copy.
+func compactEncoder() func(DeltaChunk) []byte {
+	var previousTo uint64
+	return func(c DeltaChunk) []byte {
+		if !c.rawData {
+			bytes := make([]byte, 1+2*binary.MaxVarintLen64)
+			bytes[0] = OPCODE_COMPACT_COPY
+			n := 1 + binary.PutVarint(bytes[1:], int64(*c.r.from-previousTo))
+			n += binary.PutUvarint(bytes[n:], *c.r.to-*c.r.from)
+			previousTo = *c.r.to
+			return bytes[:n]
+		}
+		bytes := make([]byte, 1+binary.MaxVarintLen64+len(c.d))
+		bytes[0] = OPCODE_COMPACT_LITERAL
+		n := 1 + binary.PutUvarint(bytes[1:], uint64(len(c.d)))
+		n += copy(bytes[n:], c.d)
+		return bytes[:n]
+	}
+}
+
+func CalculateAndSendDeltaChunks(
+	ctx context.Context,
+	referenceFileReader bufferedReader,
+	deltaChunkChan chan<- DeltaChunk,
+	findMatchingOffset func([]byte, uint32, int) (bool, int),
+	checksumCalculation func([]byte, *byte, int, *uint32, *uint32) (uint32, *uint32, *uint32),
+) error {
+	defer close(deltaChunkChan)
+
+	var unmatchedBytes []byte
+	var checksum uint32
+	var readBytes int
+	var pop *byte
+	var a *uint32
+	var b *uint32
+	var err error
+	r := Range{}
+
+	for {
+		if a == nil && b == nil {
+			readBytes, err = referenceFileReader.ReadWindow()
+			if err != nil {
+				return err
+			}
+			if readBytes == 0 {
+				if !r.empty() {
+					if err := sendDeltaChunk(ctx, deltaChunkChan, NewDeltaChunkWithRange(r)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+		}
+		checksum, a, b = checksumCalculation(
+			referenceFileReader.Buf(),
+			pop,
+			referenceFileReader.WindowLen(),
+			a,
+			b,
+		)
+		matching, offset := findMatchingOffset(
+			referenceFileReader.Buf(),
+			checksum,
+			nextBlockIndex(r, referenceFileReader.WindowLen()),
+		)
+		if matching {
+			a, b = nil, nil
+			if len(unmatchedBytes) > 0 {
+				if err := sendDeltaChunk(ctx, deltaChunkChan, NewDeltaChunkWithRawData(unmatchedBytes)); err != nil {
+					return err
+				}
+				unmatchedBytes = []byte{}
+			}
+			if r.empty() {
+				r.set(offset*referenceFileReader.WindowLen(), offset*referenceFileReader.WindowLen()+referenceFileReader.Len())
+				continue
+			}
+			if *r.to == uint64(offset*referenceFileReader.WindowLen()) {
+				r.shiftToBy(referenceFileReader.Len())
+				continue
+			}
+
+			if err := sendDeltaChunk(ctx, deltaChunkChan, NewDeltaChunkWithRange(r)); err != nil {
+				return err
+			}
+			r.set(offset*referenceFileReader.WindowLen(), offset*referenceFileReader.WindowLen()+referenceFileReader.Len())
+			continue
+		}
+
+		if !r.empty() {
+			if err := sendDeltaChunk(ctx, deltaChunkChan, NewDeltaChunkWithRange(r)); err != nil {
+				return err
+			}
+			r.clear()
+		}
+
+		p, err := referenceFileReader.PopAndShift()
+		pop = &p
+		if err != nil {
+			if errors.Is(err, ErrEmptyBuffer) {
+				if len(unmatchedBytes) > 0 {
+					if err := sendDeltaChunk(ctx, deltaChunkChan, NewDeltaChunkWithRawData(unmatchedBytes)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			return err
+		}
+		unmatchedBytes = append(unmatchedBytes, p)
+		if len(unmatchedBytes) == LITERAL_CHUNK_LENGTH {
+			if err := sendDeltaChunk(ctx, deltaChunkChan, NewDeltaChunkWithRawData(unmatchedBytes)); err != nil {
+				return err
+			}
+			// A full chunk is likely followed by another one.
+			unmatchedBytes = make([]byte, 0, LITERAL_CHUNK_LENGTH)
+		}
+	}
+}
+
+// deltaSegment is a part of the new file starting at start, followed by the
+// beginning of the next segment so matches can span the boundary.
+type deltaSegment struct {
+	index int
+	start uint64
+	data  []byte
+	last  bool
+}
+
+type segmentDeltaChunks struct {
+	deltaSegment
+	chunks []DeltaChunk
+	err    error
+}
+
+// CalculateAndSendDeltaChunksConcurrently is like CalculateAndSendDeltaChunks
+// but reads newFile in segments searched by jobs goroutines, keeping at most
+// segments of them in memory. Chunks of
+// neighbouring segments are stitched together in order: a copy crossing the
+// boundary wins over whatever the next segment found in its range and
+// adjacent copies are merged. Every byte of newFile is passed to sink in
+// order.
+func CalculateAndSendDeltaChunksConcurrently(
+	ctx context.Context,
+	newFile io.Reader,
+	blockLength int,
+	jobs int,
+	segments int,
+	deltaChunkChan chan<- DeltaChunk,
+	findMatchingOffset func([]byte, uint32, int) (bool, int),
+	checksumCalculation func([]byte, *byte, int, *uint32, *uint32) (uint32, *uint32, *uint32),
+	sink io.Writer,
+) error {
+	defer close(deltaChunkChan)
+	ctx, cancel := context.WithCancel(ctx)
+
+	segmentLength := deltaSegmentLength(blockLength)
+	if jobs > segments {
+		jobs = segments
+	}
+	tokens := make(chan struct{}, segments)
+	segmentChan := make(chan deltaSegment)
+	results := make(chan segmentDeltaChunks, cap(tokens))
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(segmentChan)
+		err := readDeltaSegments(ctx, newFile, segmentLength, blockLength-1, tokens, segmentChan, sink)
+		if err != nil {
+			results <- segmentDeltaChunks{err: err}
+		}
+	}()
+	for j := 0; j < jobs; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for segment := range segmentChan {
+				results <- searchDeltaSegment(
+					ctx,
+					segment,
+					blockLength,
+					findMatchingOffset,
+					checksumCalculation,
+				)
+			}
+		}()
+	}
+
+	stitcher := deltaStitcher{ctx: ctx, c: deltaChunkChan}
+	pending := map[int]segmentDeltaChunks{}
+	for next := 0; ; {
+		select {
+		case result := <-results:
+			if result.err != nil {
+				return result.err
+			}
+			pending[result.index] = result
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		for result, ok := pending[next]; ok; result, ok = pending[next] {
+			delete(pending, next)
+			cut := result.start + uint64(segmentLength)
+			if result.last {
+				cut = math.MaxUint64
+			}
+			err := stitcher.add(result.start, result.chunks, cut)
+			if err != nil {
+				return err
+			}
+			if result.last {
+				return stitcher.flush()
+			}
+			next++
+			<-tokens
+		}
+	}
+}
+
+func deltaSegmentLength(blockLength int) int {
+	if DELTA_SEGMENT_LENGTH < 4*blockLength {
+		return 4 * blockLength
+	}
+	return DELTA_SEGMENT_LENGTH
+}
+
+// sequentialDeltaMemory returns the memory a single job takes for data of
+// the new file whatever the memory limit: its buffered reader and the
+// literal being collected and the one being written.
+func sequentialDeltaMemory(blockLength int) int {
+	readAhead := blockLength
+	if readAhead < READ_AHEAD_LENGTH {
+		readAhead = READ_AHEAD_LENGTH
+	}
+	return blockLength + readAhead + 2*LITERAL_CHUNK_LENGTH
+}
+
+// concurrentDeltaSegments returns how many segments jobs goroutines keep in
+// memoryLimit, at most two per goroutine. A segment takes twice its length
+// at most, once for its data and once for literals found in it.
+func concurrentDeltaSegments(blockLength, jobs, memoryLimit int) int {
+	segments := memoryLimit / (2 * deltaSegmentLength(blockLength))
+	if segments > 2*jobs {
+		return 2 * jobs
+	}
+	return segments
+}
+
+// readDeltaSegments sends segments of newFile followed by overlap bytes of
+// the next one to segments, taking a token for every segment.
+func readDeltaSegments(
+	ctx context.Context,
+	newFile io.Reader,
+	segmentLength int,
+	overlap int,
+	tokens chan struct{},
+	segments chan<- deltaSegment,
+	sink io.Writer,
+) error {
+	var carry []byte
+	for index := 0; ; index++ {
+		select {
+		case tokens <- struct{}{}:
+		case <-ctx.Done():
+			return nil
+		}
+		data := make([]byte, segmentLength+overlap)
+		copy(data, carry)
+		n, err := io.ReadFull(newFile, data[len(carry):])
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		_, werr := sink.Write(data[len(carry) : len(carry)+n])
+		if werr != nil {
+			return werr
+		}
+		segment := deltaSegment{
+			index: index,
+			start: uint64(index) * uint64(segmentLength),
+			data:  data[:len(carry)+n],
+			last:  err != nil,
+		}
+		select {
+		case segments <- segment:
+		case <-ctx.Done():
+			return nil
+		}
+		if segment.last {
+			return nil
+		}
+		carry = data[segmentLength:]
+	}
+}
+
+func searchDeltaSegment(
+	ctx context.Context,
+	segment deltaSegment,
+	blockLength int,
+	findMatchingOffset func([]byte, uint32, int) (bool, int),
+	checksumCalculation func([]byte, *byte, int, *uint32, *uint32) (uint32, *uint32, *uint32),
+) segmentDeltaChunks {
+	c := make(chan DeltaChunk)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- CalculateAndSendDeltaChunks(
+			ctx,
+			NewBufferedReader(blockLength, bytes.NewReader(segment.data)),
+			c,
+			findMatchingOffset,
+			checksumCalculation,
+		)
+	}()
+	result := segmentDeltaChunks{deltaSegment: segment}
+	for chunk := range c {
+		result.chunks = append(result.chunks, chunk)
+	}
+	result.data = nil
+	result.err = <-errChan
+	return result
+}
+
+// deltaStitcher sends chunks of consecutive segments as a single delta,
+// merging adjacent copies.
+type deltaStitcher struct {
+	ctx context.Context
+	c   chan<- DeltaChunk
+	// position is the end of the part of the new file sent so far.
+	position    uint64
+	pendingCopy Range
+}
+
+// add sends chunks of a segment starting at start from position on. The
+// chunk crossing cut is sent whole if it is a copy and up to cut otherwise,
+// nothing after it is sent.
+func (s *deltaStitcher) add(start uint64, chunks []DeltaChunk, cut uint64) error {
+	for _, chunk := range chunks {
+		from, to := start, start+chunk.Len()
+		start = to
+		if to <= s.position {
+			continue
+		}
+		if from < s.position {
+			chunk = chunk.slice(s.position-from, to-from)
+			from = s.position
+		}
+		if from >= cut {
+			return nil
+		}
+		if chunk.rawData && to > cut {
+			chunk = chunk.slice(0, cut-from)
+			to = cut
+		}
+		err := s.send(chunk)
+		if err != nil {
+			return err
+		}
+		s.position = to
+	}
+	return nil
+}
+
+func (s *deltaStitcher) send(chunk DeltaChunk) error {
+	if !chunk.rawData {
+		if !s.pendingCopy.empty() && *s.pendingCopy.to == *chunk.r.from {
+			s.pendingCopy.shiftToBy(int(chunk.Len()))
+			return nil
+		}
+		err := s.flush()
+		if err != nil {
+			return err
+		}
+		s.pendingCopy.set(int(*chunk.r.from), int(*chunk.r.to))
+		return nil
+	}
+	err := s.flush()
+	if err != nil {
+		return err
+	}
+	return sendDeltaChunk(s.ctx, s.c, chunk)
+}
+
+// flush sends the copy waiting to be merged with the next one.
+func (s *deltaStitcher) flush() error {
+	if s.pendingCopy.empty() {
+		return nil
+	}
+	err := sendDeltaChunk(s.ctx, s.c, NewDeltaChunkWithRange(s.pendingCopy))
+	s.pendingCopy = Range{}
+	return err
+}
+
+// nextBlockIndex returns the index of the block directly following r, so
+// that matching it extends r instead of starting a new range, or -1.
+func nextBlockIndex(r Range, windowLength int) int {
+	if r.empty() || *r.to%uint64(windowLength) != 0 {
+		return -1
+	}
+	return int(*r.to / uint64(windowLength))
+}
@@ -0,0 +1,280 @@
+package rdiff
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const _WINDOW_SIZE = 10
+
+func TestCalculateAndSendDeltaChunks(t *testing.T) {
+	tcs := []struct {
+		name                 string
+		referenceFileContent string
+		oldFileContent       string
+	}{
+		{
+			name:                 "should successfully recreate identical file",
+			referenceFileContent: "Imagine you have two files, A and B, and you wish to update B to be the same as A.",
+			oldFileContent:       "Imagine you have two files, A and B, and you wish to update B to be the same as A.",
+		},
+		{
+			name:                 "should successfully recreate different file",
+			referenceFileContent: "Imagine you wish to uphave two files, A and B, and you wish to update B to be the same as A.",
+			oldFileContent:       "Imagine you have two files, A and B, and you wish to update B to be the same as A.",
+		},
+		{
+			name:                 "should successfully recreate completely different file",
+			referenceFileContent: "Imagfwne you have twoyou have tw||oyou have tw* #@d B, ad dw wish to !@#be the sa$me as A",
+			oldFileContent:       "Iamaginfe u have two sasdf, Asda andd yosdfu wio update B to be to be to bedf the sam@#s A. ",
+		},
+		{
+			name:                 "should successfully recreate file with length equal to window length",
+			referenceFileContent: "Imagine yo",
+			oldFileContent:       "Imagine yo",
+		},
+		{
+			name:                 "should successfully recreate empty file",
+			referenceFileContent: "",
+			oldFileContent:       "Imagine yo",
+		},
+		{
+			name:                 "should successfully recreate file basing on empty file",
+			referenceFileContent: "Imagine you have two files, A and B, and you wish to update B to be the same as A.",
+			oldFileContent:       "",
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			br := NewBufferedReader(_WINDOW_SIZE, strings.NewReader(tc.referenceFileContent))
+
+			deltaChunkChan := make(chan DeltaChunk)
+			go func() {
+				err := CalculateAndSendDeltaChunks(
+					context.Background(),
+					br,
+					deltaChunkChan,
+					mockFindMatchingOffset(tc.oldFileContent),
+					mockCalculateChecksum,
+				)
+				assert.NoError(t, err)
+			}()
+
+			deltaChunks := []DeltaChunk{}
+			for chunk := range deltaChunkChan {
+				deltaChunks = append(deltaChunks, chunk)
+			}
+
+			referenceFileFromDelta := getReferenceFileFromDelta(tc.oldFileContent, deltaChunks)
+			assert.Equal(t, tc.referenceFileContent, referenceFileFromDelta)
+		})
+	}
+}
+
+func mockFindMatchingOffset(
+	refFile string,
+) func([]byte, uint32, int) (bool, int) {
+	return func(h []byte, _ uint32, _ int) (bool, int) {
+		if len(refFile) == 0 || len(h) == 0 {
+			return false, 0
+		}
+		if r := strings.Index(refFile, string(h)); r != -1 {
+			if r%_WINDOW_SIZE == 0 {
+				return true, r / _WINDOW_SIZE
+			}
+		}
+		return false, 0
+	}
+
+}
+
+func mockCalculateChecksum(data []byte, previous *byte, length int, a, b *uint32) (uint32, *uint32, *uint32) {
+	s := uint32(0)
+	return uint32(0), &s, &s
+}
+
+func mockHashCalculation(data []byte) []byte {
+	return data
+}
+
+func getReferenceFileFromDelta(oldFileContent string, deltaChunks []DeltaChunk) string {
+	var originalFileFromDelta strings.Builder
+	for _, chunk := range deltaChunks {
+		if !chunk.rawData {
+			originalFileFromDelta.WriteString(oldFileContent[*chunk.r.from:*chunk.r.to])
+			continue
+		}
+		originalFileFromDelta.WriteString(string(chunk.d))
+	}
+	return originalFileFromDelta.String()
+}
+
+func TestCalculateAndSendDeltaChunksWithSharedRollingChecksums(t *testing.T) {
+	bbb, _, _ := CalculateChecksumWithoutPreviousCompounds([]byte("bbb"))
+	cc, _, _ := CalculateChecksumWithoutPreviousCompounds([]byte("c`c"))
+	assert.Equal(t, bbb, cc)
+
+	tcs := []struct {
+		name                 string
+		oldFileContent       string
+		referenceFileContent string
+		windowSize           int
+		expectedRanges       [][2]uint64
+	}{
+		{
+			name:                 "should match both of colliding blocks",
+			oldFileContent:       "bbbc`c",
+			referenceFileContent: "c`cbbb",
+			windowSize:           3,
+			expectedRanges:       [][2]uint64{{3, 6}, {0, 3}},
+		},
+		{
+			name:                 "should merge repeated zero-filled blocks into single range",
+			oldFileContent:       "header" + strings.Repeat("\x00", 100) + "footer",
+			referenceFileContent: strings.Repeat("\x00", 100),
+			windowSize:           10,
+			expectedRanges:       [][2]uint64{{10, 100}, {10, 20}},
+		},
+		{
+			name:                 "should match identical blocks anywhere in old file",
+			oldFileContent:       strings.Repeat("0123456789", 5),
+			referenceFileContent: strings.Repeat("0123456789", 8),
+			windowSize:           10,
+			expectedRanges:       [][2]uint64{{0, 50}, {0, 30}},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			index := newSignatureIndex(16)
+			for i := 0; i < len(tc.oldFileContent); i += tc.windowSize {
+				end := i + tc.windowSize
+				if end > len(tc.oldFileContent) {
+					end = len(tc.oldFileContent)
+				}
+				block := []byte(tc.oldFileContent[i:end])
+				checksum, _, _ := CalculateChecksumWithoutPreviousCompounds(block)
+				assert.NoError(t, index.add(checksum, calculateMD4(block)))
+			}
+			index.build()
+
+			br := NewBufferedReader(tc.windowSize, strings.NewReader(tc.referenceFileContent))
+			deltaChunkChan := make(chan DeltaChunk)
+			go func() {
+				err := CalculateAndSendDeltaChunks(
+					context.Background(),
+					br,
+					deltaChunkChan,
+					index.matchingOffsetFinder(calculateMD4),
+					CalculateChecksum,
+				)
+				assert.NoError(t, err)
+			}()
+
+			var ranges [][2]uint64
+			var deltaChunks []DeltaChunk
+			for chunk := range deltaChunkChan {
+				assert.False(t, chunk.rawData)
+				ranges = append(ranges, [2]uint64{*chunk.r.from, *chunk.r.to})
+				deltaChunks = append(deltaChunks, chunk)
+			}
+			assert.Equal(t, tc.expectedRanges, ranges)
+			assert.Equal(t, tc.referenceFileContent, getReferenceFileFromDelta(tc.oldFileContent, deltaChunks))
+		})
+	}
+}
+
+func TestCompactEncoder(t *testing.T) {
+	t.Run("should encode copies relative to the end of the previous copy", func(t *testing.T) {
+		encode := compactEncoder()
+		assert.Equal(t, []byte{OPCODE_COMPACT_COPY, 20, 10}, encode(NewDeltaChunkWithRange(Range{ptr(10), ptr(20)})))
+		assert.Equal(t, []byte{OPCODE_COMPACT_LITERAL, 2, 'a', 'b'}, encode(NewDeltaChunkWithRawData([]byte("ab"))))
+		assert.Equal(t, []byte{OPCODE_COMPACT_COPY, 0, 0x80, 0x01}, encode(NewDeltaChunkWithRange(Range{ptr(20), ptr(148)})))
+		assert.Equal(t, []byte{OPCODE_COMPACT_COPY, 0xa7, 0x02, 5}, encode(NewDeltaChunkWithRange(Range{ptr(0), ptr(5)})))
+	})
+}
+
+func TestDeltaStitcher(t *testing.T) {
+	copyChunk := func(from, to uint64) DeltaChunk {
+		return NewDeltaChunkWithRange(Range{ptr(from), ptr(to)})
+	}
+	literalChunk := func(data string) DeltaChunk {
+		return NewDeltaChunkWithRawData([]byte(data))
+	}
+	type segment struct {
+		start  uint64
+		chunks []DeltaChunk
+		cut    uint64
+	}
+
+	tcs := []struct {
+		name     string
+		segments []segment
+		expected []DeltaChunk
+	}{
+		{
+			name: "should merge adjacent copies of neighbouring segments",
+			segments: []segment{
+				{start: 0, chunks: []DeltaChunk{literalChunk("ab"), copyChunk(0, 10), literalChunk("cd")}, cut: 12},
+				{start: 12, chunks: []DeltaChunk{copyChunk(10, 20)}, cut: math.MaxUint64},
+			},
+			expected: []DeltaChunk{literalChunk("ab"), copyChunk(0, 20)},
+		},
+		{
+			name: "should keep copy crossing boundary and trim next segment",
+			segments: []segment{
+				{start: 0, chunks: []DeltaChunk{literalChunk("abcd"), copyChunk(30, 40)}, cut: 10},
+				{start: 10, chunks: []DeltaChunk{literalChunk("xy"), copyChunk(50, 60)}, cut: math.MaxUint64},
+			},
+			expected: []DeltaChunk{literalChunk("abcd"), copyChunk(30, 40), copyChunk(52, 60)},
+		},
+		{
+			name: "should cut literal at boundary",
+			segments: []segment{
+				{start: 0, chunks: []DeltaChunk{literalChunk("abcdefgh")}, cut: 4},
+				{start: 4, chunks: []DeltaChunk{copyChunk(0, 4)}, cut: math.MaxUint64},
+			},
+			expected: []DeltaChunk{literalChunk("abcd"), copyChunk(0, 4)},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			c := make(chan DeltaChunk, 10)
+			stitcher := deltaStitcher{ctx: context.Background(), c: c}
+			for _, segment := range tc.segments {
+				assert.NoError(t, stitcher.add(segment.start, segment.chunks, segment.cut))
+			}
+			assert.NoError(t, stitcher.flush())
+			close(c)
+
+			var chunks []DeltaChunk
+			for chunk := range c {
+				chunks = append(chunks, chunk)
+			}
+			assert.Equal(t, tc.expected, chunks)
+		})
+	}
+}
+
+func TestConcurrentDeltaSegments(t *testing.T) {
+	tcs := []struct {
+		name        string
+		blockLength int
+		jobs        int
+		memoryLimit int
+		expected    int
+	}{
+		{name: "should keep two segments per job", blockLength: 4096, jobs: 4, memoryLimit: DEFAULT_DELTA_MEMORY_LIMIT, expected: 8},
+		{name: "should fit segments in memory limit", blockLength: 4096, jobs: 64, memoryLimit: DEFAULT_DELTA_MEMORY_LIMIT, expected: 16},
+		{name: "should count longer segments of long blocks", blockLength: 16 << 20, jobs: 64, memoryLimit: DEFAULT_DELTA_MEMORY_LIMIT, expected: 2},
+		{name: "should keep no segment below memory of one", blockLength: 4096, jobs: 4, memoryLimit: 1 << 20, expected: 0},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, concurrentDeltaSegments(tc.blockLength, tc.jobs, tc.memoryLimit))
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package rdiff
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"io"
+)
+
+const FILE_DIGEST_SIZE = 8 + sha256.Size
+
+// FileDigest identifies whole file contents by their length and SHA-256.
+type FileDigest struct {
+	Length uint64
+	Hash   []byte
+}
+
+func (d FileDigest) Equal(other FileDigest) bool {
+	return d.Length == other.Length && bytes.Equal(d.Hash, other.Hash)
+}
+
+func (d FileDigest) ToBytes() []byte {
+	bytes := make([]byte, FILE_DIGEST_SIZE)
+	binary.BigEndian.PutUint64(bytes[0:8], d.Length)
+	copy(bytes[8:], d.Hash)
+	return bytes
+}
+
+func fileDigestFromBytes(b []byte) FileDigest {
+	hash := make([]byte, sha256.Size)
+	copy(hash, b[8:FILE_DIGEST_SIZE])
+	return FileDigest{
+		Length: binary.BigEndian.Uint64(b[0:8]),
+		Hash:   hash,
+	}
+}
+
+// digestWriter calculates FileDigest of everything written to it.
+type digestWriter struct {
+	h      hash.Hash
+	length uint64
+}
+
+func newDigestWriter() *digestWriter {
+	return &digestWriter{h: sha256.New()}
+}
+
+func (d *digestWriter) Write(p []byte) (int, error) {
+	d.length += uint64(len(p))
+	return d.h.Write(p)
+}
+
+func (d *digestWriter) Digest() FileDigest {
+	return FileDigest{
+		Length: d.length,
+		Hash:   d.h.Sum(nil),
+	}
+}
+
+func calculateFileDigest(r io.Reader) (FileDigest, error) {
+	d := newDigestWriter()
+	_, err := io.Copy(d, r)
+	if err != nil {
+		return FileDigest{}, err
+	}
+	return d.Digest(), nil
+}
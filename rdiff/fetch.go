@@ -0,0 +1,172 @@
+package rdiff
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Fetch recreates the file described by a plain signature, like zsync does:
+// local is scanned like the new file of Delta to find blocks of the file at
+// any offset, and runs of consecutive blocks it does not hold are read with
+// fetchRange, which gets their byte range [from, to) in the file. Ranges are
+// requested in ascending order. The recreated file is written to newFile and
+// ErrTargetMismatch is returned if it does not match the digest recorded in
+// the signature.
+func Fetch(
+	signature io.Reader,
+	local io.ReaderAt,
+	newFile io.Writer,
+	fetchRange func(ctx context.Context, from, to uint64) (io.ReadCloser, error),
+	opts FetchOptions,
+) error {
+	return FetchContext(context.Background(), signature, local, newFile, fetchRange, opts)
+}
+
+// FetchContext is like Fetch but stops once ctx is done, returning its
+// error.
+func FetchContext(
+	ctx context.Context,
+	signature io.Reader,
+	local io.ReaderAt,
+	newFile io.Writer,
+	fetchRange func(ctx context.Context, from, to uint64) (io.ReadCloser, error),
+	opts FetchOptions,
+) error {
+	signatureFile, err := ReadSignatureFile(signature)
+	if err != nil {
+		return err
+	}
+	sources, err := locateBlocks(ctx, signatureFile, io.NewSectionReader(local, 0, math.MaxInt64), opts)
+	if err != nil {
+		return err
+	}
+
+	digest := newDigestWriter()
+	w := io.MultiWriter(newFile, digest)
+	blockLength := uint64(signatureFile.Header.BlockLength)
+	length := signatureFile.Basis.Length
+	for block := 0; block < len(sources); {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Runs of blocks missing from local or following each other in it
+		// are read at once.
+		run := block + 1
+		for run < len(sources) && (sources[block] < 0) == (sources[run] < 0) &&
+			(sources[block] < 0 || sources[run] == sources[block]+int64(uint64(run-block)*blockLength)) {
+			run++
+		}
+		from := uint64(block) * blockLength
+		to := uint64(run) * blockLength
+		if to > length {
+			to = length
+		}
+		if sources[block] < 0 {
+			err = copyFetchedRange(ctx, w, fetchRange, from, to)
+		} else {
+			err = copyRangeFrom(w, io.NewSectionReader(local, sources[block], int64(to-from)), from, to)
+		}
+		if err != nil {
+			return err
+		}
+		block = run
+	}
+	if !digest.Digest().Equal(signatureFile.Basis) {
+		return ErrTargetMismatch
+	}
+	return nil
+}
+
+// locateBlocks returns, for every block of the file signatureFile describes,
+// the offset of the same data in local or -1 if local does not hold it.
+func locateBlocks(ctx context.Context, signatureFile SignatureFile, local io.Reader, opts FetchOptions) ([]int64, error) {
+	blockLength := uint64(signatureFile.Header.BlockLength)
+	length := signatureFile.Basis.Length
+	sources := make([]int64, signatureFile.Index.Len())
+	for i := range sources {
+		sources[i] = -1
+	}
+
+	// Chunks are recorded as they would be encoded, nothing is written.
+	var offset uint64
+	record := func(chunk DeltaChunk) []byte {
+		if !chunk.IsLiteral() {
+			from, to := chunk.Range()
+			// Copies of concurrent segments can start within a block.
+			for i := (from + blockLength - 1) / blockLength; i*blockLength < to; i++ {
+				end := (i + 1) * blockLength
+				if end > length {
+					end = length
+				}
+				if end > to {
+					break
+				}
+				if sources[i] < 0 {
+					sources[i] = int64(offset + i*blockLength - from)
+				}
+			}
+		}
+		offset += chunk.Len()
+		return nil
+	}
+	err := sendDeltaChunks(
+		ctx,
+		local,
+		io.Discard,
+		int(blockLength),
+		opts.jobs(),
+		opts.memoryLimit(),
+		signatureFile.Index,
+		CalculateChecksum,
+		signatureFile.Header.strongHash(),
+		record,
+		io.Discard,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Delta matches repeated blocks to one of them, the others are copied
+	// from the same place.
+	found := map[string]int64{}
+	for i, source := range sources {
+		if source >= 0 {
+			found[string(signatureFile.Index.Hash(i))] = source
+		}
+	}
+	for i, source := range sources {
+		if source < 0 && uint64(i+1)*blockLength <= length {
+			if foundSource, ok := found[string(signatureFile.Index.Hash(i))]; ok {
+				sources[i] = foundSource
+			}
+		}
+	}
+	return sources, nil
+}
+
+// copyFetchedRange writes the range [from, to) read with fetchRange to w.
+func copyFetchedRange(
+	ctx context.Context,
+	w io.Writer,
+	fetchRange func(ctx context.Context, from, to uint64) (io.ReadCloser, error),
+	from, to uint64,
+) error {
+	body, err := fetchRange(ctx, from, to)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return copyRangeFrom(w, body, from, to)
+}
+
+// copyRangeFrom writes the range [from, to) of the file, read from r, to w.
+func copyRangeFrom(w io.Writer, r io.Reader, from, to uint64) error {
+	_, err := io.CopyN(w, r, int64(to-from))
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("range %d-%d: %w", from, to, io.ErrUnexpectedEOF)
+	}
+	return err
+}
@@ -0,0 +1,244 @@
+package rdiff
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+func WriteChunks(w io.Writer, c chan []byte) error {
+	for bytes := range c {
+		_, err := w.Write(bytes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func WriteDeltaChunks(w io.Writer, c chan DeltaChunk, encode func(DeltaChunk) []byte) error {
+	for deltaChunk := range c {
+		_, err := w.Write(encode(deltaChunk))
+		if err != nil {
+			return err
+		}
+		if !deltaChunk.r.empty() {
+			deltaChunk.r.clear()
+		}
+	}
+	return nil
+}
+
+// SignatureFile is the parsed contents of a signature.
+type SignatureFile struct {
+	Header SignatureHeader
+	Index  *SignatureIndex
+	Basis  FileDigest
+}
+
+// ReadSignatureFile builds the index of signature while reading it, never
+// holding the signature itself in memory.
+func ReadSignatureFile(signature io.Reader) (SignatureFile, error) {
+	header, err := ReadSignatureHeader(signature)
+	if err != nil {
+		return SignatureFile{}, err
+	}
+	index, trailer, err := readBundles(signature, header.BundleSize(), SIGNATURE_TRAILER_SIZE)
+	if err != nil {
+		return SignatureFile{}, err
+	}
+
+	basis := fileDigestFromBytes(trailer)
+	blockLength := uint64(header.BlockLength)
+	if uint64(index.Len()) != (basis.Length+blockLength-1)/blockLength {
+		return SignatureFile{}, ErrTruncatedSignature
+	}
+
+	return SignatureFile{
+		Header: header,
+		Index:  index,
+		Basis:  basis,
+	}, nil
+}
+
+// readBundles indexes bundles of signature up to the trailer of the given
+// size, which it returns.
+func readBundles(signature io.Reader, bundleSize int, trailerSize int) (*SignatureIndex, []byte, error) {
+	r := bufio.NewReaderSize(signature, 64<<10+bundleSize+trailerSize)
+	index := newSignatureIndex(bundleSize - ROLLING_CHECKSUM_SIZE)
+	for {
+		b, err := r.Peek(bundleSize + trailerSize)
+		if errors.Is(err, io.EOF) {
+			if len(b) != trailerSize {
+				return nil, nil, ErrTruncatedSignature
+			}
+			index.build()
+			return index, append([]byte{}, b...), nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		err = index.add(binary.BigEndian.Uint32(b[:ROLLING_CHECKSUM_SIZE]), b[ROLLING_CHECKSUM_SIZE:bundleSize])
+		if err != nil {
+			return nil, nil, err
+		}
+		_, _ = r.Discard(bundleSize)
+	}
+}
+
+// DeltaReader sends operations read from the body of a delta of the given
+// version to c until the end of delta operation, returning the digest of
+// the target file stored with it. It refuses literals longer than
+// maxLiteralLength, compact operations in deltas older than DELTA_VERSION
+// and any data following the end operation.
+func DeltaReader(ctx context.Context, delta io.Reader, version uint16, c chan DeltaChunk, maxLiteralLength int) (FileDigest, error) {
+	defer close(c)
+	r := bufio.NewReader(delta)
+	var previousTo uint64
+	for {
+		opcode, err := r.ReadByte()
+		if err != nil {
+			return FileDigest{}, truncatedRecord(err, "end operation missing")
+		}
+		if (opcode == OPCODE_COMPACT_LITERAL || opcode == OPCODE_COMPACT_COPY) && version < DELTA_VERSION {
+			return FileDigest{}, fmt.Errorf("%w: compact operation %d in version %d delta", ErrUnknownOpcode, opcode, version)
+		}
+		switch opcode {
+		case OPCODE_LITERAL:
+			blockLenBytes := make([]byte, 8)
+			_, err := io.ReadFull(r, blockLenBytes)
+			if err != nil {
+				return FileDigest{}, truncatedRecord(err, "literal length")
+			}
+			rawData, err := readLiteral(r, binary.BigEndian.Uint64(blockLenBytes), maxLiteralLength)
+			if err != nil {
+				return FileDigest{}, err
+			}
+			err = sendDeltaChunk(ctx, c, NewDeltaChunkWithRawData(rawData))
+			if err != nil {
+				return FileDigest{}, err
+			}
+		case OPCODE_COPY:
+			rangeBytes := make([]byte, 16)
+			_, err = io.ReadFull(r, rangeBytes)
+			if err != nil {
+				return FileDigest{}, truncatedRecord(err, "copy range")
+			}
+			chunk, err := newCopyChunk(binary.BigEndian.Uint64(rangeBytes[:8]), binary.BigEndian.Uint64(rangeBytes[8:]))
+			if err != nil {
+				return FileDigest{}, err
+			}
+			previousTo = *chunk.r.to
+			err = sendDeltaChunk(ctx, c, chunk)
+			if err != nil {
+				return FileDigest{}, err
+			}
+		case OPCODE_COMPACT_LITERAL:
+			length, err := readUvarint(r, "literal length")
+			if err != nil {
+				return FileDigest{}, err
+			}
+			rawData, err := readLiteral(r, length, maxLiteralLength)
+			if err != nil {
+				return FileDigest{}, err
+			}
+			err = sendDeltaChunk(ctx, c, NewDeltaChunkWithRawData(rawData))
+			if err != nil {
+				return FileDigest{}, err
+			}
+		case OPCODE_COMPACT_COPY:
+			offset, err := binary.ReadVarint(r)
+			if err != nil {
+				return FileDigest{}, malformedOperand(err, "copy offset")
+			}
+			length, err := readUvarint(r, "copy length")
+			if err != nil {
+				return FileDigest{}, err
+			}
+			if offset < 0 && uint64(-offset) > previousTo {
+				return FileDigest{}, fmt.Errorf("%w: offset %d", ErrRangeOutsideBasis, int64(previousTo)+offset)
+			}
+			from := previousTo + uint64(offset)
+			chunk, err := newCopyChunk(from, from+length)
+			if err != nil {
+				return FileDigest{}, err
+			}
+			previousTo = *chunk.r.to
+			err = sendDeltaChunk(ctx, c, chunk)
+			if err != nil {
+				return FileDigest{}, err
+			}
+		case OPCODE_END:
+			digestBytes := make([]byte, FILE_DIGEST_SIZE)
+			_, err = io.ReadFull(r, digestBytes)
+			if err != nil {
+				return FileDigest{}, truncatedRecord(err, "target digest")
+			}
+			return fileDigestFromBytes(digestBytes), expectEnd(r)
+		default:
+			return FileDigest{}, fmt.Errorf("%w: %d", ErrUnknownOpcode, opcode)
+		}
+	}
+}
+
+// truncatedRecord turns running out of delta in the middle of a record
+// into ErrTruncatedDelta.
+func truncatedRecord(err error, record string) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %s", ErrTruncatedDelta, record)
+	}
+	return err
+}
+
+// malformedOperand turns errors of reading varint operands into
+// ErrTruncatedDelta or ErrMalformedOperand.
+func malformedOperand(err error, operand string) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return truncatedRecord(err, operand)
+	}
+	return fmt.Errorf("%w: %s", ErrMalformedOperand, operand)
+}
+
+func readUvarint(r io.ByteReader, operand string) (uint64, error) {
+	v, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, malformedOperand(err, operand)
+	}
+	return v, nil
+}
+
+// readLiteral reads literal data of the given length, refusing lengths
+// above maxLength before allocating anything.
+func readLiteral(delta io.Reader, length uint64, maxLength int) ([]byte, error) {
+	if length > uint64(maxLength) {
+		return nil, fmt.Errorf("%w: %d bytes", ErrLiteralTooLong, length)
+	}
+	rawData := make([]byte, length)
+	_, err := io.ReadFull(delta, rawData)
+	if err != nil {
+		return nil, truncatedRecord(err, "literal data")
+	}
+	return rawData, nil
+}
+
+func newCopyChunk(from, to uint64) (DeltaChunk, error) {
+	if to < from {
+		return DeltaChunk{}, fmt.Errorf("%w: %d-%d", ErrInvertedRange, from, to)
+	}
+	return NewDeltaChunkWithRange(Range{&from, &to}), nil
+}
+
+// expectEnd returns ErrTrailingData unless delta has no more data.
+func expectEnd(delta io.Reader) error {
+	readBytes, err := io.ReadFull(delta, make([]byte, 1))
+	if readBytes > 0 {
+		return ErrTrailingData
+	}
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
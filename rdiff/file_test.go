@@ -0,0 +1,184 @@
+package rdiff
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func literalOp(length uint64, data string) []byte {
+	op := make([]byte, 9)
+	op[0] = OPCODE_LITERAL
+	binary.BigEndian.PutUint64(op[1:], length)
+	return append(op, data...)
+}
+
+func copyOp(from, to uint64) []byte {
+	return NewDeltaChunkWithRange(Range{&from, &to}).ToBytes()
+}
+
+func compactCopyOps(ranges ...[2]uint64) []byte {
+	encode := compactEncoder()
+	var ops []byte
+	for _, r := range ranges {
+		ops = append(ops, encode(NewDeltaChunkWithRange(Range{ptr(r[0]), ptr(r[1])}))...)
+	}
+	return ops
+}
+
+func endOp() []byte {
+	return deltaTrailerToBytes(FileDigest{Length: 3, Hash: make([]byte, 32)})
+}
+
+func readDeltaChunks(delta []byte, maxLiteralLength int) ([]DeltaChunk, error) {
+	return readDeltaVersionChunks(delta, DELTA_VERSION, maxLiteralLength)
+}
+
+func readDeltaVersionChunks(delta []byte, version uint16, maxLiteralLength int) ([]DeltaChunk, error) {
+	c := make(chan DeltaChunk)
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := DeltaReader(context.Background(), bytes.NewReader(delta), version, c, maxLiteralLength)
+		errChan <- err
+	}()
+	var chunks []DeltaChunk
+	for chunk := range c {
+		chunks = append(chunks, chunk)
+	}
+	return chunks, <-errChan
+}
+
+func TestDeltaReader(t *testing.T) {
+	t.Run("should read operations", func(t *testing.T) {
+		delta := bytes.Join([][]byte{literalOp(3, "abc"), copyOp(10, 20), endOp()}, nil)
+
+		chunks, err := readDeltaChunks(delta, 3)
+		assert.NoError(t, err)
+		assert.Equal(t, []DeltaChunk{NewDeltaChunkWithRawData([]byte("abc")), NewDeltaChunkWithRange(Range{ptr(10), ptr(20)})}, chunks)
+	})
+
+	t.Run("should read compact operations mixed with fixed width ones", func(t *testing.T) {
+		delta := bytes.Join([][]byte{
+			compactEncoder()(NewDeltaChunkWithRawData([]byte("abc"))),
+			copyOp(10, 20),
+			compactCopyOps([2]uint64{20, 30}, [2]uint64{5, 8}),
+			endOp(),
+		}, nil)
+
+		chunks, err := readDeltaChunks(delta, 3)
+		assert.NoError(t, err)
+		assert.Equal(t, []DeltaChunk{
+			NewDeltaChunkWithRawData([]byte("abc")),
+			NewDeltaChunkWithRange(Range{ptr(10), ptr(20)}),
+			NewDeltaChunkWithRange(Range{ptr(40), ptr(50)}),
+			NewDeltaChunkWithRange(Range{ptr(25), ptr(28)}),
+		}, chunks)
+	})
+
+	t.Run("should read fixed width operations of older versions", func(t *testing.T) {
+		delta := bytes.Join([][]byte{literalOp(3, "abc"), copyOp(10, 20), endOp()}, nil)
+
+		for _, version := range []uint16{DELTA_VERSION_UNCOMPRESSED, DELTA_VERSION_FIXED_WIDTH} {
+			_, err := readDeltaVersionChunks(delta, version, 3)
+			assert.NoError(t, err)
+		}
+	})
+
+	tcs := []struct {
+		name     string
+		delta    []byte
+		version  uint16
+		expected error
+	}{
+		{name: "should refuse delta without end", delta: literalOp(3, "abc"), expected: ErrTruncatedDelta},
+		{name: "should refuse truncated literal length", delta: []byte{OPCODE_LITERAL, 0, 0}, expected: ErrTruncatedDelta},
+		{name: "should refuse truncated literal data", delta: literalOp(10, "abc"), expected: ErrTruncatedDelta},
+		{name: "should refuse truncated copy", delta: copyOp(10, 20)[:12], expected: ErrTruncatedDelta},
+		{name: "should refuse truncated end", delta: endOp()[:20], expected: ErrTruncatedDelta},
+		{name: "should refuse too long literal", delta: literalOp(1<<62, "abc"), expected: ErrLiteralTooLong},
+		{name: "should refuse inverted range", delta: copyOp(20, 10), expected: ErrInvertedRange},
+		{name: "should refuse data after end", delta: append(endOp(), 0), expected: ErrTrailingData},
+		{name: "should refuse unknown opcode", delta: []byte{9}, expected: ErrUnknownOpcode},
+		{name: "should refuse truncated compact literal", delta: []byte{OPCODE_COMPACT_LITERAL, 5, 'a'}, expected: ErrTruncatedDelta},
+		{name: "should refuse too long compact literal", delta: []byte{OPCODE_COMPACT_LITERAL, 0x80, 0x01}, expected: ErrLiteralTooLong},
+		{name: "should refuse truncated compact copy", delta: []byte{OPCODE_COMPACT_COPY, 0x80}, expected: ErrTruncatedDelta},
+		{name: "should refuse compact copy before start of basis", delta: []byte{OPCODE_COMPACT_COPY, 0x01, 1}, expected: ErrRangeOutsideBasis},
+		{name: "should refuse overflowing compact copy length", delta: append([]byte{OPCODE_COMPACT_COPY, 0}, bytes.Repeat([]byte{0xff}, 11)...), expected: ErrMalformedOperand},
+		{name: "should refuse compact literal in fixed width delta", delta: bytes.Join([][]byte{compactEncoder()(NewDeltaChunkWithRawData([]byte("abc"))), endOp()}, nil), version: DELTA_VERSION_FIXED_WIDTH, expected: ErrUnknownOpcode},
+		{name: "should refuse compact copy in uncompressed delta", delta: bytes.Join([][]byte{compactCopyOps([2]uint64{20, 30}), endOp()}, nil), version: DELTA_VERSION_UNCOMPRESSED, expected: ErrUnknownOpcode},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			version := tc.version
+			if version == 0 {
+				version = DELTA_VERSION
+			}
+			_, err := readDeltaVersionChunks(tc.delta, version, 16)
+			assert.ErrorIs(t, err, tc.expected)
+		})
+	}
+}
+
+func ptr(v uint64) *uint64 {
+	return &v
+}
+
+func FuzzDeltaReader(f *testing.F) {
+	f.Add(bytes.Join([][]byte{literalOp(3, "abc"), copyOp(10, 20), endOp()}, nil))
+	f.Add(literalOp(1<<62, "abc"))
+	f.Add(append(endOp(), 0))
+	f.Add(bytes.Join([][]byte{compactCopyOps([2]uint64{20, 30}, [2]uint64{5, 8}), endOp()}, nil))
+	f.Fuzz(func(t *testing.T, delta []byte) {
+		chunks, _ := readDeltaChunks(delta, 1<<10)
+		for _, chunk := range chunks {
+			if chunk.rawData {
+				assert.LessOrEqual(t, len(chunk.d), 1<<10)
+			} else {
+				assert.LessOrEqual(t, *chunk.r.from, *chunk.r.to)
+			}
+		}
+	})
+}
+
+func FuzzReadSignatureFile(f *testing.F) {
+	for _, hash := range []StrongHashType{STRONG_HASH_MD4, STRONG_HASH_XXH3} {
+		signature := bytes.Buffer{}
+		err := Signature(strings.NewReader("Imagine you have two files, A and B."), &signature, SignatureOptions{
+			BlockLength:      8,
+			StrongHash:       hash,
+			StrongHashLength: 8,
+		})
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(signature.Bytes())
+		// Blocks of 4 GiB.
+		tooLong := append([]byte{}, signature.Bytes()...)
+		copy(tooLong[6:10], []byte{0xff, 0xff, 0xff, 0xff})
+		f.Add(tooLong)
+	}
+	f.Fuzz(func(t *testing.T, signature []byte) {
+		signatureFile, err := ReadSignatureFile(bytes.NewReader(signature))
+		if err != nil {
+			return
+		}
+		for i := 0; i < signatureFile.Index.Len(); i++ {
+			assert.Len(t, signatureFile.Index.Hash(i), int(signatureFile.Header.StrongHashLength))
+		}
+		signatureFile.Header.strongHash()
+
+		// Headers that decode fine can still make delta allocate too much.
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		err = Delta(bytes.NewReader(signature), strings.NewReader("Imagine you have two files, A and C."), io.Discard, DeltaOptions{Jobs: 1})
+		assert.NoError(t, err)
+		runtime.ReadMemStats(&after)
+		assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(2*MAX_BLOCK_LENGTH+8<<20))
+	})
+}
@@ -0,0 +1,270 @@
+package rdiff
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	SIGNATURE_MAGIC        uint32 = 0x72647367 // "rdsg"
+	SIGNATURE_VERSION      uint16 = 1
+	SIGNATURE_HEADER_SIZE         = 4 + 2 + 4 + 1 + 1 + 1
+	SIGNATURE_TRAILER_SIZE        = FILE_DIGEST_SIZE
+)
+
+const (
+	DELTA_MAGIC        uint32 = 0x7264646c // "rddl"
+	DELTA_VERSION      uint16 = 3
+	DELTA_HEADER_SIZE         = 4 + 2 + 1 + FILE_DIGEST_SIZE
+	DELTA_TRAILER_SIZE        = 1 + FILE_DIGEST_SIZE
+)
+
+// MAX_BLOCK_LENGTH bounds the block length of signatures, since delta holds
+// two blocks of the new file in memory per job.
+const MAX_BLOCK_LENGTH = 16 << 20
+
+type RollingChecksumType uint8
+
+const ROLLING_CHECKSUM_RDIFF RollingChecksumType = 1
+
+const ROLLING_CHECKSUM_SIZE = 4
+
+var (
+	ErrNotSignature                = errors.New("not a signature file")
+	ErrUnsupportedSignatureVersion = errors.New("unsupported signature version")
+	ErrUnsupportedRollingChecksum  = errors.New("unsupported rolling checksum")
+	ErrUnsupportedStrongHash       = errors.New("unsupported strong hash")
+	ErrInvalidStrongHashLength     = errors.New("invalid strong hash length")
+	ErrInvalidBlockLength          = errors.New("invalid block length")
+	ErrTruncatedSignature          = errors.New("truncated signature")
+	ErrNotDelta                    = errors.New("not a delta file")
+	ErrUnsupportedDeltaVersion     = errors.New("unsupported delta version")
+	ErrTruncatedDelta              = errors.New("truncated delta")
+	ErrUnknownOpcode               = errors.New("unknown delta opcode")
+	ErrLiteralTooLong              = errors.New("delta literal exceeds maximum length")
+	ErrInvertedRange               = errors.New("delta copy range ends before it starts")
+	ErrRangeOutsideBasis           = errors.New("delta copy range outside basis file")
+	ErrTrailingData                = errors.New("data after delta end")
+	ErrMalformedOperand            = errors.New("malformed delta operand")
+	ErrBasisMismatch               = errors.New("basis file does not match the one delta was calculated against")
+	ErrTargetMismatch              = errors.New("patched file does not match the one delta was calculated from")
+	ErrTargetDiffers               = errors.New("patched file differs from target file")
+)
+
+// invalidInputErrors are returned for signature and delta files that are
+// corrupted or not supported.
+var invalidInputErrors = []error{
+	ErrNotSignature,
+	ErrUnsupportedSignatureVersion,
+	ErrUnsupportedRollingChecksum,
+	ErrUnsupportedStrongHash,
+	ErrInvalidStrongHashLength,
+	ErrInvalidBlockLength,
+	ErrTruncatedSignature,
+	ErrNotDelta,
+	ErrUnsupportedDeltaVersion,
+	ErrTruncatedDelta,
+	ErrUnknownOpcode,
+	ErrLiteralTooLong,
+	ErrInvertedRange,
+	ErrRangeOutsideBasis,
+	ErrTrailingData,
+	ErrMalformedOperand,
+	ErrTooManyBlocks,
+	ErrUnsupportedCompression,
+	ErrInvalidPath,
+}
+
+// IsInvalidInput returns whether err is caused by a signature or delta file
+// that is corrupted or not supported.
+func IsInvalidInput(err error) bool {
+	for _, invalidInputErr := range invalidInputErrors {
+		if errors.Is(err, invalidInputErr) {
+			return true
+		}
+	}
+	return false
+}
+
+// SignatureHeader precedes the bundles of a signature and describes how they
+// were calculated.
+type SignatureHeader struct {
+	Version          uint16
+	BlockLength      uint32
+	RollingChecksum  RollingChecksumType
+	StrongHash       StrongHashType
+	StrongHashLength uint8
+}
+
+// NewSignatureHeader returns header of a signature using strongHash sums
+// truncated to strongHashLength bytes, or untruncated ones when
+// strongHashLength is 0.
+func NewSignatureHeader(blockLength int, strongHash StrongHashType, strongHashLength int) (SignatureHeader, error) {
+	if blockLength <= 0 || blockLength > MAX_BLOCK_LENGTH {
+		return SignatureHeader{}, fmt.Errorf("%w: %d", ErrInvalidBlockLength, blockLength)
+	}
+	h, err := StrongHashByType(strongHash)
+	if err != nil {
+		return SignatureHeader{}, err
+	}
+	if strongHashLength == 0 {
+		strongHashLength = h.Size()
+	}
+	if strongHashLength < 0 || strongHashLength > h.Size() {
+		return SignatureHeader{}, fmt.Errorf("%w: %d", ErrInvalidStrongHashLength, strongHashLength)
+	}
+	return SignatureHeader{
+		Version:          SIGNATURE_VERSION,
+		BlockLength:      uint32(blockLength),
+		RollingChecksum:  ROLLING_CHECKSUM_RDIFF,
+		StrongHash:       strongHash,
+		StrongHashLength: uint8(strongHashLength),
+	}, nil
+}
+
+func (h SignatureHeader) ToBytes() []byte {
+	bytes := make([]byte, SIGNATURE_HEADER_SIZE)
+	binary.BigEndian.PutUint32(bytes[0:4], SIGNATURE_MAGIC)
+	binary.BigEndian.PutUint16(bytes[4:6], h.Version)
+	binary.BigEndian.PutUint32(bytes[6:10], h.BlockLength)
+	bytes[10] = byte(h.RollingChecksum)
+	bytes[11] = byte(h.StrongHash)
+	bytes[12] = h.StrongHashLength
+	return bytes
+}
+
+// BundleSize returns the length of a single block entry following the header.
+func (h SignatureHeader) BundleSize() int {
+	return ROLLING_CHECKSUM_SIZE + int(h.StrongHashLength)
+}
+
+func ReadSignatureHeader(signature io.Reader) (SignatureHeader, error) {
+	bytes := make([]byte, SIGNATURE_HEADER_SIZE)
+	_, err := io.ReadFull(signature, bytes)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return SignatureHeader{}, ErrTruncatedSignature
+		}
+		return SignatureHeader{}, err
+	}
+	if binary.BigEndian.Uint32(bytes[0:4]) != SIGNATURE_MAGIC {
+		return SignatureHeader{}, ErrNotSignature
+	}
+
+	h := SignatureHeader{
+		Version:          binary.BigEndian.Uint16(bytes[4:6]),
+		BlockLength:      binary.BigEndian.Uint32(bytes[6:10]),
+		RollingChecksum:  RollingChecksumType(bytes[10]),
+		StrongHash:       StrongHashType(bytes[11]),
+		StrongHashLength: bytes[12],
+	}
+	if h.Version != SIGNATURE_VERSION {
+		return SignatureHeader{}, fmt.Errorf("%w: %d", ErrUnsupportedSignatureVersion, h.Version)
+	}
+	if h.BlockLength == 0 || h.BlockLength > MAX_BLOCK_LENGTH {
+		return SignatureHeader{}, fmt.Errorf("%w: %d", ErrInvalidBlockLength, h.BlockLength)
+	}
+	if h.RollingChecksum != ROLLING_CHECKSUM_RDIFF {
+		return SignatureHeader{}, fmt.Errorf("%w: %d", ErrUnsupportedRollingChecksum, h.RollingChecksum)
+	}
+	strongHash, err := StrongHashByType(h.StrongHash)
+	if err != nil {
+		return SignatureHeader{}, err
+	}
+	if h.StrongHashLength == 0 || int(h.StrongHashLength) > strongHash.Size() {
+		return SignatureHeader{}, fmt.Errorf("%w: %d", ErrInvalidStrongHashLength, h.StrongHashLength)
+	}
+	return h, nil
+}
+
+// strongHash returns the function calculating strong hashes of the signature.
+// Headers are validated when created or read, so the hash is always known.
+func (h SignatureHeader) strongHash() func([]byte) []byte {
+	strongHash, err := StrongHashByType(h.StrongHash)
+	if err != nil {
+		panic(err)
+	}
+	return truncatedHash(strongHash, int(h.StrongHashLength))
+}
+
+// Deltas of older versions are still read. DELTA_VERSION_UNCOMPRESSED deltas
+// have no compression field, DELTA_VERSION_FIXED_WIDTH deltas have it but
+// use only the fixed width operations.
+const (
+	DELTA_VERSION_UNCOMPRESSED uint16 = 1
+	DELTA_VERSION_FIXED_WIDTH  uint16 = 2
+)
+
+// DeltaHeader precedes the delta operations and identifies the basis file
+// the delta has to be applied to.
+type DeltaHeader struct {
+	Version uint16
+	// Compression applies to everything following the header.
+	Compression Compression
+	Basis       FileDigest
+}
+
+func NewDeltaHeader(basis FileDigest, compression Compression) DeltaHeader {
+	return DeltaHeader{
+		Version:     DELTA_VERSION,
+		Compression: compression,
+		Basis:       basis,
+	}
+}
+
+func (h DeltaHeader) ToBytes() []byte {
+	bytes := make([]byte, DELTA_HEADER_SIZE)
+	binary.BigEndian.PutUint32(bytes[0:4], DELTA_MAGIC)
+	binary.BigEndian.PutUint16(bytes[4:6], h.Version)
+	bytes[6] = byte(h.Compression)
+	copy(bytes[7:], h.Basis.ToBytes())
+	return bytes
+}
+
+func ReadDeltaHeader(delta io.Reader) (DeltaHeader, error) {
+	bytes := make([]byte, DELTA_HEADER_SIZE)
+	_, err := io.ReadFull(delta, bytes[:6])
+	if err != nil {
+		return DeltaHeader{}, truncatedRecord(err, "header")
+	}
+	if binary.BigEndian.Uint32(bytes[0:4]) != DELTA_MAGIC {
+		return DeltaHeader{}, ErrNotDelta
+	}
+
+	h := DeltaHeader{Version: binary.BigEndian.Uint16(bytes[4:6])}
+	switch h.Version {
+	case DELTA_VERSION, DELTA_VERSION_FIXED_WIDTH:
+		_, err = io.ReadFull(delta, bytes[6:])
+		h.Compression = Compression(bytes[6])
+	case DELTA_VERSION_UNCOMPRESSED:
+		_, err = io.ReadFull(delta, bytes[7:])
+	default:
+		return DeltaHeader{}, fmt.Errorf("%w: %d", ErrUnsupportedDeltaVersion, h.Version)
+	}
+	if err != nil {
+		return DeltaHeader{}, truncatedRecord(err, "header")
+	}
+	if !h.Compression.valid() {
+		return DeltaHeader{}, fmt.Errorf("%w: %d", ErrUnsupportedCompression, h.Compression)
+	}
+	h.Basis = fileDigestFromBytes(bytes[7:])
+	return h, nil
+}
+
+// Body returns the operations following the header in delta, decompressed
+// if the header says so.
+func (h DeltaHeader) Body(delta io.Reader) (io.ReadCloser, error) {
+	body, err := h.Compression.reader(delta)
+	if err != nil {
+		return nil, truncatedRecord(err, "compressed data")
+	}
+	return body, nil
+}
+
+// deltaTrailerToBytes returns the end of delta operation carrying the digest
+// of the file that applying the delta has to produce.
+func deltaTrailerToBytes(target FileDigest) []byte {
+	return append([]byte{OPCODE_END}, target.ToBytes()...)
+}
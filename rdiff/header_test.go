@@ -0,0 +1,185 @@
+package rdiff
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestSignatureHeader(t *testing.T) {
+	t.Run("should read header that was written", func(t *testing.T) {
+		header, err := NewSignatureHeader(5000, STRONG_HASH_MD4, 0)
+		assert.NoError(t, err)
+
+		readHeader, err := ReadSignatureHeader(bytes.NewReader(header.ToBytes()))
+		assert.NoError(t, err)
+		assert.Equal(t, header, readHeader)
+		assert.Equal(t, uint32(5000), readHeader.BlockLength)
+		assert.Equal(t, 20, readHeader.BundleSize())
+	})
+
+	t.Run("should refuse invalid block length", func(t *testing.T) {
+		_, err := NewSignatureHeader(0, STRONG_HASH_MD4, 0)
+		assert.ErrorIs(t, err, ErrInvalidBlockLength)
+		_, err = NewSignatureHeader(MAX_BLOCK_LENGTH+1, STRONG_HASH_MD4, 0)
+		assert.ErrorIs(t, err, ErrInvalidBlockLength)
+	})
+
+	t.Run("should truncate strong hashes", func(t *testing.T) {
+		header, err := NewSignatureHeader(5000, STRONG_HASH_SHA256, 12)
+		assert.NoError(t, err)
+		assert.Equal(t, 16, header.BundleSize())
+
+		_, err = NewSignatureHeader(5000, STRONG_HASH_SHA256, 33)
+		assert.ErrorIs(t, err, ErrInvalidStrongHashLength)
+	})
+
+	t.Run("should return error for invalid headers", func(t *testing.T) {
+		header, err := NewSignatureHeader(10, STRONG_HASH_MD4, 0)
+		assert.NoError(t, err)
+		valid := header.ToBytes()
+
+		tcs := []struct {
+			name        string
+			modify      func([]byte) []byte
+			expectedErr error
+		}{
+			{
+				name:        "empty",
+				modify:      func(b []byte) []byte { return nil },
+				expectedErr: ErrTruncatedSignature,
+			},
+			{
+				name:        "truncated",
+				modify:      func(b []byte) []byte { return b[:SIGNATURE_HEADER_SIZE-1] },
+				expectedErr: ErrTruncatedSignature,
+			},
+			{
+				name:        "wrong magic",
+				modify:      func(b []byte) []byte { b[0] = 'x'; return b },
+				expectedErr: ErrNotSignature,
+			},
+			{
+				name:        "unknown version",
+				modify:      func(b []byte) []byte { b[5] = 99; return b },
+				expectedErr: ErrUnsupportedSignatureVersion,
+			},
+			{
+				name:        "zero block length",
+				modify:      func(b []byte) []byte { copy(b[6:10], []byte{0, 0, 0, 0}); return b },
+				expectedErr: ErrInvalidBlockLength,
+			},
+			{
+				name:        "too long block length",
+				modify:      func(b []byte) []byte { copy(b[6:10], []byte{0xff, 0xff, 0xff, 0xff}); return b },
+				expectedErr: ErrInvalidBlockLength,
+			},
+			{
+				name:        "unknown rolling checksum",
+				modify:      func(b []byte) []byte { b[10] = 99; return b },
+				expectedErr: ErrUnsupportedRollingChecksum,
+			},
+			{
+				name:        "unknown strong hash",
+				modify:      func(b []byte) []byte { b[11] = 99; return b },
+				expectedErr: ErrUnsupportedStrongHash,
+			},
+			{
+				name:        "too long strong hash",
+				modify:      func(b []byte) []byte { b[12] = 17; return b },
+				expectedErr: ErrInvalidStrongHashLength,
+			},
+		}
+		for _, tc := range tcs {
+			t.Run(tc.name, func(t *testing.T) {
+				b := make([]byte, len(valid))
+				copy(b, valid)
+				_, err := ReadSignatureHeader(bytes.NewReader(tc.modify(b)))
+				assert.ErrorIs(t, err, tc.expectedErr)
+			})
+		}
+	})
+}
+
+func TestReadSignatureFile(t *testing.T) {
+	t.Run("should return error on truncated bundle", func(t *testing.T) {
+		signature := bytes.Buffer{}
+		err := Signature(strings.NewReader("abcdefghijk"), &signature, SignatureOptions{BlockLength: 3})
+		assert.NoError(t, err)
+
+		_, err = ReadSignatureFile(bytes.NewReader(signature.Bytes()[:signature.Len()-1]))
+		assert.ErrorIs(t, err, ErrTruncatedSignature)
+	})
+
+	t.Run("should return error on missing bundle", func(t *testing.T) {
+		signature := bytes.Buffer{}
+		err := Signature(strings.NewReader("abcdefghijk"), &signature, SignatureOptions{BlockLength: 3})
+		assert.NoError(t, err)
+
+		withoutLastBundle := append(
+			signature.Bytes()[:signature.Len()-SIGNATURE_TRAILER_SIZE-ROLLING_CHECKSUM_SIZE-blake2b.Size256],
+			signature.Bytes()[signature.Len()-SIGNATURE_TRAILER_SIZE:]...,
+		)
+		_, err = ReadSignatureFile(bytes.NewReader(withoutLastBundle))
+		assert.ErrorIs(t, err, ErrTruncatedSignature)
+	})
+
+	t.Run("should use block length from signature", func(t *testing.T) {
+		signature := bytes.Buffer{}
+		err := Signature(strings.NewReader("abcdefghijk"), &signature, SignatureOptions{BlockLength: 3})
+		assert.NoError(t, err)
+
+		signatureFile, err := ReadSignatureFile(&signature)
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(3), signatureFile.Header.BlockLength)
+		assert.Equal(t, 4, signatureFile.Index.Len())
+		assert.Equal(t, uint64(11), signatureFile.Basis.Length)
+	})
+}
+
+func TestDeltaHeader(t *testing.T) {
+	t.Run("should read header that was written", func(t *testing.T) {
+		basis, err := calculateFileDigest(strings.NewReader("basis"))
+		assert.NoError(t, err)
+		header := NewDeltaHeader(basis, COMPRESSION_ZSTD)
+
+		readHeader, err := ReadDeltaHeader(bytes.NewReader(header.ToBytes()))
+		assert.NoError(t, err)
+		assert.Equal(t, header, readHeader)
+	})
+
+	t.Run("should read uncompressed version header", func(t *testing.T) {
+		basis, err := calculateFileDigest(strings.NewReader("basis"))
+		assert.NoError(t, err)
+		b := append([]byte("rddl\x00\x01"), basis.ToBytes()...)
+
+		readHeader, err := ReadDeltaHeader(bytes.NewReader(b))
+		assert.NoError(t, err)
+		assert.Equal(t, DeltaHeader{Version: DELTA_VERSION_UNCOMPRESSED, Compression: COMPRESSION_NONE, Basis: basis}, readHeader)
+	})
+
+	t.Run("should return error for invalid headers", func(t *testing.T) {
+		valid := NewDeltaHeader(FileDigest{Length: 1, Hash: make([]byte, 32)}, COMPRESSION_NONE).ToBytes()
+
+		_, err := ReadDeltaHeader(bytes.NewReader(valid[:DELTA_HEADER_SIZE-1]))
+		assert.ErrorIs(t, err, ErrTruncatedDelta)
+
+		b := append([]byte{}, valid...)
+		b[0] = 'x'
+		_, err = ReadDeltaHeader(bytes.NewReader(b))
+		assert.ErrorIs(t, err, ErrNotDelta)
+
+		b = append([]byte{}, valid...)
+		b[5] = 99
+		_, err = ReadDeltaHeader(bytes.NewReader(b))
+		assert.ErrorIs(t, err, ErrUnsupportedDeltaVersion)
+
+		b = append([]byte{}, valid...)
+		b[6] = 99
+		_, err = ReadDeltaHeader(bytes.NewReader(b))
+		assert.ErrorIs(t, err, ErrUnsupportedCompression)
+	})
+}
@@ -0,0 +1,159 @@
+package rdiff
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ErrTooManyBlocks is returned for signatures of more blocks than a
+// SignatureIndex can address.
+var ErrTooManyBlocks = errors.New("too many blocks in signature")
+
+// MAX_INDEXED_BLOCKS is the number of blocks a SignatureIndex can hold.
+const MAX_INDEXED_BLOCKS = math.MaxUint32
+
+// checksumMixer spreads rolling checksums over buckets. Multiplying by an
+// odd number is a bijection, so mixed checksums are compared directly and
+// multiplying by checksumUnmixer, its inverse, restores them.
+const (
+	checksumMixer   uint32 = 0x9e3779b1
+	checksumUnmixer uint32 = 0x0e8b2f51
+)
+
+// SignatureIndex looks up blocks of a signature by their rolling checksum.
+//
+// It takes 8 bytes per block for an entry holding the mixed rolling checksum
+// and the block index, 2 to 4 bytes per block for the bucket table and the
+// strong hash length of the signature per block for the packed hashes, so a
+// signature with 32 byte hashes takes 42 to 44 bytes per block. While it is
+// being read, arrays grow by doubling and can take twice as much.
+type SignatureIndex struct {
+	hashLength int
+	// hashes are the strong hashes of all blocks in block order.
+	hashes []byte
+	// entries are mixed checksums shifted above block indexes, sorted so
+	// that each bucket is a contiguous run in ascending order.
+	entries []uint64
+	// buckets holds the start of every bucket in entries, followed by
+	// len(entries). The bucket of a mixed checksum is its top bits.
+	buckets []uint32
+	bits    uint
+}
+
+func newSignatureIndex(hashLength int) *SignatureIndex {
+	return &SignatureIndex{hashLength: hashLength}
+}
+
+// add appends the next block, build has to be called once all are added.
+func (x *SignatureIndex) add(checksum uint32, hash []byte) error {
+	if len(x.entries) == MAX_INDEXED_BLOCKS {
+		return fmt.Errorf("%w: more than %d", ErrTooManyBlocks, MAX_INDEXED_BLOCKS)
+	}
+	x.entries = append(x.entries, uint64(checksum*checksumMixer)<<32|uint64(len(x.entries)))
+	x.hashes = append(x.hashes, hash...)
+	return nil
+}
+
+// build sorts the entries and fills the bucket table.
+func (x *SignatureIndex) build() {
+	sort.Slice(x.entries, func(i, j int) bool {
+		return x.entries[i] < x.entries[j]
+	})
+	x.bits = 0
+	for x.bits < 32 && 1<<(x.bits+1) < len(x.entries) {
+		x.bits++
+	}
+	x.buckets = make([]uint32, 1<<x.bits+1)
+	for _, entry := range x.entries {
+		x.buckets[x.bucket(uint32(entry>>32))+1]++
+	}
+	for i := 1; i < len(x.buckets); i++ {
+		x.buckets[i] += x.buckets[i-1]
+	}
+}
+
+func (x *SignatureIndex) bucket(mixed uint32) uint64 {
+	return uint64(mixed) >> (32 - x.bits)
+}
+
+// Len returns the number of blocks.
+func (x *SignatureIndex) Len() int {
+	return len(x.entries)
+}
+
+// Hash returns the strong hash of the block with the given index.
+func (x *SignatureIndex) Hash(index int) []byte {
+	return x.hashes[index*x.hashLength : (index+1)*x.hashLength]
+}
+
+// Checksums returns the rolling checksums of all blocks in block order,
+// taking another 4 bytes per block.
+func (x *SignatureIndex) Checksums() []uint32 {
+	checksums := make([]uint32, len(x.entries))
+	for _, entry := range x.entries {
+		checksums[uint32(entry)] = uint32(entry>>32) * checksumUnmixer
+	}
+	return checksums
+}
+
+// candidates returns the entries of blocks with the rolling checksum in
+// ascending order of their indexes.
+func (x *SignatureIndex) candidates(checksum uint32) []uint64 {
+	if len(x.entries) == 0 {
+		return nil
+	}
+	mixed := checksum * checksumMixer
+	b := x.bucket(mixed)
+	entries := x.entries[x.buckets[b]:x.buckets[b+1]]
+	key := uint64(mixed) << 32
+	from := searchEntries(entries, key)
+	// Block indexes stay below math.MaxUint32, so the next checksum starts
+	// at the first entry not below key|math.MaxUint32.
+	to := from + searchEntries(entries[from:], key|math.MaxUint32)
+	return entries[from:to]
+}
+
+// searchEntries returns the index of the first entry not below key.
+func searchEntries(entries []uint64, key uint64) int {
+	from, to := 0, len(entries)
+	for from < to {
+		middle := int(uint(from+to) >> 1)
+		if entries[middle] < key {
+			from = middle + 1
+		} else {
+			to = middle
+		}
+	}
+	return from
+}
+
+// matchingOffsetFinder returns a function looking up blocks with the given
+// rolling checksum and confirming the match with strongHash. Every block
+// sharing the rolling checksum is a candidate; preferred one wins if it
+// matches, otherwise the first matching one in the basis file.
+func (x *SignatureIndex) matchingOffsetFinder(strongHash func([]byte) []byte) func([]byte, uint32, int) (bool, int) {
+	return func(block []byte, checksum uint32, preferred int) (bool, int) {
+		candidates := x.candidates(checksum)
+		if len(candidates) == 0 {
+			return false, 0
+		}
+		blockHash := strongHash(block)
+		if preferred >= 0 && preferred < x.Len() {
+			key := candidates[0]&^math.MaxUint32 | uint64(preferred)
+			i := searchEntries(candidates, key)
+			if i < len(candidates) && candidates[i] == key && bytes.Equal(blockHash, x.Hash(preferred)) {
+				return true, preferred
+			}
+		}
+		for _, entry := range candidates {
+			index := int(uint32(entry))
+			if bytes.Equal(blockHash, x.Hash(index)) {
+				return true, index
+			}
+		}
+		return false, 0
+	}
+}
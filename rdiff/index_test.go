@@ -0,0 +1,156 @@
+package rdiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"runtime"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// unmixed returns the checksum mixed into the given value.
+func unmixed(mixed uint32) uint32 {
+	return mixed * checksumUnmixer
+}
+
+func indexHash(i int) []byte {
+	hash := make([]byte, 8)
+	binary.BigEndian.PutUint64(hash, uint64(i))
+	return hash
+}
+
+func TestSignatureIndex(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	checksums := []uint32{unmixed(0), unmixed(0xffffffff), unmixed(0xffffffff), 7}
+	for i := 0; i < 1000; i++ {
+		checksums = append(checksums, uint32(random.Intn(300)), random.Uint32())
+	}
+	index := newSignatureIndex(8)
+	for i, checksum := range checksums {
+		assert.NoError(t, index.add(checksum, indexHash(i)))
+	}
+	index.build()
+
+	t.Run("should find all blocks sharing checksum in ascending order", func(t *testing.T) {
+		for _, checksum := range checksums {
+			var expected []int
+			for i, c := range checksums {
+				if c == checksum {
+					expected = append(expected, i)
+				}
+			}
+			var found []int
+			for _, entry := range index.candidates(checksum) {
+				found = append(found, int(uint32(entry)))
+			}
+			assert.Equal(t, expected, found)
+		}
+	})
+
+	t.Run("should not find missing checksum", func(t *testing.T) {
+		assert.Empty(t, index.candidates(unmixed(0x12345678)))
+	})
+
+	t.Run("should return checksums and strong hashes in block order", func(t *testing.T) {
+		assert.Equal(t, len(checksums), index.Len())
+		assert.Equal(t, checksums, index.Checksums())
+		assert.Equal(t, indexHash(5), index.Hash(5))
+	})
+
+	t.Run("should prefer given block and fall back to first matching", func(t *testing.T) {
+		duplicated := newSignatureIndex(8)
+		for i := 0; i < 4; i++ {
+			assert.NoError(t, duplicated.add(42, []byte("samehash")))
+		}
+		duplicated.build()
+		find := duplicated.matchingOffsetFinder(func(b []byte) []byte { return b })
+
+		matching, offset := find([]byte("samehash"), 42, 2)
+		assert.True(t, matching)
+		assert.Equal(t, 2, offset)
+		matching, offset = find([]byte("samehash"), 42, 9)
+		assert.True(t, matching)
+		assert.Equal(t, 0, offset)
+		matching, _ = find([]byte("samehash"), 43, -1)
+		assert.False(t, matching)
+	})
+
+	t.Run("should look up nothing in empty index", func(t *testing.T) {
+		empty := newSignatureIndex(8)
+		empty.build()
+		assert.Empty(t, empty.candidates(7))
+	})
+}
+
+func TestReadSignatureFileInPieces(t *testing.T) {
+	t.Run("should index signature arriving byte by byte", func(t *testing.T) {
+		content := make([]byte, 100_000)
+		rand.New(rand.NewSource(1)).Read(content)
+		signature := bytes.Buffer{}
+		err := Signature(bytes.NewReader(content), &signature, SignatureOptions{BlockLength: 700})
+		assert.NoError(t, err)
+
+		signatureFile, err := ReadSignatureFile(iotest.OneByteReader(bytes.NewReader(signature.Bytes())))
+		assert.NoError(t, err)
+		assert.Equal(t, 143, signatureFile.Index.Len())
+		assert.Equal(t, uint64(len(content)), signatureFile.Basis.Length)
+	})
+}
+
+// signatureOfBlocks returns a plain signature of the given number of blocks
+// with random checksums and 16 byte hashes.
+func signatureOfBlocks(b *testing.B, blocks int) []byte {
+	header, err := NewSignatureHeader(1024, STRONG_HASH_XXH3, 16)
+	if err != nil {
+		b.Fatal(err)
+	}
+	signature := header.ToBytes()
+	bundles := make([]byte, blocks*header.BundleSize())
+	rand.New(rand.NewSource(1)).Read(bundles)
+	signature = append(signature, bundles...)
+	return append(signature, FileDigest{Length: uint64(blocks) * 1024, Hash: make([]byte, 32)}.ToBytes()...)
+}
+
+// BenchmarkReadSignatureFile reports the heap taken by the index of a
+// signature of a million blocks.
+func BenchmarkReadSignatureFile(b *testing.B) {
+	const blocks = 1_000_000
+	signature := signatureOfBlocks(b, blocks)
+	b.SetBytes(int64(len(signature)))
+	b.ResetTimer()
+
+	var stats runtime.MemStats
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		before := stats.HeapAlloc
+		signatureFile, err := ReadSignatureFile(bytes.NewReader(signature))
+		if err != nil {
+			b.Fatal(err)
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		b.ReportMetric(float64(stats.HeapAlloc-before)/blocks, "B/block")
+		runtime.KeepAlive(signatureFile)
+	}
+}
+
+// BenchmarkSignatureIndexLookup looks up rolling checksums missing from a
+// signature of a million blocks, as delta does for every unmatched byte.
+func BenchmarkSignatureIndexLookup(b *testing.B) {
+	signatureFile, err := ReadSignatureFile(bytes.NewReader(signatureOfBlocks(b, 1_000_000)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	checksums := make([]uint32, 1<<16)
+	for i := range checksums {
+		checksums[i] = rand.Uint32()
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		signatureFile.Index.candidates(checksums[i&(len(checksums)-1)])
+	}
+}
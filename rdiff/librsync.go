@@ -0,0 +1,383 @@
+package rdiff
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/md4"
+)
+
+// Magic numbers of librsync files.
+const (
+	RS_DELTA_MAGIC         uint32 = 0x72730236
+	RS_MD4_SIG_MAGIC       uint32 = 0x72730136
+	RS_BLAKE2_SIG_MAGIC    uint32 = 0x72730137
+	RS_RK_MD4_SIG_MAGIC    uint32 = 0x72730146
+	RS_RK_BLAKE2_SIG_MAGIC uint32 = 0x72730147
+)
+
+const LIBRSYNC_SIGNATURE_HEADER_SIZE = 4 + 4 + 4
+
+// librsync delta commands. Literal commands from RS_OP_LITERAL_1 to
+// RS_OP_LITERAL_64 carry the literal length in the opcode itself, the
+// remaining literal and copy commands are followed by big-endian operands
+// of 1, 2, 4 or 8 bytes.
+const (
+	RS_OP_END        byte = 0x00
+	RS_OP_LITERAL_1  byte = 0x01
+	RS_OP_LITERAL_64 byte = 0x40
+	RS_OP_LITERAL_N1 byte = 0x41
+	RS_OP_LITERAL_N8 byte = 0x44
+	RS_OP_COPY_N1_N1 byte = 0x45
+	RS_OP_COPY_N8_N8 byte = 0x54
+)
+
+// LibrsyncSignatureHeader precedes the blocks of a librsync signature.
+type LibrsyncSignatureHeader struct {
+	Magic            uint32
+	BlockLength      uint32
+	StrongHashLength uint32
+}
+
+func NewLibrsyncSignatureHeader(magic uint32, blockLength, strongHashLength int) (LibrsyncSignatureHeader, error) {
+	h := LibrsyncSignatureHeader{Magic: magic}
+	maxStrongHashLength, err := h.maxStrongHashLength()
+	if err != nil {
+		return LibrsyncSignatureHeader{}, err
+	}
+	if strongHashLength == 0 {
+		strongHashLength = maxStrongHashLength
+	}
+	if blockLength <= 0 || blockLength > MAX_BLOCK_LENGTH {
+		return LibrsyncSignatureHeader{}, fmt.Errorf("%w: %d", ErrInvalidBlockLength, blockLength)
+	}
+	if strongHashLength < 0 || strongHashLength > maxStrongHashLength {
+		return LibrsyncSignatureHeader{}, fmt.Errorf("%w: %d", ErrInvalidStrongHashLength, strongHashLength)
+	}
+	h.BlockLength = uint32(blockLength)
+	h.StrongHashLength = uint32(strongHashLength)
+	return h, nil
+}
+
+func (h LibrsyncSignatureHeader) ToBytes() []byte {
+	bytes := make([]byte, LIBRSYNC_SIGNATURE_HEADER_SIZE)
+	binary.BigEndian.PutUint32(bytes[0:4], h.Magic)
+	binary.BigEndian.PutUint32(bytes[4:8], h.BlockLength)
+	binary.BigEndian.PutUint32(bytes[8:12], h.StrongHashLength)
+	return bytes
+}
+
+func (h LibrsyncSignatureHeader) BundleSize() int {
+	return ROLLING_CHECKSUM_SIZE + int(h.StrongHashLength)
+}
+
+func (h LibrsyncSignatureHeader) maxStrongHashLength() (int, error) {
+	switch h.Magic {
+	case RS_MD4_SIG_MAGIC, RS_RK_MD4_SIG_MAGIC:
+		return md4.Size, nil
+	case RS_BLAKE2_SIG_MAGIC, RS_RK_BLAKE2_SIG_MAGIC:
+		return blake2b.Size256, nil
+	}
+	return 0, fmt.Errorf("%w: magic %#x", ErrNotSignature, h.Magic)
+}
+
+func (h LibrsyncSignatureHeader) checksumCalculation() func([]byte, *byte, int, *uint32, *uint32) (uint32, *uint32, *uint32) {
+	if h.Magic == RS_RK_MD4_SIG_MAGIC || h.Magic == RS_RK_BLAKE2_SIG_MAGIC {
+		return CalculateRabinKarp
+	}
+	return CalculateRollsum
+}
+
+func (h LibrsyncSignatureHeader) strongHash() func([]byte) []byte {
+	strongHash, _ := StrongHashByType(STRONG_HASH_BLAKE2B)
+	if h.Magic == RS_MD4_SIG_MAGIC || h.Magic == RS_RK_MD4_SIG_MAGIC {
+		strongHash, _ = StrongHashByType(STRONG_HASH_MD4)
+	}
+	return truncatedHash(strongHash, int(h.StrongHashLength))
+}
+
+func ReadLibrsyncSignatureHeader(signature io.Reader) (LibrsyncSignatureHeader, error) {
+	bytes := make([]byte, LIBRSYNC_SIGNATURE_HEADER_SIZE)
+	_, err := io.ReadFull(signature, bytes)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return LibrsyncSignatureHeader{}, ErrTruncatedSignature
+		}
+		return LibrsyncSignatureHeader{}, err
+	}
+
+	h := LibrsyncSignatureHeader{
+		Magic:            binary.BigEndian.Uint32(bytes[0:4]),
+		BlockLength:      binary.BigEndian.Uint32(bytes[4:8]),
+		StrongHashLength: binary.BigEndian.Uint32(bytes[8:12]),
+	}
+	maxStrongHashLength, err := h.maxStrongHashLength()
+	if err != nil {
+		return LibrsyncSignatureHeader{}, err
+	}
+	if h.BlockLength == 0 || h.BlockLength > MAX_BLOCK_LENGTH {
+		return LibrsyncSignatureHeader{}, fmt.Errorf("%w: %d", ErrInvalidBlockLength, h.BlockLength)
+	}
+	if h.StrongHashLength == 0 || h.StrongHashLength > uint32(maxStrongHashLength) {
+		return LibrsyncSignatureHeader{}, fmt.Errorf("%w: %d", ErrInvalidStrongHashLength, h.StrongHashLength)
+	}
+	return h, nil
+}
+
+func ReadLibrsyncSignatureFile(signature io.Reader) (LibrsyncSignatureHeader, *SignatureIndex, error) {
+	header, err := ReadLibrsyncSignatureHeader(signature)
+	if err != nil {
+		return LibrsyncSignatureHeader{}, nil, err
+	}
+	index, _, err := readBundles(signature, header.BundleSize(), 0)
+	if err != nil {
+		return LibrsyncSignatureHeader{}, nil, err
+	}
+	return header, index, nil
+}
+
+func librsyncDeltaHeaderToBytes() []byte {
+	bytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(bytes, RS_DELTA_MAGIC)
+	return bytes
+}
+
+func ReadLibrsyncDeltaHeader(delta io.Reader) error {
+	bytes := make([]byte, 4)
+	_, err := io.ReadFull(delta, bytes)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrTruncatedDelta
+		}
+		return err
+	}
+	if binary.BigEndian.Uint32(bytes) != RS_DELTA_MAGIC {
+		return ErrNotDelta
+	}
+	return nil
+}
+
+// ToLibrsyncBytes encodes the chunk as a librsync delta command using the
+// narrowest operands that fit.
+func (c DeltaChunk) ToLibrsyncBytes() []byte {
+	if !c.rawData {
+		from := *c.r.from
+		length := *c.r.to - *c.r.from
+		fromWidth, fromIndex := librsyncIntWidth(from)
+		lengthWidth, lengthIndex := librsyncIntWidth(length)
+
+		bytes := make([]byte, 1, 1+fromWidth+lengthWidth)
+		bytes[0] = RS_OP_COPY_N1_N1 + byte(fromIndex*4+lengthIndex)
+		bytes = appendLibrsyncInt(bytes, from, fromWidth)
+		return appendLibrsyncInt(bytes, length, lengthWidth)
+	}
+
+	length := uint64(len(c.d))
+	if length <= uint64(RS_OP_LITERAL_64) {
+		bytes := make([]byte, 1, 1+length)
+		bytes[0] = RS_OP_LITERAL_1 + byte(length-1)
+		return append(bytes, c.d...)
+	}
+	lengthWidth, lengthIndex := librsyncIntWidth(length)
+	bytes := make([]byte, 1, 1+lengthWidth+len(c.d))
+	bytes[0] = RS_OP_LITERAL_N1 + byte(lengthIndex)
+	bytes = appendLibrsyncInt(bytes, length, lengthWidth)
+	return append(bytes, c.d...)
+}
+
+func librsyncDeltaTrailerToBytes() []byte {
+	return []byte{RS_OP_END}
+}
+
+// LibrsyncDeltaReader sends commands read from a librsync delta to c until
+// the end command, refusing literals longer than maxLiteralLength and any
+// data following the end command.
+func LibrsyncDeltaReader(ctx context.Context, delta io.Reader, c chan DeltaChunk, maxLiteralLength int) error {
+	defer close(c)
+	for {
+		b := make([]byte, 1)
+		_, err := io.ReadFull(delta, b)
+		if err != nil {
+			return truncatedRecord(err, "end command missing")
+		}
+		op := b[0]
+		switch {
+		case op == RS_OP_END:
+			return expectEnd(delta)
+		case op >= RS_OP_LITERAL_1 && op <= RS_OP_LITERAL_N8:
+			length := uint64(op-RS_OP_LITERAL_1) + 1
+			if op >= RS_OP_LITERAL_N1 {
+				length, err = readLibrsyncInt(delta, 1<<(op-RS_OP_LITERAL_N1))
+				if err != nil {
+					return truncatedRecord(err, "literal length")
+				}
+			}
+			rawData, err := readLiteral(delta, length, maxLiteralLength)
+			if err != nil {
+				return err
+			}
+			err = sendDeltaChunk(ctx, c, NewDeltaChunkWithRawData(rawData))
+			if err != nil {
+				return err
+			}
+		case op >= RS_OP_COPY_N1_N1 && op <= RS_OP_COPY_N8_N8:
+			index := op - RS_OP_COPY_N1_N1
+			from, err := readLibrsyncInt(delta, 1<<(index/4))
+			if err != nil {
+				return truncatedRecord(err, "copy offset")
+			}
+			length, err := readLibrsyncInt(delta, 1<<(index%4))
+			if err != nil {
+				return truncatedRecord(err, "copy length")
+			}
+			// from+length overflowing ends up as an inverted range
+			chunk, err := newCopyChunk(from, from+length)
+			if err != nil {
+				return err
+			}
+			err = sendDeltaChunk(ctx, c, chunk)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: %#x", ErrUnknownOpcode, op)
+		}
+	}
+}
+
+// librsyncIntWidth returns how many bytes librsync uses to store v and the
+// index of that width among 1, 2, 4 and 8.
+func librsyncIntWidth(v uint64) (int, int) {
+	switch {
+	case v <= 0xff:
+		return 1, 0
+	case v <= 0xffff:
+		return 2, 1
+	case v <= 0xffffffff:
+		return 4, 2
+	}
+	return 8, 3
+}
+
+func appendLibrsyncInt(b []byte, v uint64, width int) []byte {
+	for i := width - 1; i >= 0; i-- {
+		b = append(b, byte(v>>(8*i)))
+	}
+	return b
+}
+
+func readLibrsyncInt(r io.Reader, width int) (uint64, error) {
+	bytes := make([]byte, width)
+	_, err := io.ReadFull(r, bytes)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, b := range bytes {
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// LibrsyncSignatureMagic returns the magic of librsync signatures with
+// strongHash, which defaults to BLAKE2, and the Rabin-Karp rolling checksum
+// or, without rabinKarp, the rollsum one. librsync reads Rabin-Karp
+// signatures since 2.2 and its rdiff writes them by default since 2.3.
+func LibrsyncSignatureMagic(strongHash StrongHashType, rabinKarp bool) (uint32, error) {
+	var magic uint32
+	switch strongHash {
+	case 0, STRONG_HASH_BLAKE2B:
+		magic = RS_BLAKE2_SIG_MAGIC
+	case STRONG_HASH_MD4:
+		magic = RS_MD4_SIG_MAGIC
+	default:
+		return 0, fmt.Errorf("%w: librsync supports only md4 and blake2b", ErrUnsupportedStrongHash)
+	}
+	if rabinKarp {
+		// Rabin-Karp magics are the rollsum ones plus 0x10.
+		magic += RS_RK_BLAKE2_SIG_MAGIC - RS_BLAKE2_SIG_MAGIC
+	}
+	return magic, nil
+}
+
+// librsyncSignature writes a librsync signature of basis.
+func librsyncSignature(ctx context.Context, basis io.ReaderAt, signature io.Writer, opts SignatureOptions) error {
+	magic := opts.LibrsyncMagic
+	if magic == 0 {
+		var err error
+		magic, err = LibrsyncSignatureMagic(opts.StrongHash, true)
+		if err != nil {
+			return err
+		}
+	}
+	blockLength := opts.blockLength(basis)
+	header, err := NewLibrsyncSignatureHeader(magic, blockLength, opts.StrongHashLength)
+	if err != nil {
+		return err
+	}
+	_, err = signature.Write(header.ToBytes())
+	if err != nil {
+		return err
+	}
+
+	checksumCalculation := header.checksumCalculation()
+	return sendChecksums(
+		ctx,
+		basis,
+		signature,
+		blockLength,
+		opts.jobs(),
+		func(data []byte) (uint32, *uint32, *uint32) {
+			return checksumCalculation(data, nil, len(data), nil, nil)
+		},
+		header.strongHash(),
+		io.Discard,
+	)
+}
+
+// librsyncDelta writes a librsync delta of newFile against a librsync
+// signature.
+func librsyncDelta(ctx context.Context, signature io.Reader, newFile io.Reader, delta io.Writer, opts DeltaOptions) error {
+	header, index, err := ReadLibrsyncSignatureFile(signature)
+	if err != nil {
+		return err
+	}
+	_, err = delta.Write(librsyncDeltaHeaderToBytes())
+	if err != nil {
+		return err
+	}
+
+	err = sendDeltaChunks(
+		ctx,
+		newFile,
+		delta,
+		int(header.BlockLength),
+		opts.jobs(),
+		opts.memoryLimit(),
+		index,
+		header.checksumCalculation(),
+		header.strongHash(),
+		DeltaChunk.ToLibrsyncBytes,
+		io.Discard,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = delta.Write(librsyncDeltaTrailerToBytes())
+	return err
+}
+
+// librsyncPatch applies a librsync delta on top of basis.
+func librsyncPatch(ctx context.Context, basis io.ReaderAt, delta io.Reader, newFile io.Writer, opts PatchOptions) error {
+	err := ReadLibrsyncDeltaHeader(delta)
+	if err != nil {
+		return err
+	}
+	return applyDelta(ctx, basis, newFile, opts.observed(func(ctx context.Context, c chan DeltaChunk) error {
+		return LibrsyncDeltaReader(ctx, delta, c, opts.maxLiteralLength())
+	}))
+}
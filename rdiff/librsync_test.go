@@ -0,0 +1,312 @@
+package rdiff
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Fixtures in testdata/librsync use a block length of 256 bytes. generate.sh
+// there regenerates them with the rdiff of LIBRSYNC_VERSION, which
+// TestLibrsyncInterop checks them and this package against.
+const (
+	LIBRSYNC_FIXTURES = "testdata/librsync"
+	LIBRSYNC_VERSION  = "2.3.4"
+	// REQUIRE_RDIFF_ENV makes TestLibrsyncInterop fail rather than skip
+	// without rdiff, so CI jobs installing it cannot silently skip it.
+	REQUIRE_RDIFF_ENV = "PLAIN_RDIFF_REQUIRE_RDIFF"
+)
+
+var librsyncSignatureFixtures = []struct {
+	file             string
+	magic            uint32
+	strongHashLength int
+	// hash and rollsum are the -H and -R options of rdiff signature.
+	hash    string
+	rollsum string
+}{
+	{file: "basis.md4.sig", magic: RS_MD4_SIG_MAGIC, strongHashLength: 16, hash: "md4", rollsum: "rollsum"},
+	{file: "basis.md4-8.sig", magic: RS_MD4_SIG_MAGIC, strongHashLength: 8, hash: "md4", rollsum: "rollsum"},
+	{file: "basis.blake2.sig", magic: RS_BLAKE2_SIG_MAGIC, strongHashLength: 32, hash: "blake2", rollsum: "rollsum"},
+	{file: "basis.rk-md4.sig", magic: RS_RK_MD4_SIG_MAGIC, strongHashLength: 16, hash: "md4", rollsum: "rabinkarp"},
+	{file: "basis.rk-blake2.sig", magic: RS_RK_BLAKE2_SIG_MAGIC, strongHashLength: 32, hash: "blake2", rollsum: "rabinkarp"},
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(LIBRSYNC_FIXTURES, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestLibrsyncSignature(t *testing.T) {
+	basis := readFixture(t, "basis.txt")
+	for _, tc := range librsyncSignatureFixtures {
+		t.Run("should produce "+tc.file, func(t *testing.T) {
+			signature := bytes.Buffer{}
+			err := Signature(bytes.NewReader(basis), &signature, SignatureOptions{
+				Format:           FORMAT_LIBRSYNC,
+				BlockLength:      256,
+				LibrsyncMagic:    tc.magic,
+				StrongHashLength: tc.strongHashLength,
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, readFixture(t, tc.file), signature.Bytes())
+		})
+	}
+
+	t.Run("should default to Rabin-Karp, BLAKE2 and librsync block length", func(t *testing.T) {
+		signature := bytes.Buffer{}
+		err := Signature(bytes.NewReader(basis), &signature, SignatureOptions{Format: FORMAT_LIBRSYNC})
+		assert.NoError(t, err)
+
+		header, err := ReadLibrsyncSignatureHeader(&signature)
+		assert.NoError(t, err)
+		assert.Equal(t, RS_RK_BLAKE2_SIG_MAGIC, header.Magic)
+		assert.Equal(t, uint32(DEFAULT_LIBRSYNC_BLOCK_LENGTH), header.BlockLength)
+		assert.Equal(t, uint32(32), header.StrongHashLength)
+	})
+
+	t.Run("should pick librsync magic from strong hash", func(t *testing.T) {
+		signature := bytes.Buffer{}
+		err := Signature(bytes.NewReader(basis), &signature, SignatureOptions{
+			Format:      FORMAT_LIBRSYNC,
+			BlockLength: 256,
+			StrongHash:  STRONG_HASH_MD4,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, readFixture(t, "basis.rk-md4.sig"), signature.Bytes())
+
+		magic, err := LibrsyncSignatureMagic(STRONG_HASH_MD4, false)
+		assert.NoError(t, err)
+		signature.Reset()
+		err = Signature(bytes.NewReader(basis), &signature, SignatureOptions{
+			Format:        FORMAT_LIBRSYNC,
+			BlockLength:   256,
+			LibrsyncMagic: magic,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, readFixture(t, "basis.md4.sig"), signature.Bytes())
+
+		err = Signature(bytes.NewReader(basis), &bytes.Buffer{}, SignatureOptions{
+			Format:     FORMAT_LIBRSYNC,
+			StrongHash: STRONG_HASH_XXH3,
+		})
+		assert.ErrorIs(t, err, ErrUnsupportedStrongHash)
+	})
+
+	t.Run("should refuse too long strong hash", func(t *testing.T) {
+		err := Signature(bytes.NewReader(basis), &bytes.Buffer{}, SignatureOptions{
+			Format:           FORMAT_LIBRSYNC,
+			LibrsyncMagic:    RS_MD4_SIG_MAGIC,
+			StrongHashLength: 17,
+		})
+		assert.ErrorIs(t, err, ErrInvalidStrongHashLength)
+	})
+}
+
+func TestLibrsyncPatch(t *testing.T) {
+	t.Run("should apply librsync delta", func(t *testing.T) {
+		newFile := bytes.Buffer{}
+		err := Patch(
+			bytes.NewReader(readFixture(t, "basis.txt")),
+			bytes.NewReader(readFixture(t, "new.delta")),
+			&newFile,
+			PatchOptions{Format: FORMAT_LIBRSYNC},
+		)
+		assert.NoError(t, err)
+		assert.Equal(t, readFixture(t, "new.txt"), newFile.Bytes())
+	})
+
+	t.Run("should return error on delta without end command", func(t *testing.T) {
+		delta := readFixture(t, "new.delta")
+		err := Patch(
+			bytes.NewReader(readFixture(t, "basis.txt")),
+			bytes.NewReader(delta[:len(delta)-1]),
+			&bytes.Buffer{},
+			PatchOptions{Format: FORMAT_LIBRSYNC},
+		)
+		assert.ErrorIs(t, err, ErrTruncatedDelta)
+	})
+
+	t.Run("should refuse copy range outside basis file", func(t *testing.T) {
+		// copy of 1 byte at offset 2000 with 2 byte operands
+		delta := append(librsyncDeltaHeaderToBytes(), RS_OP_COPY_N1_N1+5, 0x07, 0xd0, 0, 1, RS_OP_END)
+		err := Patch(
+			bytes.NewReader(readFixture(t, "basis.txt")),
+			bytes.NewReader(delta),
+			&bytes.Buffer{},
+			PatchOptions{Format: FORMAT_LIBRSYNC},
+		)
+		assert.ErrorIs(t, err, ErrRangeOutsideBasis)
+	})
+
+	t.Run("should refuse plain delta", func(t *testing.T) {
+		err := Patch(
+			bytes.NewReader(readFixture(t, "basis.txt")),
+			bytes.NewReader(NewDeltaHeader(FileDigest{Hash: make([]byte, 32)}, COMPRESSION_NONE).ToBytes()),
+			&bytes.Buffer{},
+			PatchOptions{Format: FORMAT_LIBRSYNC},
+		)
+		assert.ErrorIs(t, err, ErrNotDelta)
+	})
+}
+
+func TestLibrsyncDelta(t *testing.T) {
+	basis := readFixture(t, "basis.txt")
+	newContent := readFixture(t, "new.txt")
+	for _, tc := range librsyncSignatureFixtures {
+		t.Run("should recreate new file using "+tc.file, func(t *testing.T) {
+			delta := bytes.Buffer{}
+			err := Delta(
+				bytes.NewReader(readFixture(t, tc.file)),
+				bytes.NewReader(newContent),
+				&delta,
+				DeltaOptions{Format: FORMAT_LIBRSYNC},
+			)
+			assert.NoError(t, err)
+			assert.Less(t, delta.Len(), len(newContent)/2)
+
+			newFile := bytes.Buffer{}
+			err = Patch(bytes.NewReader(basis), &delta, &newFile, PatchOptions{Format: FORMAT_LIBRSYNC})
+			assert.NoError(t, err)
+			assert.Equal(t, newContent, newFile.Bytes())
+		})
+	}
+
+	t.Run("should refuse plain signature", func(t *testing.T) {
+		signature := bytes.Buffer{}
+		err := Signature(bytes.NewReader(basis), &signature, SignatureOptions{})
+		assert.NoError(t, err)
+
+		err = Delta(&signature, bytes.NewReader(newContent), &bytes.Buffer{}, DeltaOptions{Format: FORMAT_LIBRSYNC})
+		assert.ErrorIs(t, err, ErrNotSignature)
+	})
+}
+
+// TestLibrsyncInterop runs librsync's rdiff on the fixtures and is skipped
+// unless it is installed or REQUIRE_RDIFF_ENV is set.
+func TestLibrsyncInterop(t *testing.T) {
+	version, err := exec.Command("rdiff", "--version").Output()
+	if err != nil || !strings.Contains(string(version), "librsync") {
+		if os.Getenv(REQUIRE_RDIFF_ENV) != "" {
+			t.Fatalf("rdiff of librsync is required by %s but not installed", REQUIRE_RDIFF_ENV)
+		}
+		t.Skip("rdiff of librsync is not installed")
+	}
+	if !strings.Contains(string(version), "librsync "+LIBRSYNC_VERSION) {
+		t.Logf("fixtures are generated with librsync %s, not %s", LIBRSYNC_VERSION, strings.TrimSpace(string(version)))
+	}
+	rdiff := func(t *testing.T, args ...string) {
+		t.Helper()
+		output, err := exec.Command("rdiff", args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("rdiff %s: %v: %s", strings.Join(args, " "), err, output)
+		}
+	}
+	dir := t.TempDir()
+	basisPath := filepath.Join(LIBRSYNC_FIXTURES, "basis.txt")
+	newPath := filepath.Join(LIBRSYNC_FIXTURES, "new.txt")
+	basis := readFixture(t, "basis.txt")
+	newContent := readFixture(t, "new.txt")
+
+	for _, tc := range librsyncSignatureFixtures {
+		t.Run("should match rdiff signature of "+tc.file, func(t *testing.T) {
+			signaturePath := filepath.Join(dir, tc.file)
+			rdiff(t, "-f", "-b", "256", "-S", strconv.Itoa(tc.strongHashLength), "-H", tc.hash, "-R", tc.rollsum,
+				"signature", basisPath, signaturePath)
+			expected, err := os.ReadFile(signaturePath)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, readFixture(t, tc.file), "committed fixture differs, run generate.sh")
+
+			signature := bytes.Buffer{}
+			err = Signature(bytes.NewReader(basis), &signature, SignatureOptions{
+				Format:           FORMAT_LIBRSYNC,
+				BlockLength:      256,
+				LibrsyncMagic:    tc.magic,
+				StrongHashLength: tc.strongHashLength,
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, expected, signature.Bytes())
+		})
+	}
+
+	t.Run("should apply rdiff delta", func(t *testing.T) {
+		signaturePath := filepath.Join(dir, "default.sig")
+		deltaPath := filepath.Join(dir, "new.delta")
+		rdiff(t, "-f", "signature", basisPath, signaturePath)
+		rdiff(t, "-f", "delta", signaturePath, newPath, deltaPath)
+		delta, err := os.ReadFile(deltaPath)
+		assert.NoError(t, err)
+
+		newFile := bytes.Buffer{}
+		err = Patch(bytes.NewReader(basis), bytes.NewReader(delta), &newFile, PatchOptions{Format: FORMAT_LIBRSYNC})
+		assert.NoError(t, err)
+		assert.Equal(t, newContent, newFile.Bytes())
+	})
+
+	t.Run("should let rdiff apply delta", func(t *testing.T) {
+		signature := bytes.Buffer{}
+		assert.NoError(t, Signature(bytes.NewReader(basis), &signature, SignatureOptions{Format: FORMAT_LIBRSYNC}))
+		delta := bytes.Buffer{}
+		assert.NoError(t, Delta(&signature, bytes.NewReader(newContent), &delta, DeltaOptions{Format: FORMAT_LIBRSYNC}))
+		deltaPath := filepath.Join(dir, "plain-rdiff.delta")
+		assert.NoError(t, os.WriteFile(deltaPath, delta.Bytes(), 0o644))
+
+		newPath := filepath.Join(dir, "new.txt")
+		rdiff(t, "-f", "patch", basisPath, deltaPath, newPath)
+		newFile, err := os.ReadFile(newPath)
+		assert.NoError(t, err)
+		assert.Equal(t, newContent, newFile)
+	})
+}
+
+func TestToLibrsyncBytes(t *testing.T) {
+	copyChunk := func(from, to uint64) DeltaChunk {
+		return NewDeltaChunkWithRange(Range{&from, &to})
+	}
+	tcs := []struct {
+		name     string
+		chunk    DeltaChunk
+		expected []byte
+	}{
+		{
+			name:     "short literal",
+			chunk:    NewDeltaChunkWithRawData([]byte("abc")),
+			expected: []byte{0x03, 'a', 'b', 'c'},
+		},
+		{
+			name:     "literal with 1 byte length",
+			chunk:    NewDeltaChunkWithRawData(bytes.Repeat([]byte{'x'}, 65)),
+			expected: append([]byte{RS_OP_LITERAL_N1, 65}, bytes.Repeat([]byte{'x'}, 65)...),
+		},
+		{
+			name:     "copy with 1 byte operands",
+			chunk:    copyChunk(10, 20),
+			expected: []byte{RS_OP_COPY_N1_N1, 10, 10},
+		},
+		{
+			name:     "copy with 4 byte offset and 2 byte length",
+			chunk:    copyChunk(0x10000, 0x10000+0x100),
+			expected: []byte{0x4e, 0, 1, 0, 0, 1, 0},
+		},
+		{
+			name:     "copy with 8 byte offset and 1 byte length",
+			chunk:    copyChunk(1<<32, 1<<32+1),
+			expected: []byte{0x51, 0, 0, 0, 1, 0, 0, 0, 0, 1},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.chunk.ToLibrsyncBytes())
+		})
+	}
+}
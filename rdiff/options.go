@@ -0,0 +1,227 @@
+package rdiff
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"runtime"
+)
+
+type Format int
+
+const (
+	FORMAT_PLAIN Format = iota
+	FORMAT_LIBRSYNC
+)
+
+const (
+	DEFAULT_BLOCK_LENGTH          = 5000
+	DEFAULT_LIBRSYNC_BLOCK_LENGTH = 2048
+	// AUTO_BLOCK_LENGTH makes Signature pick the block length from the
+	// length of the basis file, see AutoBlockLength.
+	AUTO_BLOCK_LENGTH = -1
+)
+
+// DEFAULT_MAX_LITERAL_LENGTH is the default limit of literals accepted by
+// Patch. Delta never writes literals longer than LITERAL_CHUNK_LENGTH.
+const DEFAULT_MAX_LITERAL_LENGTH = 64 << 20
+
+// DEFAULT_DELTA_MEMORY_LIMIT is the default of DeltaOptions.MemoryLimit.
+const DEFAULT_DELTA_MEMORY_LIMIT = 256 << 20
+
+const (
+	MIN_AUTO_BLOCK_LENGTH = 700
+	MAX_AUTO_BLOCK_LENGTH = 1 << 17
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported format")
+
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "plain":
+		return FORMAT_PLAIN, nil
+	case "librsync":
+		return FORMAT_LIBRSYNC, nil
+	}
+	return 0, fmt.Errorf("%w: %s", ErrUnsupportedFormat, s)
+}
+
+func (f Format) String() string {
+	switch f {
+	case FORMAT_PLAIN:
+		return "plain"
+	case FORMAT_LIBRSYNC:
+		return "librsync"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+type SignatureOptions struct {
+	Format Format
+	// BlockLength defaults to DEFAULT_BLOCK_LENGTH or, for librsync,
+	// DEFAULT_LIBRSYNC_BLOCK_LENGTH, like the block size of the CLI. With
+	// AUTO_BLOCK_LENGTH it is picked from the length of the basis file if
+	// the basis reader can tell it, falling back to the default otherwise.
+	// The default stays fixed so that signatures of the same file with the
+	// same options do not depend on how its length is known.
+	BlockLength int
+	// StrongHash defaults to DEFAULT_STRONG_HASH. librsync signatures
+	// support only STRONG_HASH_MD4 and STRONG_HASH_BLAKE2B.
+	StrongHash StrongHashType
+	// StrongHashLength truncates strong hashes to make signatures smaller
+	// and defaults to the full hash length.
+	StrongHashLength int
+	// LibrsyncMagic selects the rolling checksum and strong hash of librsync
+	// signatures, overriding StrongHash. Like rdiff of librsync 2.3, it
+	// defaults to RS_RK_BLAKE2_SIG_MAGIC or RS_RK_MD4_SIG_MAGIC, depending on
+	// StrongHash. Older librsync versions need the rollsum magics, see
+	// LibrsyncSignatureMagic.
+	LibrsyncMagic uint32
+	// Jobs is the number of goroutines reading and hashing blocks of the
+	// basis concurrently and defaults to runtime.NumCPU(). With 1 the basis
+	// is read sequentially, which does not need concurrent ReadAt calls.
+	Jobs int
+	// Skipped is called by TreeSignature with the path and type of the
+	// files of the tree left out as neither regular files nor directories,
+	// such as symbolic links.
+	Skipped func(name string, mode fs.FileMode)
+}
+
+type DeltaOptions struct {
+	Format Format
+	// Compression of plain deltas, recorded in the delta header so Patch
+	// decompresses them transparently. librsync deltas are not compressed.
+	Compression Compression
+	// Jobs is the number of goroutines searching segments of the new file
+	// concurrently and defaults to runtime.NumCPU(). Segments resume
+	// matching after a copy crossing their start, so deltas can be marginally
+	// larger than the single pass of 1 job writes.
+	Jobs int
+	// MemoryLimit bounds the memory taken by data of the new file in Delta
+	// and defaults to DEFAULT_DELTA_MEMORY_LIMIT. Jobs are reduced so the
+	// segments they search fit in it. A single job takes the block length
+	// plus READ_AHEAD_LENGTH or twice the block length, whichever is more,
+	// and two literals of LITERAL_CHUNK_LENGTH whatever the limit: about
+	// 3 MiB with the default block length and 34 MiB with MAX_BLOCK_LENGTH.
+	// The signature is held in memory besides it.
+	MemoryLimit int
+	// Skipped is called by TreeDelta like SignatureOptions.Skipped.
+	Skipped func(name string, mode fs.FileMode)
+}
+
+type FetchOptions struct {
+	// Jobs is the number of goroutines searching segments of the local file
+	// concurrently, like DeltaOptions.Jobs.
+	Jobs int
+	// MemoryLimit bounds the memory taken by data of the local file while it
+	// is searched, like DeltaOptions.MemoryLimit.
+	MemoryLimit int
+}
+
+type PatchOptions struct {
+	Format Format
+	// MaxLiteralLength limits how much memory a single literal of the delta
+	// can take and defaults to DEFAULT_MAX_LITERAL_LENGTH.
+	MaxLiteralLength int
+	// observe is called with every delta chunk before it is applied.
+	observe func(DeltaChunk)
+}
+
+func (opts PatchOptions) maxLiteralLength() int {
+	if opts.MaxLiteralLength <= 0 {
+		return DEFAULT_MAX_LITERAL_LENGTH
+	}
+	return opts.MaxLiteralLength
+}
+
+func (opts SignatureOptions) jobs() int {
+	return jobs(opts.Jobs)
+}
+
+func (opts DeltaOptions) jobs() int {
+	return jobs(opts.Jobs)
+}
+
+func (opts DeltaOptions) memoryLimit() int {
+	if opts.MemoryLimit <= 0 {
+		return DEFAULT_DELTA_MEMORY_LIMIT
+	}
+	return opts.MemoryLimit
+}
+
+func (opts FetchOptions) jobs() int {
+	return jobs(opts.Jobs)
+}
+
+func (opts FetchOptions) memoryLimit() int {
+	return DeltaOptions{MemoryLimit: opts.MemoryLimit}.memoryLimit()
+}
+
+func jobs(n int) int {
+	if n <= 0 {
+		return runtime.NumCPU()
+	}
+	return n
+}
+
+// AutoBlockLength picks a block length proportional to the square root of
+// basisLength, like rsync does, so both the signature size and the cost of
+// a single mismatch grow slowly with the file. Plain signatures use blocks
+// between MIN_AUTO_BLOCK_LENGTH and MAX_AUTO_BLOCK_LENGTH rounded to 8 bytes,
+// librsync ones follow librsync: 256 bytes up to 64 KiB files and the
+// square root rounded up to 128 bytes above that.
+func AutoBlockLength(format Format, basisLength int64) int {
+	sqrt := int(math.Sqrt(float64(basisLength)))
+	if format == FORMAT_LIBRSYNC {
+		if basisLength <= 256*256 {
+			return 256
+		}
+		return (sqrt + 127) / 128 * 128
+	}
+
+	blockLength := sqrt / 8 * 8
+	if blockLength < MIN_AUTO_BLOCK_LENGTH {
+		return MIN_AUTO_BLOCK_LENGTH
+	}
+	if blockLength > MAX_AUTO_BLOCK_LENGTH {
+		return MAX_AUTO_BLOCK_LENGTH
+	}
+	return blockLength
+}
+
+// blockLength resolves opts.BlockLength for basis.
+func (opts SignatureOptions) blockLength(basis io.ReaderAt) int {
+	defaultBlockLength := DEFAULT_BLOCK_LENGTH
+	if opts.Format == FORMAT_LIBRSYNC {
+		defaultBlockLength = DEFAULT_LIBRSYNC_BLOCK_LENGTH
+	}
+	switch opts.BlockLength {
+	case 0:
+		return defaultBlockLength
+	case AUTO_BLOCK_LENGTH:
+		basisLength, ok := readerLength(basis)
+		if !ok {
+			return defaultBlockLength
+		}
+		return AutoBlockLength(opts.Format, basisLength)
+	}
+	return opts.BlockLength
+}
+
+// readerLength returns the length of readers that can tell it, like files
+// and in-memory readers.
+func readerLength(r io.ReaderAt) (int64, bool) {
+	switch r := r.(type) {
+	case interface{ Size() int64 }:
+		return r.Size(), true
+	case interface{ Stat() (fs.FileInfo, error) }:
+		info, err := r.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return 0, false
+		}
+		return info.Size(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,78 @@
+package rdiff
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAutoBlockLength(t *testing.T) {
+	tcs := []struct {
+		format      Format
+		basisLength int64
+		expected    int
+	}{
+		{format: FORMAT_PLAIN, basisLength: 0, expected: MIN_AUTO_BLOCK_LENGTH},
+		{format: FORMAT_PLAIN, basisLength: 100_000, expected: MIN_AUTO_BLOCK_LENGTH},
+		{format: FORMAT_PLAIN, basisLength: 100_000_000, expected: 10000},
+		{format: FORMAT_PLAIN, basisLength: 60_000_000, expected: 7744},
+		{format: FORMAT_PLAIN, basisLength: 1 << 40, expected: MAX_AUTO_BLOCK_LENGTH},
+		{format: FORMAT_LIBRSYNC, basisLength: 0, expected: 256},
+		{format: FORMAT_LIBRSYNC, basisLength: 256 * 256, expected: 256},
+		{format: FORMAT_LIBRSYNC, basisLength: 100_000_000, expected: 10112},
+	}
+	for _, tc := range tcs {
+		assert.Equal(t, tc.expected, AutoBlockLength(tc.format, tc.basisLength), "%s %d", tc.format, tc.basisLength)
+	}
+}
+
+func TestSignatureBlockLength(t *testing.T) {
+	basis := strings.Repeat("Imagine you have two files, A and B. ", 20_000)
+
+	t.Run("should record automatically picked block length", func(t *testing.T) {
+		signature := bytes.Buffer{}
+		err := Signature(strings.NewReader(basis), &signature, SignatureOptions{BlockLength: AUTO_BLOCK_LENGTH})
+		assert.NoError(t, err)
+
+		header, err := ReadSignatureHeader(&signature)
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(AutoBlockLength(FORMAT_PLAIN, int64(len(basis)))), header.BlockLength)
+	})
+
+	t.Run("should fall back to default block length for readers of unknown length", func(t *testing.T) {
+		signature := bytes.Buffer{}
+		err := Signature(readerAtOnly{strings.NewReader(basis)}, &signature, SignatureOptions{BlockLength: AUTO_BLOCK_LENGTH})
+		assert.NoError(t, err)
+
+		header, err := ReadSignatureHeader(&signature)
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(DEFAULT_BLOCK_LENGTH), header.BlockLength)
+	})
+
+	t.Run("should create delta with block length from signature", func(t *testing.T) {
+		newContent := strings.Replace(basis, "two", "three", 100)
+		signature := bytes.Buffer{}
+		err := Signature(strings.NewReader(basis), &signature, SignatureOptions{BlockLength: 1234})
+		assert.NoError(t, err)
+
+		delta := bytes.Buffer{}
+		err = Delta(&signature, strings.NewReader(newContent), &delta, DeltaOptions{})
+		assert.NoError(t, err)
+
+		newFile := bytes.Buffer{}
+		err = Patch(strings.NewReader(basis), &delta, &newFile, PatchOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, newContent, newFile.String())
+	})
+}
+
+type readerAtOnly struct {
+	r io.ReaderAt
+}
+
+func (r readerAtOnly) ReadAt(p []byte, off int64) (int, error) {
+	return r.r.ReadAt(p, off)
+}
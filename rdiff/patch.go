@@ -0,0 +1,60 @@
+package rdiff
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// COPY_CHUNK_LENGTH is the maximal length of basis data read at once, so
+// copying a long range does not take memory proportional to its length.
+const COPY_CHUNK_LENGTH = 1 << 20
+
+func ApplyDeltaChunks(ctx context.Context, deltaChunksChan chan DeltaChunk, oldFileReader io.ReaderAt, newFileWriterChan chan []byte) error {
+	defer close(newFileWriterChan)
+	for ss := range deltaChunksChan {
+		if !ss.rawData {
+			err := copyRange(ctx, *ss.r.from, *ss.r.to, oldFileReader, newFileWriterChan)
+			if err != nil {
+				return err
+			}
+		} else {
+			err := sendChunk(ctx, newFileWriterChan, ss.d)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyRange sends basis data between from and to in chunks of at most
+// COPY_CHUNK_LENGTH bytes, returning ErrRangeOutsideBasis if basis ends
+// before to.
+func copyRange(ctx context.Context, from, to uint64, basis io.ReaderAt, c chan<- []byte) error {
+	if to > math.MaxInt64 {
+		return fmt.Errorf("%w: %d-%d", ErrRangeOutsideBasis, from, to)
+	}
+	for offset := from; offset < to; {
+		chunkLength := to - offset
+		if chunkLength > COPY_CHUNK_LENGTH {
+			chunkLength = COPY_CHUNK_LENGTH
+		}
+		data := make([]byte, chunkLength)
+		readBytes, err := basis.ReadAt(data, int64(offset))
+		if readBytes < len(data) {
+			if err == nil || errors.Is(err, io.EOF) {
+				return fmt.Errorf("%w: %d-%d", ErrRangeOutsideBasis, from, to)
+			}
+			return err
+		}
+		err = sendChunk(ctx, c, data)
+		if err != nil {
+			return err
+		}
+		offset += chunkLength
+	}
+	return nil
+}
@@ -0,0 +1,345 @@
+// Package rdiff computes signatures, deltas and patches in the spirit of rdiff.
+//
+// A signature describes the basis file in blocks of a fixed length, a delta
+// describes the new file in terms of those blocks plus literal data and a
+// patch applies the delta on top of the basis file to recreate the new file.
+//
+// Files are written either in this package's own format, which identifies
+// the basis and target files so patching can be verified, or in the format
+// of librsync's rdiff.
+package rdiff
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Signature reads basis in blocks and writes their checksums to signature.
+func Signature(basis io.ReaderAt, signature io.Writer, opts SignatureOptions) error {
+	return SignatureContext(context.Background(), basis, signature, opts)
+}
+
+// SignatureContext is like Signature but stops once ctx is done, returning
+// its error.
+func SignatureContext(ctx context.Context, basis io.ReaderAt, signature io.Writer, opts SignatureOptions) error {
+	switch opts.Format {
+	case FORMAT_PLAIN:
+		return plainSignature(ctx, basis, signature, opts)
+	case FORMAT_LIBRSYNC:
+		return librsyncSignature(ctx, basis, signature, opts)
+	}
+	return fmt.Errorf("%w: %s", ErrUnsupportedFormat, opts.Format)
+}
+
+// Delta compares newFile against the blocks described by signature and
+// writes the resulting delta to delta. The block length is taken from the
+// signature header. newFile is read once from start to end, so it can be a
+// pipe or a socket.
+func Delta(signature io.Reader, newFile io.Reader, delta io.Writer, opts DeltaOptions) error {
+	return DeltaContext(context.Background(), signature, newFile, delta, opts)
+}
+
+// DeltaContext is like Delta but stops once ctx is done, returning its
+// error.
+func DeltaContext(ctx context.Context, signature io.Reader, newFile io.Reader, delta io.Writer, opts DeltaOptions) error {
+	switch opts.Format {
+	case FORMAT_PLAIN:
+		_, err := plainDelta(ctx, signature, newFile, delta, opts)
+		return err
+	case FORMAT_LIBRSYNC:
+		if opts.Compression != COMPRESSION_NONE {
+			return fmt.Errorf("%w: librsync deltas are not compressed", ErrUnsupportedCompression)
+		}
+		return librsyncDelta(ctx, signature, newFile, delta, opts)
+	}
+	return fmt.Errorf("%w: %s", ErrUnsupportedFormat, opts.Format)
+}
+
+// Patch applies delta on top of basis and writes the recreated file to
+// newFile.
+func Patch(basis io.ReaderAt, delta io.Reader, newFile io.Writer, opts PatchOptions) error {
+	return PatchContext(context.Background(), basis, delta, newFile, opts)
+}
+
+// PatchContext is like Patch but stops once ctx is done, returning its
+// error.
+func PatchContext(ctx context.Context, basis io.ReaderAt, delta io.Reader, newFile io.Writer, opts PatchOptions) error {
+	switch opts.Format {
+	case FORMAT_PLAIN:
+		return plainPatch(ctx, basis, delta, newFile, opts)
+	case FORMAT_LIBRSYNC:
+		return librsyncPatch(ctx, basis, delta, newFile, opts)
+	}
+	return fmt.Errorf("%w: %s", ErrUnsupportedFormat, opts.Format)
+}
+
+// plainSignature writes a signature header, the blocks' checksums and the
+// digest of basis to signature.
+func plainSignature(ctx context.Context, basis io.ReaderAt, signature io.Writer, opts SignatureOptions) error {
+	blockLength := opts.blockLength(basis)
+	strongHash := opts.StrongHash
+	if strongHash == 0 {
+		strongHash = DEFAULT_STRONG_HASH
+	}
+	header, err := NewSignatureHeader(blockLength, strongHash, opts.StrongHashLength)
+	if err != nil {
+		return err
+	}
+	_, err = signature.Write(header.ToBytes())
+	if err != nil {
+		return err
+	}
+
+	digest := newDigestWriter()
+	err = sendChecksums(
+		ctx,
+		basis,
+		signature,
+		blockLength,
+		opts.jobs(),
+		CalculateChecksumWithoutPreviousCompounds,
+		header.strongHash(),
+		digest,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = signature.Write(digest.Digest().ToBytes())
+	return err
+}
+
+// plainDelta writes a delta header identifying the basis file, the delta
+// chunks and an end operation carrying the digest of newFile, compressing
+// everything following the header with opts.Compression. It returns the
+// digest of newFile.
+func plainDelta(ctx context.Context, signature io.Reader, newFile io.Reader, delta io.Writer, opts DeltaOptions) (FileDigest, error) {
+	signatureFile, err := ReadSignatureFile(signature)
+	if err != nil {
+		return FileDigest{}, err
+	}
+	_, err = delta.Write(NewDeltaHeader(signatureFile.Basis, opts.Compression).ToBytes())
+	if err != nil {
+		return FileDigest{}, err
+	}
+	body, err := opts.Compression.writer(delta)
+	if err != nil {
+		return FileDigest{}, err
+	}
+
+	digest := newDigestWriter()
+	err = sendDeltaChunks(
+		ctx,
+		newFile,
+		body,
+		int(signatureFile.Header.BlockLength),
+		opts.jobs(),
+		opts.memoryLimit(),
+		signatureFile.Index,
+		CalculateChecksum,
+		signatureFile.Header.strongHash(),
+		compactEncoder(),
+		digest,
+	)
+	if err != nil {
+		return FileDigest{}, err
+	}
+	_, err = body.Write(deltaTrailerToBytes(digest.Digest()))
+	if err != nil {
+		return FileDigest{}, err
+	}
+	return digest.Digest(), body.Close()
+}
+
+// plainPatch refuses basis files other than the one the delta was
+// calculated against and returns ErrTargetMismatch when the written file
+// differs from the one the delta was calculated from.
+func plainPatch(ctx context.Context, basis io.ReaderAt, delta io.Reader, newFile io.Writer, opts PatchOptions) error {
+	header, err := ReadDeltaHeader(delta)
+	if err != nil {
+		return err
+	}
+	basisDigest, err := calculateFileDigest(io.NewSectionReader(basis, 0, math.MaxInt64))
+	if err != nil {
+		return err
+	}
+	if !basisDigest.Equal(header.Basis) {
+		return ErrBasisMismatch
+	}
+	body, err := header.Body(delta)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	var target FileDigest
+	digest := newDigestWriter()
+	err = applyDelta(ctx, basis, io.MultiWriter(newFile, digest), opts.observed(func(ctx context.Context, c chan DeltaChunk) error {
+		var err error
+		target, err = DeltaReader(ctx, body, header.Version, c, opts.maxLiteralLength())
+		return err
+	}))
+	if err != nil {
+		return err
+	}
+	if !digest.Digest().Equal(target) {
+		return ErrTargetMismatch
+	}
+	return nil
+}
+
+// sendChecksums writes bundles of basis blocks to signature, passing every
+// byte of basis to sink. More than one job hashes blocks concurrently.
+func sendChecksums(
+	ctx context.Context,
+	basis io.ReaderAt,
+	signature io.Writer,
+	blockLength int,
+	jobs int,
+	checksumCalculation func([]byte) (uint32, *uint32, *uint32),
+	strongHash func([]byte) []byte,
+	sink io.Writer,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c := make(chan []byte)
+	errChan := make(chan error, 1)
+	go func() {
+		if jobs > 1 {
+			errChan <- CalculateAndSendChecksumsConcurrently(ctx, basis, blockLength, jobs, c, checksumCalculation, strongHash, sink)
+			return
+		}
+		br := NewBufferedReader(blockLength, io.NewSectionReader(basis, 0, math.MaxInt64))
+		br.TeeTo(sink)
+		errChan <- CalculateAndSendChecksums(ctx, br, c, checksumCalculation, strongHash)
+	}()
+
+	err := WriteChunks(signature, c)
+	if err != nil {
+		cancel()
+		<-errChan
+		return err
+	}
+	return <-errChan
+}
+
+// sendDeltaChunks writes delta chunks of newFile encoded with encode to
+// delta, passing every byte of newFile to sink. More than one job searches
+// segments of newFile concurrently if more than one fits in memoryLimit.
+func sendDeltaChunks(
+	ctx context.Context,
+	newFile io.Reader,
+	delta io.Writer,
+	blockLength int,
+	jobs int,
+	memoryLimit int,
+	index *SignatureIndex,
+	checksumCalculation func([]byte, *byte, int, *uint32, *uint32) (uint32, *uint32, *uint32),
+	strongHash func([]byte) []byte,
+	encode func(DeltaChunk) []byte,
+	sink io.Writer,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c := make(chan DeltaChunk)
+	errChan := make(chan error, 1)
+	go func() {
+		segments := concurrentDeltaSegments(blockLength, jobs, memoryLimit)
+		if jobs > 1 && segments > 1 {
+			errChan <- CalculateAndSendDeltaChunksConcurrently(
+				ctx,
+				newFile,
+				blockLength,
+				jobs,
+				segments,
+				c,
+				index.matchingOffsetFinder(strongHash),
+				checksumCalculation,
+				sink,
+			)
+			return
+		}
+		br := NewBufferedReader(blockLength, newFile)
+		br.TeeTo(sink)
+		errChan <- CalculateAndSendDeltaChunks(
+			ctx,
+			br,
+			c,
+			index.matchingOffsetFinder(strongHash),
+			checksumCalculation,
+		)
+	}()
+
+	err := WriteDeltaChunks(delta, c, encode)
+	if err != nil {
+		cancel()
+		<-errChan
+		return err
+	}
+	return <-errChan
+}
+
+// applyDelta writes chunks sent by deltaReader, applied on top of basis, to
+// newFile. deltaReader has to stop once the context passed to it is done.
+func applyDelta(
+	ctx context.Context,
+	basis io.ReaderAt,
+	newFile io.Writer,
+	deltaReader func(context.Context, chan DeltaChunk) error,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c := make(chan DeltaChunk)
+	newFileWriterChan := make(chan []byte)
+
+	readErrChan := make(chan error, 1)
+	go func() {
+		readErrChan <- deltaReader(ctx, c)
+	}()
+
+	applyErrChan := make(chan error, 1)
+	go func() {
+		err := ApplyDeltaChunks(ctx, c, basis, newFileWriterChan)
+		if err != nil {
+			cancel()
+		}
+		applyErrChan <- err
+	}()
+
+	err := WriteChunks(newFile, newFileWriterChan)
+	if err != nil {
+		cancel()
+		<-applyErrChan
+		<-readErrChan
+		return err
+	}
+	if err := <-applyErrChan; err != nil {
+		<-readErrChan
+		return err
+	}
+	return <-readErrChan
+}
+
+// sendChunk sends chunk to c unless ctx is done first.
+func sendChunk(ctx context.Context, c chan<- []byte, chunk []byte) error {
+	select {
+	case c <- chunk:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sendDeltaChunk sends chunk to c unless ctx is done first.
+func sendDeltaChunk(ctx context.Context, c chan<- DeltaChunk, chunk DeltaChunk) error {
+	select {
+	case c <- chunk:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,827 @@
+package rdiff
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignatureDeltaPatch(t *testing.T) {
+	tcs := []struct {
+		name       string
+		oldContent string
+		newContent string
+	}{
+		{
+			name:       "should recreate identical file",
+			oldContent: "Imagine you have two files, A and B, and you wish to update B to be the same as A.",
+			newContent: "Imagine you have two files, A and B, and you wish to update B to be the same as A.",
+		},
+		{
+			name:       "should recreate changed file",
+			oldContent: "Imagine you have two files, A and B, and you wish to update B to be the same as A.",
+			newContent: "Imagine you wish to uphave two files, A and B, and you wish to update B to be the same as A!",
+		},
+		{
+			name:       "should recreate file ending with shorter last block of old file",
+			oldContent: "abcdefghijklmnopqrstuvwxy",
+			newContent: "XXuvwxy",
+		},
+		{
+			name:       "should recreate file basing on empty file",
+			oldContent: "",
+			newContent: "Imagine you have two files",
+		},
+		{
+			name:       "should recreate empty file",
+			oldContent: "Imagine you have two files",
+			newContent: "",
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			basis := strings.NewReader(tc.oldContent)
+
+			signature := bytes.Buffer{}
+			err := Signature(basis, &signature, SignatureOptions{BlockLength: _WINDOW_SIZE})
+			assert.NoError(t, err)
+
+			delta := bytes.Buffer{}
+			err = Delta(&signature, strings.NewReader(tc.newContent), &delta, DeltaOptions{})
+			assert.NoError(t, err)
+
+			newFile := bytes.Buffer{}
+			err = Patch(basis, &delta, &newFile, PatchOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.newContent, newFile.String())
+		})
+	}
+}
+
+func TestDeltaBlockLength(t *testing.T) {
+	tcs := []struct {
+		format Format
+		offset int
+	}{
+		{format: FORMAT_PLAIN, offset: 6},
+		{format: FORMAT_LIBRSYNC, offset: 4},
+	}
+	for _, tc := range tcs {
+		t.Run("should refuse "+tc.format.String()+" signature with too long blocks", func(t *testing.T) {
+			signature := bytes.Buffer{}
+			assert.NoError(t, Signature(bytes.NewReader(nil), &signature, SignatureOptions{Format: tc.format}))
+			crafted := signature.Bytes()
+			copy(crafted[tc.offset:tc.offset+4], []byte{0xff, 0xff, 0xff, 0xff})
+
+			err := Delta(bytes.NewReader(crafted), strings.NewReader("new"), io.Discard, DeltaOptions{Format: tc.format})
+			assert.ErrorIs(t, err, ErrInvalidBlockLength)
+			assert.True(t, IsInvalidInput(err))
+		})
+	}
+
+	t.Run("should refuse too long blocks", func(t *testing.T) {
+		err := Signature(bytes.NewReader(nil), io.Discard, SignatureOptions{BlockLength: MAX_BLOCK_LENGTH + 1})
+		assert.ErrorIs(t, err, ErrInvalidBlockLength)
+	})
+}
+
+func TestConcurrentSignature(t *testing.T) {
+	basis := make([]byte, 3*SIGNATURE_SEGMENT_LENGTH+1234)
+	rand.New(rand.NewSource(1)).Read(basis)
+
+	for _, format := range []Format{FORMAT_PLAIN, FORMAT_LIBRSYNC} {
+		t.Run("should write the same "+format.String()+" signature as a single job", func(t *testing.T) {
+			sequential := bytes.Buffer{}
+			err := Signature(bytes.NewReader(basis), &sequential, SignatureOptions{Format: format, Jobs: 1})
+			assert.NoError(t, err)
+
+			concurrent := bytes.Buffer{}
+			err = Signature(bytes.NewReader(basis), &concurrent, SignatureOptions{Format: format, Jobs: 4})
+			assert.NoError(t, err)
+			assert.Equal(t, sequential.Bytes(), concurrent.Bytes())
+		})
+	}
+}
+
+func TestConcurrentDelta(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	oldContent := make([]byte, 3*DELTA_SEGMENT_LENGTH+1234)
+	random.Read(oldContent)
+	edited := append([]byte{}, oldContent...)
+	for i := 0; i < 100; i++ {
+		edited[random.Intn(len(edited))]++
+	}
+	// Inserting bytes shifts matches off segment boundaries.
+	shifted := append(append(append([]byte{}, oldContent[:100]...), "inserted"...), oldContent[100:]...)
+
+	tcs := []struct {
+		name       string
+		newContent []byte
+	}{
+		{name: "should recreate identical file", newContent: oldContent},
+		{name: "should recreate file with random edits", newContent: edited},
+		{name: "should recreate file with matches crossing segments", newContent: shifted},
+		{name: "should recreate file shorter than segment", newContent: oldContent[:1000]},
+		{name: "should recreate empty file", newContent: []byte{}},
+	}
+	for _, format := range []Format{FORMAT_PLAIN, FORMAT_LIBRSYNC} {
+		signature := bytes.Buffer{}
+		err := Signature(bytes.NewReader(oldContent), &signature, SignatureOptions{Format: format, BlockLength: 4096})
+		assert.NoError(t, err)
+
+		for _, tc := range tcs {
+			t.Run(tc.name+" from "+format.String()+" delta", func(t *testing.T) {
+				createDelta := func(jobs int) []byte {
+					delta := bytes.Buffer{}
+					err := Delta(bytes.NewReader(signature.Bytes()), bytes.NewReader(tc.newContent), &delta, DeltaOptions{Format: format, Jobs: jobs})
+					assert.NoError(t, err)
+					return delta.Bytes()
+				}
+				sequential := createDelta(1)
+				concurrent := createDelta(4)
+				assert.LessOrEqual(t, len(concurrent), len(sequential)+3*4096)
+
+				newFile := bytes.Buffer{}
+				err := Patch(bytes.NewReader(oldContent), bytes.NewReader(concurrent), &newFile, PatchOptions{Format: format})
+				assert.NoError(t, err)
+				assert.True(t, bytes.Equal(tc.newContent, newFile.Bytes()))
+			})
+		}
+	}
+}
+
+func TestDeltaMemory(t *testing.T) {
+	basis := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(basis)
+
+	tcs := []struct {
+		name          string
+		blockLength   int
+		newFileLength int64
+		opts          DeltaOptions
+		maxHeapGrowth uint64
+	}{
+		{
+			name:          "should not hold literals of completely different file in memory",
+			blockLength:   DEFAULT_BLOCK_LENGTH,
+			newFileLength: 32 << 20,
+			opts:          DeltaOptions{Jobs: 1},
+			maxHeapGrowth: 8 << 20,
+		},
+		{
+			name:          "should keep concurrent segments within memory limit",
+			blockLength:   DEFAULT_BLOCK_LENGTH,
+			newFileLength: 96 << 20,
+			opts:          DeltaOptions{Jobs: 4, MemoryLimit: 2 * 2 * DELTA_SEGMENT_LENGTH},
+			maxHeapGrowth: 2*2*DELTA_SEGMENT_LENGTH + 8<<20,
+		},
+		{
+			name:          "should take memory of a single job of longest blocks below limit",
+			blockLength:   MAX_BLOCK_LENGTH,
+			newFileLength: 48 << 20,
+			opts:          DeltaOptions{Jobs: 4, MemoryLimit: 1 << 20},
+			// Garbage grows with the heap, far less than the 4 jobs would
+			// take without the limit.
+			maxHeapGrowth: uint64(sequentialDeltaMemory(MAX_BLOCK_LENGTH)) + 16<<20,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			signature := bytes.Buffer{}
+			err := Signature(bytes.NewReader(basis), &signature, SignatureOptions{BlockLength: tc.blockLength})
+			assert.NoError(t, err)
+			if tc.opts.Jobs > 1 && tc.opts.MemoryLimit >= sequentialDeltaMemory(tc.blockLength) {
+				assert.Greater(t, concurrentDeltaSegments(tc.blockLength, tc.opts.Jobs, tc.opts.MemoryLimit), 1)
+			}
+			newFile := io.LimitReader(rand.New(rand.NewSource(2)), tc.newFileLength)
+			growth := peakHeapGrowth(func() {
+				err := Delta(bytes.NewReader(signature.Bytes()), newFile, io.Discard, tc.opts)
+				assert.NoError(t, err)
+			})
+			assert.Less(t, growth, tc.maxHeapGrowth)
+		})
+	}
+}
+
+// peakHeapGrowth returns how far the heap grew above its size before f while
+// f ran, sampling it every millisecond.
+func peakHeapGrowth(f func()) uint64 {
+	defer debug.SetGCPercent(debug.SetGCPercent(10))
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	baseline := stats.HeapAlloc
+
+	done := make(chan struct{})
+	peakChan := make(chan uint64)
+	go func() {
+		var stats runtime.MemStats
+		var peak uint64
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				runtime.ReadMemStats(&stats)
+				if stats.HeapAlloc > peak {
+					peak = stats.HeapAlloc
+				}
+			case <-done:
+				peakChan <- peak
+				return
+			}
+		}
+	}()
+	f()
+	close(done)
+	peak := <-peakChan
+	if peak < baseline {
+		return 0
+	}
+	return peak - baseline
+}
+
+func TestDeltaFromNonSeekableReader(t *testing.T) {
+	oldContent := strings.Repeat("Imagine you have two files, A and B. ", 100_000)
+	newContent := strings.Replace(oldContent, "two", "three", 1000)
+
+	signature := bytes.Buffer{}
+	err := Signature(strings.NewReader(oldContent), &signature, SignatureOptions{BlockLength: 1000})
+	assert.NoError(t, err)
+
+	t.Run("should create the same delta as from seekable reader", func(t *testing.T) {
+		expected := bytes.Buffer{}
+		err := Delta(bytes.NewReader(signature.Bytes()), strings.NewReader(newContent), &expected, DeltaOptions{})
+		assert.NoError(t, err)
+
+		pipeReader, pipeWriter := io.Pipe()
+		go func() {
+			// pipe hands over data in small pieces, like stdin
+			for _, chunk := range strings.SplitAfter(newContent, "B. ") {
+				pipeWriter.Write([]byte(chunk))
+			}
+			pipeWriter.Close()
+		}()
+		delta := bytes.Buffer{}
+		err = Delta(bytes.NewReader(signature.Bytes()), pipeReader, &delta, DeltaOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, expected.Bytes(), delta.Bytes())
+
+		newFile := bytes.Buffer{}
+		err = Patch(strings.NewReader(oldContent), &delta, &newFile, PatchOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, newContent, newFile.String())
+	})
+}
+
+func TestPatchVerification(t *testing.T) {
+	oldContent := "Imagine you have two files, A and B, and you wish to update B to be the same as A."
+	newContent := "Imagine you wish to uphave two files, A and B, and you wish to update B to be the same as A!"
+
+	createDelta := func(t *testing.T) []byte {
+		signature := bytes.Buffer{}
+		err := Signature(strings.NewReader(oldContent), &signature, SignatureOptions{BlockLength: _WINDOW_SIZE})
+		assert.NoError(t, err)
+		delta := bytes.Buffer{}
+		err = Delta(&signature, strings.NewReader(newContent), &delta, DeltaOptions{})
+		assert.NoError(t, err)
+		return delta.Bytes()
+	}
+
+	t.Run("should read delta arriving in pieces", func(t *testing.T) {
+		delta := createDelta(t)
+
+		newFile := bytes.Buffer{}
+		err := Patch(strings.NewReader(oldContent), iotest.OneByteReader(bytes.NewReader(delta)), &newFile, PatchOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, newContent, newFile.String())
+	})
+
+	t.Run("should refuse wrong basis file", func(t *testing.T) {
+		delta := createDelta(t)
+		wrongBasis := strings.NewReader(strings.Replace(oldContent, "two", "TWO", 1))
+
+		err := Patch(wrongBasis, bytes.NewReader(delta), &bytes.Buffer{}, PatchOptions{})
+		assert.ErrorIs(t, err, ErrBasisMismatch)
+	})
+
+	t.Run("should detect corrupted literal data", func(t *testing.T) {
+		delta := createDelta(t)
+		index := bytes.Index(delta, []byte("wish to up"))
+		assert.NotEqual(t, -1, index)
+		delta[index] = 'W'
+
+		err := Patch(strings.NewReader(oldContent), bytes.NewReader(delta), &bytes.Buffer{}, PatchOptions{})
+		assert.ErrorIs(t, err, ErrTargetMismatch)
+	})
+
+	t.Run("should return error on missing trailer", func(t *testing.T) {
+		delta := createDelta(t)
+
+		err := Patch(strings.NewReader(oldContent), bytes.NewReader(delta[:len(delta)-DELTA_TRAILER_SIZE]), &bytes.Buffer{}, PatchOptions{})
+		assert.ErrorIs(t, err, ErrTruncatedDelta)
+	})
+
+	t.Run("should refuse copy range outside basis file", func(t *testing.T) {
+		basisDigest, err := calculateFileDigest(strings.NewReader(oldContent))
+		assert.NoError(t, err)
+		delta := bytes.Join([][]byte{
+			NewDeltaHeader(basisDigest, COMPRESSION_NONE).ToBytes(),
+			copyOp(0, uint64(len(oldContent)+1)),
+			endOp(),
+		}, nil)
+
+		err = Patch(strings.NewReader(oldContent), bytes.NewReader(delta), &bytes.Buffer{}, PatchOptions{})
+		assert.ErrorIs(t, err, ErrRangeOutsideBasis)
+	})
+
+	t.Run("should refuse literal above configured maximum", func(t *testing.T) {
+		delta := createDelta(t)
+
+		err := Patch(strings.NewReader(oldContent), bytes.NewReader(delta), &bytes.Buffer{}, PatchOptions{MaxLiteralLength: 2})
+		assert.ErrorIs(t, err, ErrLiteralTooLong)
+	})
+
+	t.Run("should return error on unknown opcode", func(t *testing.T) {
+		delta := createDelta(t)
+		delta[DELTA_HEADER_SIZE] = 0x7f
+
+		err := Patch(strings.NewReader(oldContent), bytes.NewReader(delta), &bytes.Buffer{}, PatchOptions{})
+		assert.ErrorIs(t, err, ErrUnknownOpcode)
+	})
+}
+
+func TestVerify(t *testing.T) {
+	basis := "0123456789"
+	newContent := "ab0123456789cd"
+	basisDigest, err := calculateFileDigest(strings.NewReader(basis))
+	assert.NoError(t, err)
+	targetDigest, err := calculateFileDigest(strings.NewReader(newContent))
+	assert.NoError(t, err)
+	delta := bytes.Join([][]byte{
+		NewDeltaHeader(basisDigest, COMPRESSION_NONE).ToBytes(),
+		literalOp(2, "ab"),
+		copyOp(0, 10),
+		literalOp(2, "cd"),
+		deltaTrailerToBytes(targetDigest),
+	}, nil)
+
+	tcs := []struct {
+		name     string
+		target   string
+		expected string
+	}{
+		{name: "should accept identical target", target: newContent},
+		{
+			name:     "should report copy writing first difference",
+			target:   "ab01X3456789cd",
+			expected: "patched file differs from target file at offset 4, written by operation 1: COPY of 10 bytes from 0",
+		},
+		{
+			name:     "should report literal writing first difference",
+			target:   "ab0123456789cD",
+			expected: "patched file differs from target file at offset 13, written by operation 2: LITERAL of 2 bytes",
+		},
+		{
+			name:     "should report shorter target",
+			target:   "ab0123",
+			expected: "patched file differs from target file at offset 6, written by operation 1: COPY of 10 bytes from 0",
+		},
+		{
+			name:     "should report longer target",
+			target:   newContent + "ef",
+			expected: "patched file differs from target file at offset 14: target file is longer",
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Verify(strings.NewReader(basis), bytes.NewReader(delta), strings.NewReader(tc.target), PatchOptions{})
+			if tc.expected == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrTargetDiffers)
+			assert.EqualError(t, err, tc.expected)
+		})
+	}
+
+	t.Run("should check digest recorded in delta without target", func(t *testing.T) {
+		err := Verify(strings.NewReader(basis), bytes.NewReader(delta), nil, PatchOptions{})
+		assert.NoError(t, err)
+
+		corrupted := bytes.Replace(delta, []byte("cd"), []byte("cD"), 1)
+		err = Verify(strings.NewReader(basis), bytes.NewReader(corrupted), nil, PatchOptions{})
+		assert.ErrorIs(t, err, ErrTargetMismatch)
+	})
+
+	t.Run("should find difference far into long librsync delta", func(t *testing.T) {
+		old := make([]byte, 1<<20)
+		rand.New(rand.NewSource(1)).Read(old)
+		newFile := append([]byte{}, old...)
+		copy(newFile[700_000:], "changed")
+		target := append([]byte{}, newFile...)
+		target[900_000]++
+
+		signature := bytes.Buffer{}
+		err := Signature(bytes.NewReader(old), &signature, SignatureOptions{Format: FORMAT_LIBRSYNC, BlockLength: 64})
+		assert.NoError(t, err)
+		librsyncDelta := bytes.Buffer{}
+		err = Delta(&signature, bytes.NewReader(newFile), &librsyncDelta, DeltaOptions{Format: FORMAT_LIBRSYNC})
+		assert.NoError(t, err)
+
+		err = Verify(bytes.NewReader(old), bytes.NewReader(librsyncDelta.Bytes()), bytes.NewReader(target), PatchOptions{Format: FORMAT_LIBRSYNC})
+		assert.ErrorIs(t, err, ErrTargetDiffers)
+		assert.Contains(t, err.Error(), "at offset 900000, written by operation 2: COPY")
+	})
+}
+
+// rangeFetcher serves ranges of file, recording them.
+type rangeFetcher struct {
+	file   []byte
+	ranges [][2]uint64
+}
+
+func (f *rangeFetcher) fetch(_ context.Context, from, to uint64) (io.ReadCloser, error) {
+	f.ranges = append(f.ranges, [2]uint64{from, to})
+	return io.NopCloser(bytes.NewReader(f.file[from:to])), nil
+}
+
+func TestFetch(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	target := make([]byte, 100*1024+100)
+	random.Read(target)
+	changed := append([]byte("inserted"), target...)
+	changed[8+10*1024+5]++
+	repeated := make([]byte, 20*1024)
+	copy(repeated[10*1024:], target[:1024])
+
+	tcs := []struct {
+		name     string
+		target   []byte
+		local    []byte
+		opts     FetchOptions
+		expected [][2]uint64
+	}{
+		{name: "should fetch nothing of identical file", target: target, local: target},
+		{name: "should fetch whole file without local one", target: target, local: nil, expected: [][2]uint64{{0, uint64(len(target))}}},
+		{name: "should fetch changed block of shifted file", target: target, local: changed, expected: [][2]uint64{{10 * 1024, 11 * 1024}}},
+		{name: "should fetch last block", target: target, local: target[:100*1024], expected: [][2]uint64{{100 * 1024, uint64(len(target))}}},
+		{name: "should copy repeated blocks once found", target: repeated, local: make([]byte, 1024), expected: [][2]uint64{{10 * 1024, 11 * 1024}}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			signature := bytes.Buffer{}
+			assert.NoError(t, Signature(bytes.NewReader(tc.target), &signature, SignatureOptions{BlockLength: 1024}))
+			fetcher := &rangeFetcher{file: tc.target}
+			fetched := bytes.Buffer{}
+			err := Fetch(&signature, bytes.NewReader(tc.local), &fetched, fetcher.fetch, tc.opts)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(tc.target, fetched.Bytes()))
+			assert.Equal(t, tc.expected, fetcher.ranges)
+		})
+	}
+
+	t.Run("should fetch changed block with concurrent jobs", func(t *testing.T) {
+		long := make([]byte, 2*DELTA_SEGMENT_LENGTH+1234)
+		random.Read(long)
+		shifted := append([]byte("inserted"), long...)
+		shifted[8+DELTA_SEGMENT_LENGTH+5]++
+		signature := bytes.Buffer{}
+		assert.NoError(t, Signature(bytes.NewReader(long), &signature, SignatureOptions{BlockLength: 1024}))
+		fetcher := &rangeFetcher{file: long}
+		fetched := bytes.Buffer{}
+		err := Fetch(&signature, bytes.NewReader(shifted), &fetched, fetcher.fetch, FetchOptions{Jobs: 4})
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(long, fetched.Bytes()))
+		assert.Equal(t, [][2]uint64{{DELTA_SEGMENT_LENGTH, DELTA_SEGMENT_LENGTH + 1024}}, fetcher.ranges)
+	})
+
+	signature := bytes.Buffer{}
+	assert.NoError(t, Signature(bytes.NewReader(target), &signature, SignatureOptions{BlockLength: 1024}))
+
+	t.Run("should refuse fetched data of other file", func(t *testing.T) {
+		other := append([]byte{}, target...)
+		other[50*1024]++
+		fetcher := &rangeFetcher{file: other}
+		err := Fetch(bytes.NewReader(signature.Bytes()), bytes.NewReader(changed), io.Discard, fetcher.fetch, FetchOptions{})
+		assert.NoError(t, err)
+		err = Fetch(bytes.NewReader(signature.Bytes()), bytes.NewReader(nil), io.Discard, fetcher.fetch, FetchOptions{})
+		assert.ErrorIs(t, err, ErrTargetMismatch)
+	})
+
+	t.Run("should refuse truncated range", func(t *testing.T) {
+		fetcher := &rangeFetcher{file: target[:50*1024]}
+		err := Fetch(bytes.NewReader(signature.Bytes()), bytes.NewReader(nil), io.Discard, func(ctx context.Context, from, _ uint64) (io.ReadCloser, error) {
+			return fetcher.fetch(ctx, from, uint64(len(fetcher.file)))
+		}, FetchOptions{})
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+
+	t.Run("should return error of fetch", func(t *testing.T) {
+		fetchErr := errors.New("connection refused")
+		err := Fetch(bytes.NewReader(signature.Bytes()), bytes.NewReader(changed), io.Discard, func(context.Context, uint64, uint64) (io.ReadCloser, error) {
+			return nil, fetchErr
+		}, FetchOptions{})
+		assert.ErrorIs(t, err, fetchErr)
+	})
+}
+
+func TestCancellation(t *testing.T) {
+	basis := make([]byte, 1_000_000)
+	rand.New(rand.NewSource(1)).Read(basis)
+	newContent := bytes.Repeat(basis, 64)
+
+	signature := bytes.Buffer{}
+	err := Signature(bytes.NewReader(basis), &signature, SignatureOptions{BlockLength: 10_000})
+	assert.NoError(t, err)
+
+	t.Run("should stop reading new file when writing delta fails", func(t *testing.T) {
+		writeErr := errors.New("disk full")
+		newFile := &countingReader{r: bytes.NewReader(newContent)}
+
+		err := Delta(bytes.NewReader(signature.Bytes()), newFile, &failingWriter{writes: 2, err: writeErr}, DeltaOptions{})
+		assert.ErrorIs(t, err, writeErr)
+		assert.Less(t, newFile.n, len(newContent)/2)
+	})
+
+	t.Run("should stop patching when writing new file fails", func(t *testing.T) {
+		delta := bytes.Buffer{}
+		err := Delta(bytes.NewReader(signature.Bytes()), bytes.NewReader(newContent), &delta, DeltaOptions{})
+		assert.NoError(t, err)
+
+		writeErr := errors.New("disk full")
+		err = Patch(bytes.NewReader(basis), &delta, &failingWriter{writes: 1, err: writeErr}, PatchOptions{})
+		assert.ErrorIs(t, err, writeErr)
+	})
+
+	t.Run("should return context error once cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := DeltaContext(ctx, bytes.NewReader(signature.Bytes()), bytes.NewReader(newContent), io.Discard, DeltaOptions{})
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += n
+	return n, err
+}
+
+// failingWriter returns err from all writes following the given number of
+// successful ones.
+type failingWriter struct {
+	writes int
+	err    error
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.writes == 0 {
+		return 0, w.err
+	}
+	w.writes--
+	return len(p), nil
+}
+
+func TestDeltaCompression(t *testing.T) {
+	oldContent := strings.Repeat("Imagine you have two files, A and B. ", 1000)
+	newContent := oldContent + strings.Repeat("and you wish to update B to be the same as A. ", 1000)
+
+	signature := bytes.Buffer{}
+	err := Signature(strings.NewReader(oldContent), &signature, SignatureOptions{BlockLength: 100})
+	assert.NoError(t, err)
+
+	createDelta := func(t *testing.T, compression Compression) []byte {
+		delta := bytes.Buffer{}
+		err := Delta(bytes.NewReader(signature.Bytes()), strings.NewReader(newContent), &delta, DeltaOptions{Compression: compression})
+		assert.NoError(t, err)
+		return delta.Bytes()
+	}
+	uncompressed := createDelta(t, COMPRESSION_NONE)
+
+	for _, compression := range []Compression{COMPRESSION_GZIP, COMPRESSION_ZSTD} {
+		t.Run("should recreate new file from delta compressed with "+compression.String(), func(t *testing.T) {
+			delta := createDelta(t, compression)
+			assert.Less(t, len(delta), len(uncompressed)/10)
+
+			newFile := bytes.Buffer{}
+			err := Patch(strings.NewReader(oldContent), bytes.NewReader(delta), &newFile, PatchOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, newContent, newFile.String())
+		})
+
+		t.Run("should refuse truncated delta compressed with "+compression.String(), func(t *testing.T) {
+			delta := createDelta(t, compression)
+
+			err := Patch(strings.NewReader(oldContent), bytes.NewReader(delta[:len(delta)-10]), &bytes.Buffer{}, PatchOptions{})
+			assert.Error(t, err)
+		})
+	}
+
+	t.Run("should refuse compressing librsync delta", func(t *testing.T) {
+		err := Delta(&bytes.Buffer{}, strings.NewReader(newContent), &bytes.Buffer{}, DeltaOptions{Format: FORMAT_LIBRSYNC, Compression: COMPRESSION_ZSTD})
+		assert.ErrorIs(t, err, ErrUnsupportedCompression)
+	})
+}
+
+func TestCompactDelta(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	oldContent := make([]byte, 1<<20)
+	random.Read(oldContent)
+	newContent := append([]byte{}, oldContent...)
+	for i := 0; i < 1000; i++ {
+		newContent[random.Intn(len(newContent))]++
+	}
+
+	signature := bytes.Buffer{}
+	err := Signature(bytes.NewReader(oldContent), &signature, SignatureOptions{BlockLength: 16})
+	assert.NoError(t, err)
+	signatureFile, err := ReadSignatureFile(bytes.NewReader(signature.Bytes()))
+	assert.NoError(t, err)
+
+	fixedWidthDelta := func(t *testing.T) []byte {
+		header := NewDeltaHeader(signatureFile.Basis, COMPRESSION_NONE)
+		header.Version = DELTA_VERSION_FIXED_WIDTH
+		delta := bytes.NewBuffer(header.ToBytes())
+		digest := newDigestWriter()
+		err := sendDeltaChunks(
+			context.Background(),
+			bytes.NewReader(newContent),
+			delta,
+			int(signatureFile.Header.BlockLength),
+			1,
+			DEFAULT_DELTA_MEMORY_LIMIT,
+			signatureFile.Index,
+			CalculateChecksum,
+			signatureFile.Header.strongHash(),
+			DeltaChunk.ToBytes,
+			digest,
+		)
+		assert.NoError(t, err)
+		delta.Write(deltaTrailerToBytes(digest.Digest()))
+		return delta.Bytes()
+	}
+
+	t.Run("should write smaller delta than fixed width operations", func(t *testing.T) {
+		delta := bytes.Buffer{}
+		err := Delta(bytes.NewReader(signature.Bytes()), bytes.NewReader(newContent), &delta, DeltaOptions{})
+		assert.NoError(t, err)
+		assert.Less(t, delta.Len(), len(fixedWidthDelta(t))*3/4)
+
+		newFile := bytes.Buffer{}
+		err = Patch(bytes.NewReader(oldContent), &delta, &newFile, PatchOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, newContent, newFile.Bytes())
+	})
+
+	t.Run("should still apply delta with fixed width operations", func(t *testing.T) {
+		newFile := bytes.Buffer{}
+		err := Patch(bytes.NewReader(oldContent), bytes.NewReader(fixedWidthDelta(t)), &newFile, PatchOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, newContent, newFile.Bytes())
+	})
+}
+
+// BenchmarkSignature compares reading the basis sequentially with reading
+// it concurrently with several jobs.
+func BenchmarkSignature(b *testing.B) {
+	basis := make([]byte, 100_000_000)
+	rand.New(rand.NewSource(1)).Read(basis)
+
+	for _, jobs := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			b.SetBytes(int64(len(basis)))
+			for i := 0; i < b.N; i++ {
+				err := Signature(bytes.NewReader(basis), io.Discard, SignatureOptions{Jobs: jobs})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// The 100 MB e2e scenario benchmarks mirror: files of equal length with
+// randomly changed bytes and a window of E2E_WINDOW_SIZE bytes.
+const (
+	E2E_FILES_LENGTH = 100_000_000
+	E2E_WINDOW_SIZE  = 20_000
+	E2E_DIFFERENCES  = 10_000
+)
+
+// e2eFiles returns the old and new file of the 100 MB e2e scenario.
+func e2eFiles() ([]byte, []byte) {
+	rnd := rand.New(rand.NewSource(1))
+	oldContent := make([]byte, E2E_FILES_LENGTH)
+	rnd.Read(oldContent)
+	newContent := make([]byte, E2E_FILES_LENGTH)
+	copy(newContent, oldContent)
+	for i := 0; i < E2E_DIFFERENCES; i++ {
+		newContent[rnd.Intn(E2E_FILES_LENGTH)] = byte(rnd.Int())
+	}
+	return oldContent, newContent
+}
+
+// BenchmarkDelta runs delta on the 100 MB e2e scenario.
+func BenchmarkDelta(b *testing.B) {
+	oldContent, newContent := e2eFiles()
+	signature := bytes.Buffer{}
+	err := Signature(bytes.NewReader(oldContent), &signature, SignatureOptions{BlockLength: E2E_WINDOW_SIZE})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, jobs := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			b.SetBytes(E2E_FILES_LENGTH)
+			for i := 0; i < b.N; i++ {
+				err := Delta(bytes.NewReader(signature.Bytes()), bytes.NewReader(newContent), io.Discard, DeltaOptions{Jobs: jobs})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDeltaCompression reports the size of deltas relative to the new
+// file, which is a text or binary corpus whose first half is the basis file.
+func BenchmarkDeltaCompression(b *testing.B) {
+	corpora := map[string]func(b *testing.B) []byte{
+		"text":   textCorpus,
+		"binary": binaryCorpus,
+	}
+	for _, corpusName := range []string{"text", "binary"} {
+		newContent := corpora[corpusName](b)
+		basis := newContent[:len(newContent)/2]
+		signature := bytes.Buffer{}
+		err := Signature(bytes.NewReader(basis), &signature, SignatureOptions{BlockLength: AUTO_BLOCK_LENGTH})
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		for _, compression := range []Compression{COMPRESSION_NONE, COMPRESSION_GZIP, COMPRESSION_ZSTD} {
+			b.Run(corpusName+"/"+compression.String(), func(b *testing.B) {
+				b.SetBytes(int64(len(newContent)))
+				delta := bytes.Buffer{}
+				for i := 0; i < b.N; i++ {
+					delta.Reset()
+					err := Delta(bytes.NewReader(signature.Bytes()), bytes.NewReader(newContent), &delta, DeltaOptions{Compression: compression})
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(delta.Len())/float64(len(newContent)), "delta/new")
+			})
+		}
+	}
+}
+
+// textCorpus returns the Go sources of net/http from GOROOT.
+func textCorpus(b *testing.B) []byte {
+	files, err := filepath.Glob(filepath.Join(runtime.GOROOT(), "src", "net", "http", "*.go"))
+	if err != nil || len(files) == 0 {
+		b.Skip("Go sources not found")
+	}
+	corpus := []byte{}
+	for _, f := range files {
+		content, err := os.ReadFile(f)
+		if err != nil {
+			b.Fatal(err)
+		}
+		corpus = append(corpus, content...)
+	}
+	return corpus
+}
+
+// binaryCorpus returns the test binary.
+func binaryCorpus(b *testing.B) []byte {
+	executable, err := os.Executable()
+	if err != nil {
+		b.Fatal(err)
+	}
+	corpus, err := os.ReadFile(executable)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return corpus
+}
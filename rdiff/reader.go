@@ -0,0 +1,150 @@
+package rdiff
+
+import (
+	"errors"
+	"io"
+)
+
+// READ_AHEAD_LENGTH is the minimal number of bytes read from the underlying
+// reader at once, so rolling the window byte by byte does not read it byte
+// by byte.
+const READ_AHEAD_LENGTH = 1 << 20
+
+// bufferedReader keeps a window over a sequentially read input in a buffer
+// holding the window and bytes read ahead of it, so the input does not have
+// to be seekable. Bytes popped from the window stay in
+// the buffer until it runs out of read ahead bytes, when the window is moved
+// to the beginning of the buffer and the rest is refilled.
+type bufferedReader struct {
+	r            io.Reader
+	windowLength int
+	buffer       []byte
+	// start of the window in buffer
+	start int
+	// end of the bytes read into buffer
+	end    int
+	length int
+	offset int64
+	eof    bool
+	sink   io.Writer
+	// sinkErr is the error sink returned, returned by all following reads.
+	sinkErr error
+}
+
+var ErrEmptyBuffer = errors.New("empty buffer- cannot pop")
+
+func NewBufferedReader(windowLength int, reader io.Reader) bufferedReader {
+	readAhead := windowLength
+	if readAhead < READ_AHEAD_LENGTH {
+		readAhead = READ_AHEAD_LENGTH
+	}
+	br := bufferedReader{
+		r:            reader,
+		windowLength: windowLength,
+		buffer:       make([]byte, windowLength+readAhead),
+	}
+	return br
+}
+
+func (br *bufferedReader) ReadWindow() (int, error) {
+	start := br.start + br.length
+	if br.end-start < br.windowLength {
+		if err := br.fill(); err != nil {
+			return 0, err
+		}
+		start = br.start + br.length
+	}
+	readBytes := br.end - start
+	if readBytes > br.windowLength {
+		readBytes = br.windowLength
+	}
+	br.start = start
+	br.offset += int64(br.length)
+	br.length = readBytes
+	return readBytes, nil
+}
+
+func (br *bufferedReader) PopAndShift() (byte, error) {
+	if br.length == 0 {
+		return byte(0), ErrEmptyBuffer
+	}
+	if br.start+br.length == br.end {
+		if err := br.fill(); err != nil {
+			return byte(0), err
+		}
+	}
+	pop := br.buffer[br.start]
+	br.start++
+	br.offset++
+	if br.start+br.length > br.end {
+		br.length--
+	}
+	return pop, nil
+}
+
+// fill moves the window to the beginning of the buffer and reads as many
+// bytes after it as fit.
+func (br *bufferedReader) fill() error {
+	if br.sinkErr != nil {
+		return br.sinkErr
+	}
+	if br.eof {
+		return nil
+	}
+	copy(br.buffer, br.buffer[br.start:br.end])
+	br.end -= br.start
+	br.start = 0
+	for br.end < len(br.buffer) {
+		readBytes, err := br.r.Read(br.buffer[br.end:])
+		if br.sink != nil && readBytes > 0 {
+			if _, br.sinkErr = br.sink.Write(br.buffer[br.end : br.end+readBytes]); br.sinkErr != nil {
+				return br.sinkErr
+			}
+		}
+		br.end += readBytes
+		if errors.Is(err, io.EOF) {
+			br.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TeeTo makes the reader write every byte it reads to w, so w receives the
+// whole input exactly once and in order. Reads fail with the first error w
+// returns.
+func (br *bufferedReader) TeeTo(w io.Writer) {
+	br.sink = w
+}
+
+func (br *bufferedReader) Offset() int64 {
+	return br.offset
+}
+
+func (br *bufferedReader) Len() int {
+	return br.length
+}
+
+// isEOF tells whether the window reaches the end of the input.
+func (br *bufferedReader) isEOF() bool {
+	return br.eof && br.start+br.length == br.end
+}
+
+func (br *bufferedReader) GetHash(calculations func([]byte) []byte) []byte {
+	return calculations(br.Buf())
+}
+
+func (br *bufferedReader) Get(index int) byte {
+	return br.buffer[br.start+index]
+}
+
+func (br *bufferedReader) Buf() []byte {
+	return br.buffer[br.start : br.start+br.length]
+}
+
+func (br *bufferedReader) WindowLen() int {
+	return br.windowLength
+}
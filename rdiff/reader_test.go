@@ -1,7 +1,9 @@
-package main
+package rdiff
 
 import (
+	"bytes"
 	"crypto/rand"
+	"errors"
 	"strings"
 	"testing"
 
@@ -36,6 +38,17 @@ func TestReadWindow(t *testing.T) {
 		assert.False(t, anyReads > 0)
 		assert.True(t, br.isEOF())
 	})
+
+	t.Run("should return error of tee writer", func(t *testing.T) {
+		sinkErr := errors.New("sink failed")
+		br := NewBufferedReader(10, strings.NewReader("15 chars string"))
+		br.TeeTo(&failingWriter{err: sinkErr})
+
+		_, err := br.ReadWindow()
+		assert.ErrorIs(t, err, sinkErr)
+		_, err = br.ReadWindow()
+		assert.ErrorIs(t, err, sinkErr)
+	})
 }
 
 func TestBuf(t *testing.T) {
@@ -102,3 +115,23 @@ func TestPopAndShift(t *testing.T) {
 		assert.ErrorIs(t, err, ErrEmptyBuffer)
 	})
 }
+
+// BenchmarkPopAndShift rolls the window through the new file of the 100 MB
+// e2e scenario, like delta does where no block matches.
+func BenchmarkPopAndShift(b *testing.B) {
+	_, input := e2eFiles()
+
+	b.SetBytes(E2E_FILES_LENGTH)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		br := NewBufferedReader(E2E_WINDOW_SIZE, bytes.NewReader(input))
+		if _, err := br.ReadWindow(); err != nil {
+			b.Fatal(err)
+		}
+		for {
+			if _, err := br.PopAndShift(); err != nil {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package rdiff
+
+func CalculateChecksumWithoutPreviousCompounds(data []byte) (uint32, *uint32, *uint32) {
+	var a uint32
+	var b uint32
+	for index, singleByte := range data {
+		uintByte := uint32(singleByte)
+		a += uintByte
+		b += uint32(len(data)-index) * uint32(data[index])
+	}
+	return b<<16 | a, &a, &b
+}
+
+func CalculateChecksumUsingPreviousCompounds(
+	data []byte,
+	previous byte,
+	length int,
+	a, b uint32,
+) (uint32, *uint32, *uint32) {
+	prev := uint32(previous)
+	dataLen := len(data)
+
+	if len(data) < length {
+		A := a - prev
+		B := b - uint32(dataLen+1)*prev
+		return B<<16 | A, &A, &B
+	}
+
+	A := a - prev + uint32(data[dataLen-1])
+	B := b - uint32(dataLen)*prev + A
+
+	return B<<16 | A, &A, &B
+}
+
+func CalculateChecksum(data []byte, previous *byte, length int, a, b *uint32) (uint32, *uint32, *uint32) {
+	if a == nil && b == nil {
+		return CalculateChecksumWithoutPreviousCompounds(data)
+	}
+	return CalculateChecksumUsingPreviousCompounds(data, *previous, length, *a, *b)
+}
+
+// ROLLSUM_CHAR_OFFSET is added to every byte by librsync's rollsum.
+const ROLLSUM_CHAR_OFFSET = 31
+
+// CalculateRollsumWithoutPreviousCompounds calculates librsync's rollsum,
+// returning its s1 and s2 compounds.
+func CalculateRollsumWithoutPreviousCompounds(data []byte) (uint32, *uint32, *uint32) {
+	var s1 uint32
+	var s2 uint32
+	for _, singleByte := range data {
+		s1 += uint32(singleByte) + ROLLSUM_CHAR_OFFSET
+		s2 += s1
+	}
+	return s2<<16 | s1&0xffff, &s1, &s2
+}
+
+func CalculateRollsumUsingPreviousCompounds(
+	data []byte,
+	previous byte,
+	length int,
+	s1, s2 uint32,
+) (uint32, *uint32, *uint32) {
+	out := uint32(previous) + ROLLSUM_CHAR_OFFSET
+	dataLen := len(data)
+
+	if len(data) < length {
+		S1 := s1 - out
+		S2 := s2 - uint32(dataLen+1)*out
+		return S2<<16 | S1&0xffff, &S1, &S2
+	}
+
+	S1 := s1 + uint32(data[dataLen-1]) - uint32(previous)
+	S2 := s2 + S1 - uint32(dataLen)*out
+
+	return S2<<16 | S1&0xffff, &S1, &S2
+}
+
+func CalculateRollsum(data []byte, previous *byte, length int, s1, s2 *uint32) (uint32, *uint32, *uint32) {
+	if s1 == nil && s2 == nil {
+		return CalculateRollsumWithoutPreviousCompounds(data)
+	}
+	return CalculateRollsumUsingPreviousCompounds(data, *previous, length, *s1, *s2)
+}
+
+const (
+	RABINKARP_SEED uint32 = 1
+	RABINKARP_MULT uint32 = 0x08104225
+	// RABINKARP_INVM is the multiplicative inverse of RABINKARP_MULT modulo 2^32.
+	RABINKARP_INVM uint32 = 0x98f009ad
+	RABINKARP_ADJ  uint32 = RABINKARP_MULT - RABINKARP_SEED
+)
+
+// CalculateRabinKarpWithoutPreviousCompounds calculates librsync's
+// Rabin-Karp rolling hash, returning the hash and RABINKARP_MULT raised to
+// the length of data as its compounds.
+func CalculateRabinKarpWithoutPreviousCompounds(data []byte) (uint32, *uint32, *uint32) {
+	hash := RABINKARP_SEED
+	mult := uint32(1)
+	for _, singleByte := range data {
+		hash = hash*RABINKARP_MULT + uint32(singleByte)
+		mult *= RABINKARP_MULT
+	}
+	return hash, &hash, &mult
+}
+
+func CalculateRabinKarpUsingPreviousCompounds(
+	data []byte,
+	previous byte,
+	length int,
+	hash, mult uint32,
+) (uint32, *uint32, *uint32) {
+	out := uint32(previous) + RABINKARP_ADJ
+
+	if len(data) < length {
+		M := mult * RABINKARP_INVM
+		H := hash - M*out
+		return H, &H, &M
+	}
+
+	H := hash*RABINKARP_MULT + uint32(data[len(data)-1]) - mult*out
+	return H, &H, &mult
+}
+
+func CalculateRabinKarp(data []byte, previous *byte, length int, hash, mult *uint32) (uint32, *uint32, *uint32) {
+	if hash == nil && mult == nil {
+		return CalculateRabinKarpWithoutPreviousCompounds(data)
+	}
+	return CalculateRabinKarpUsingPreviousCompounds(data, *previous, length, *hash, *mult)
+}
@@ -0,0 +1,85 @@
+package rdiff
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalculateChecksumWithoutPreviousCompounds(t *testing.T) {
+	t.Run("should properly calculate checksums", func(t *testing.T) {
+		testData := map[string]uint32{
+			"abc": uint32(586<<16 | 294),
+			"def": uint32(604<<16 | 303),
+			"ghi": uint32(622<<16 | 312),
+			"jk":  uint32(319<<16 | 213),
+		}
+		for str, checksum := range testData {
+			actualChecksum, _, _ := CalculateChecksumWithoutPreviousCompounds([]byte(str))
+			assert.Equal(t, checksum, actualChecksum)
+		}
+	})
+}
+
+func TestCalculateChecksumUsingPreviousCompounds(t *testing.T) {
+	t.Run("should properly calculate checksums when input converges to zero", func(t *testing.T) {
+		input := "some random input"
+		windowLength := len(input)
+		_, a, b := CalculateChecksumWithoutPreviousCompounds([]byte(input))
+		for i := 1; i < windowLength; i++ {
+			var checksum uint32
+			currInput := []byte(input[i:])
+			checksum, a, b = CalculateChecksumUsingPreviousCompounds(currInput, input[i-1], windowLength, *a, *b)
+			refChecksum, _, _ := CalculateChecksumWithoutPreviousCompounds(currInput)
+			assert.Equal(t, refChecksum, checksum)
+		}
+	})
+}
+
+func TestCalculateRollsum(t *testing.T) {
+	t.Run("should calculate librsync rollsum", func(t *testing.T) {
+		checksum, _, _ := CalculateRollsumWithoutPreviousCompounds([]byte("abc"))
+		assert.Equal(t, uint32(772<<16|387), checksum)
+	})
+
+	t.Run("should roll through input and shrink window at its end", func(t *testing.T) {
+		input := "some random input that is rolled"
+		windowLength := 8
+		_, s1, s2 := CalculateRollsumWithoutPreviousCompounds([]byte(input[:windowLength]))
+		for i := 1; i < len(input); i++ {
+			var checksum uint32
+			end := i + windowLength
+			if end > len(input) {
+				end = len(input)
+			}
+			currInput := []byte(input[i:end])
+			checksum, s1, s2 = CalculateRollsum(currInput, &[]byte(input)[i-1], windowLength, s1, s2)
+			refChecksum, _, _ := CalculateRollsumWithoutPreviousCompounds(currInput)
+			assert.Equal(t, refChecksum, checksum)
+		}
+	})
+}
+
+func TestCalculateRabinKarp(t *testing.T) {
+	t.Run("should use inverse of multiplier", func(t *testing.T) {
+		mult, invm := RABINKARP_MULT, RABINKARP_INVM
+		assert.Equal(t, uint32(1), mult*invm)
+	})
+
+	t.Run("should roll through input and shrink window at its end", func(t *testing.T) {
+		input := "some random input that is rolled"
+		windowLength := 8
+		_, hash, mult := CalculateRabinKarpWithoutPreviousCompounds([]byte(input[:windowLength]))
+		for i := 1; i < len(input); i++ {
+			var checksum uint32
+			end := i + windowLength
+			if end > len(input) {
+				end = len(input)
+			}
+			currInput := []byte(input[i:end])
+			checksum, hash, mult = CalculateRabinKarp(currInput, &[]byte(input)[i-1], windowLength, hash, mult)
+			refChecksum, _, _ := CalculateRabinKarpWithoutPreviousCompounds(currInput)
+			assert.Equal(t, refChecksum, checksum)
+		}
+	})
+}
@@ -0,0 +1,175 @@
+package rdiff
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// SIGNATURE_SEGMENT_LENGTH is roughly how much of the basis a single job of
+// CalculateAndSendChecksumsConcurrently reads and hashes at once.
+const SIGNATURE_SEGMENT_LENGTH = 1 << 20
+
+func CalculateAndSendChecksums(
+	ctx context.Context,
+	bufferedReader bufferedReader,
+	checksumsChan chan []byte,
+	checksumCalculation func([]byte) (uint32, *uint32, *uint32),
+	strongHash func([]byte) []byte,
+) error {
+	defer close(checksumsChan)
+
+	for {
+		readBytes, err := bufferedReader.ReadWindow()
+		if err != nil {
+			return err
+		}
+		if readBytes == 0 {
+			return nil
+		}
+
+		checksum, _, _ := checksumCalculation(bufferedReader.Buf())
+		err = sendChunk(ctx, checksumsChan, getBundle(checksum, bufferedReader.GetHash(strongHash)))
+		if err != nil {
+			return err
+		}
+
+		if bufferedReader.isEOF() {
+			return nil
+		}
+	}
+}
+
+// segmentChecksums are the bundles of a segment of the basis together with
+// its data.
+type segmentChecksums struct {
+	index   int
+	data    []byte
+	bundles []byte
+	eof     bool
+	err     error
+}
+
+// CalculateAndSendChecksumsConcurrently is like CalculateAndSendChecksums
+// but reads and hashes segments of basis with jobs goroutines, sending the
+// bundles of every segment in order as a single chunk. Every byte of basis
+// is passed to sink in order.
+func CalculateAndSendChecksumsConcurrently(
+	ctx context.Context,
+	basis io.ReaderAt,
+	blockLength int,
+	jobs int,
+	checksumsChan chan []byte,
+	checksumCalculation func([]byte) (uint32, *uint32, *uint32),
+	strongHash func([]byte) []byte,
+	sink io.Writer,
+) error {
+	defer close(checksumsChan)
+	ctx, cancel := context.WithCancel(ctx)
+
+	segmentLength := blockLength
+	if blockLength < SIGNATURE_SEGMENT_LENGTH {
+		segmentLength = SIGNATURE_SEGMENT_LENGTH / blockLength * blockLength
+	}
+	// Segments waiting to be sent are bounded by tokens, so results never
+	// blocks and memory stays at a few segments per job.
+	tokens := make(chan struct{}, 2*jobs)
+	indexes := make(chan int)
+	results := make(chan segmentChecksums, cap(tokens))
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(indexes)
+		for i := 0; ; i++ {
+			select {
+			case tokens <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case indexes <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for j := 0; j < jobs; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				results <- calculateSegmentChecksums(basis, index, segmentLength, blockLength, checksumCalculation, strongHash)
+			}
+		}()
+	}
+
+	pending := map[int]segmentChecksums{}
+	for next := 0; ; {
+		select {
+		case result := <-results:
+			pending[result.index] = result
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		for result, ok := pending[next]; ok; result, ok = pending[next] {
+			delete(pending, next)
+			if result.err != nil {
+				return result.err
+			}
+			if len(result.data) > 0 {
+				_, err := sink.Write(result.data)
+				if err != nil {
+					return err
+				}
+				err = sendChunk(ctx, checksumsChan, result.bundles)
+				if err != nil {
+					return err
+				}
+			}
+			if result.eof {
+				return nil
+			}
+			next++
+			<-tokens
+		}
+	}
+}
+
+func calculateSegmentChecksums(
+	basis io.ReaderAt,
+	index int,
+	segmentLength int,
+	blockLength int,
+	checksumCalculation func([]byte) (uint32, *uint32, *uint32),
+	strongHash func([]byte) []byte,
+) segmentChecksums {
+	data := make([]byte, segmentLength)
+	n, err := basis.ReadAt(data, int64(index)*int64(segmentLength))
+	result := segmentChecksums{index: index, data: data[:n], eof: n < segmentLength}
+	if err != nil && !errors.Is(err, io.EOF) {
+		result.err = err
+		return result
+	}
+
+	for start := 0; start < n; start += blockLength {
+		end := start + blockLength
+		if end > n {
+			end = n
+		}
+		checksum, _, _ := checksumCalculation(data[start:end])
+		result.bundles = append(result.bundles, getBundle(checksum, strongHash(data[start:end]))...)
+	}
+	return result
+}
+
+func getBundle(rollingChecksum uint32, hash []byte) []byte {
+	checksum := make([]byte, 4)
+	binary.BigEndian.PutUint32(checksum, rollingChecksum)
+	return append(checksum, hash...)
+}
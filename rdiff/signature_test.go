@@ -0,0 +1,132 @@
+package rdiff
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalculateAndSendChecksums(t *testing.T) {
+	t.Run("should calculate proper amount of checksums for various inputs", func(t *testing.T) {
+		tcs := []struct {
+			input        string
+			windowLength int
+		}{
+			{
+				input:        "abcdefghijk",
+				windowLength: 3,
+			},
+			{
+				input:        "abcdefghi",
+				windowLength: 3,
+			},
+		}
+		for _, tc := range tcs {
+			br := NewBufferedReader(tc.windowLength, strings.NewReader(tc.input))
+			checksumsChan := make(chan []byte, 3)
+			go func() {
+				err := CalculateAndSendChecksums(
+					context.Background(),
+					br,
+					checksumsChan,
+					func(b []byte) (uint32, *uint32, *uint32) {
+						s := uint32(0)
+						return uint32(0), &s, &s
+					},
+					calculateMD4,
+				)
+				assert.NoError(t, err)
+			}()
+
+			var checksums [][]byte
+			for c := range checksumsChan {
+				checksums = append(checksums, c)
+			}
+			div := float64(len(tc.input)) / float64(tc.windowLength)
+			assert.Len(t, checksums, int(math.Ceil(div)))
+			for _, c := range checksums {
+				assert.Len(t, c, 20)
+			}
+		}
+	})
+}
+
+func TestCalculateAndSendChecksumsConcurrently(t *testing.T) {
+	content := make([]byte, 3*SIGNATURE_SEGMENT_LENGTH+1234)
+	rand.New(rand.NewSource(1)).Read(content)
+	checksumCalculation := CalculateChecksumWithoutPreviousCompounds
+
+	readChecksums := func(calculate func(c chan []byte) error) ([]byte, error) {
+		c := make(chan []byte)
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- calculate(c)
+		}()
+		var checksums []byte
+		for chunk := range c {
+			checksums = append(checksums, chunk...)
+		}
+		return checksums, <-errChan
+	}
+
+	tcs := []struct {
+		name        string
+		length      int
+		blockLength int
+		jobs        int
+	}{
+		{name: "should send nothing for empty basis", length: 0, blockLength: 700, jobs: 4},
+		{name: "should send single short block", length: 10, blockLength: 700, jobs: 4},
+		{name: "should send whole segments", length: 2 * SIGNATURE_SEGMENT_LENGTH / 700 * 700, blockLength: 700, jobs: 4},
+		{name: "should send segments in order", length: len(content), blockLength: 700, jobs: 8},
+		{name: "should send blocks longer than segment", length: len(content), blockLength: SIGNATURE_SEGMENT_LENGTH + 1, jobs: 2},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			basis := content[:tc.length]
+			expected, err := readChecksums(func(c chan []byte) error {
+				br := NewBufferedReader(tc.blockLength, bytes.NewReader(basis))
+				return CalculateAndSendChecksums(context.Background(), br, c, checksumCalculation, calculateMD4)
+			})
+			assert.NoError(t, err)
+
+			sink := bytes.Buffer{}
+			checksums, err := readChecksums(func(c chan []byte) error {
+				return CalculateAndSendChecksumsConcurrently(context.Background(), bytes.NewReader(basis), tc.blockLength, tc.jobs, c, checksumCalculation, calculateMD4, &sink)
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, expected, checksums)
+			assert.Equal(t, string(basis), sink.String())
+		})
+	}
+
+	t.Run("should return read error", func(t *testing.T) {
+		readErr := errors.New("bad sector")
+		basis := failingReaderAt{r: bytes.NewReader(content), offset: 2 * SIGNATURE_SEGMENT_LENGTH, err: readErr}
+
+		_, err := readChecksums(func(c chan []byte) error {
+			return CalculateAndSendChecksumsConcurrently(context.Background(), basis, 700, 4, c, checksumCalculation, calculateMD4, io.Discard)
+		})
+		assert.ErrorIs(t, err, readErr)
+	})
+}
+
+type failingReaderAt struct {
+	r      io.ReaderAt
+	offset int64
+	err    error
+}
+
+func (r failingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > r.offset {
+		return 0, r.err
+	}
+	return r.r.ReadAt(p, off)
+}
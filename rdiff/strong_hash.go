@@ -0,0 +1,126 @@
+package rdiff
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/zeebo/blake3"
+	"github.com/zeebo/xxh3"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/md4"
+)
+
+type StrongHashType uint8
+
+const (
+	STRONG_HASH_MD4     StrongHashType = 1
+	STRONG_HASH_BLAKE2B StrongHashType = 2
+	STRONG_HASH_BLAKE3  StrongHashType = 3
+	STRONG_HASH_SHA256  StrongHashType = 4
+	STRONG_HASH_XXH3    StrongHashType = 5
+)
+
+// DEFAULT_STRONG_HASH is used for signatures that do not select one.
+const DEFAULT_STRONG_HASH = STRONG_HASH_BLAKE2B
+
+// StrongHash confirms blocks whose rolling checksums match.
+type StrongHash interface {
+	Type() StrongHashType
+	Name() string
+	// Size returns the length of untruncated sums.
+	Size() int
+	Sum(data []byte) []byte
+}
+
+type strongHash struct {
+	t    StrongHashType
+	name string
+	size int
+	sum  func([]byte) []byte
+}
+
+func (h strongHash) Type() StrongHashType {
+	return h.t
+}
+
+func (h strongHash) Name() string {
+	return h.name
+}
+
+func (h strongHash) Size() int {
+	return h.size
+}
+
+func (h strongHash) Sum(data []byte) []byte {
+	return h.sum(data)
+}
+
+var strongHashes = []StrongHash{
+	strongHash{t: STRONG_HASH_MD4, name: "md4", size: md4.Size, sum: calculateMD4},
+	strongHash{t: STRONG_HASH_BLAKE2B, name: "blake2b", size: blake2b.Size256, sum: calculateBLAKE2b256},
+	strongHash{t: STRONG_HASH_BLAKE3, name: "blake3", size: 32, sum: calculateBLAKE3},
+	strongHash{t: STRONG_HASH_SHA256, name: "sha256", size: sha256.Size, sum: calculateSHA256},
+	strongHash{t: STRONG_HASH_XXH3, name: "xxh3", size: 16, sum: calculateXXH3},
+}
+
+func StrongHashByType(t StrongHashType) (StrongHash, error) {
+	for _, h := range strongHashes {
+		if h.Type() == t {
+			return h, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %d", ErrUnsupportedStrongHash, t)
+}
+
+func ParseStrongHash(name string) (StrongHashType, error) {
+	for _, h := range strongHashes {
+		if h.Name() == name {
+			return h.Type(), nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %s", ErrUnsupportedStrongHash, name)
+}
+
+func StrongHashNames() []string {
+	names := make([]string, len(strongHashes))
+	for i, h := range strongHashes {
+		names[i] = h.Name()
+	}
+	return names
+}
+
+// truncatedHash returns sums of h limited to their first length bytes.
+func truncatedHash(h StrongHash, length int) func([]byte) []byte {
+	if length == h.Size() {
+		return h.Sum
+	}
+	return func(data []byte) []byte {
+		return h.Sum(data)[:length]
+	}
+}
+
+func calculateMD4(data []byte) []byte {
+	h := md4.New()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func calculateBLAKE2b256(data []byte) []byte {
+	h := blake2b.Sum256(data)
+	return h[:]
+}
+
+func calculateBLAKE3(data []byte) []byte {
+	h := blake3.Sum256(data)
+	return h[:]
+}
+
+func calculateSHA256(data []byte) []byte {
+	h := sha256.Sum256(data)
+	return h[:]
+}
+
+func calculateXXH3(data []byte) []byte {
+	h := xxh3.Hash128(data).Bytes()
+	return h[:]
+}
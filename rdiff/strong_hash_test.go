@@ -0,0 +1,61 @@
+package rdiff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStrongHashes(t *testing.T) {
+	oldContent := strings.Repeat("Imagine you have two files, A and B, and you wish to update B. ", 50)
+	newContent := strings.Replace(oldContent, "files", "FILES", 7)
+
+	for _, name := range StrongHashNames() {
+		for _, strongHashLength := range []int{0, 6} {
+			t.Run(fmt.Sprintf("should recreate file using %s truncated to %d bytes", name, strongHashLength), func(t *testing.T) {
+				strongHashType, err := ParseStrongHash(name)
+				assert.NoError(t, err)
+				strongHash, err := StrongHashByType(strongHashType)
+				assert.NoError(t, err)
+				assert.Len(t, strongHash.Sum([]byte(oldContent)), strongHash.Size())
+
+				signature := bytes.Buffer{}
+				err = Signature(strings.NewReader(oldContent), &signature, SignatureOptions{
+					BlockLength:      64,
+					StrongHash:       strongHashType,
+					StrongHashLength: strongHashLength,
+				})
+				assert.NoError(t, err)
+
+				header, err := ReadSignatureHeader(bytes.NewReader(signature.Bytes()))
+				assert.NoError(t, err)
+				assert.Equal(t, strongHashType, header.StrongHash)
+				if strongHashLength == 0 {
+					strongHashLength = strongHash.Size()
+				}
+				assert.Equal(t, uint8(strongHashLength), header.StrongHashLength)
+
+				delta := bytes.Buffer{}
+				err = Delta(&signature, strings.NewReader(newContent), &delta, DeltaOptions{})
+				assert.NoError(t, err)
+				assert.Less(t, delta.Len(), len(newContent)/2)
+
+				newFile := bytes.Buffer{}
+				err = Patch(strings.NewReader(oldContent), &delta, &newFile, PatchOptions{})
+				assert.NoError(t, err)
+				assert.Equal(t, newContent, newFile.String())
+			})
+		}
+	}
+
+	t.Run("should refuse unknown strong hash", func(t *testing.T) {
+		_, err := ParseStrongHash("crc32")
+		assert.ErrorIs(t, err, ErrUnsupportedStrongHash)
+
+		err = Signature(strings.NewReader(oldContent), &bytes.Buffer{}, SignatureOptions{StrongHash: 99})
+		assert.ErrorIs(t, err, ErrUnsupportedStrongHash)
+	})
+}
@@ -0,0 +1,28 @@
+#!/bin/sh
+# Regenerates the librsync fixtures with the rdiff command of librsync 2.3.4,
+# which has to be on PATH, and records its version in VERSION.
+set -eu
+cd "$(dirname "$0")"
+
+LIBRSYNC_VERSION=2.3.4
+
+version=$(rdiff --version | head -n 1)
+case "$version" in
+*"librsync $LIBRSYNC_VERSION"*) ;;
+*)
+	echo "fixtures are generated with librsync $LIBRSYNC_VERSION, not: $version" >&2
+	exit 1
+	;;
+esac
+
+rdiff -f -b 256 -S 16 -H md4 -R rollsum signature basis.txt basis.md4.sig
+rdiff -f -b 256 -S 8 -H md4 -R rollsum signature basis.txt basis.md4-8.sig
+rdiff -f -b 256 -S 32 -H blake2 -R rollsum signature basis.txt basis.blake2.sig
+rdiff -f -b 256 -S 16 -H md4 -R rabinkarp signature basis.txt basis.rk-md4.sig
+rdiff -f -b 256 -S 32 -H blake2 -R rabinkarp signature basis.txt basis.rk-blake2.sig
+rdiff -f delta basis.rk-blake2.sig new.txt new.rdiff.delta
+rdiff -f patch basis.txt new.rdiff.delta new.rdiff.txt
+cmp new.txt new.rdiff.txt
+rm new.rdiff.txt
+
+echo "$version" >VERSION
@@ -0,0 +1,888 @@
+package rdiff
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+const (
+	TREE_SIGNATURE_MAGIC uint32 = 0x72647473 // "rdts"
+	TREE_DELTA_MAGIC     uint32 = 0x72647464 // "rdtd"
+	TREE_VERSION         uint16 = 1
+	TREE_HEADER_SIZE            = 4 + 2
+	// MAX_TREE_PATH_LENGTH bounds the paths of files in tree signatures and
+	// deltas.
+	MAX_TREE_PATH_LENGTH = 4096
+	// TREE_CHUNK_LENGTH is the length of the chunks embedded signatures and
+	// deltas are written in.
+	TREE_CHUNK_LENGTH = 64 << 10
+)
+
+// Kinds of tree signature entries, written after their path.
+const (
+	// TREE_ENTRY_FILE is followed by the embedded signature of a regular
+	// file.
+	TREE_ENTRY_FILE byte = iota
+	// TREE_ENTRY_DIRECTORY marks a directory.
+	TREE_ENTRY_DIRECTORY
+)
+
+// Operations of tree deltas. Every file of the new tree has one of
+// TREE_OP_UNCHANGED, TREE_OP_RENAMED, TREE_OP_ADDED or TREE_OP_CHANGED,
+// every directory TREE_OP_DIRECTORY, and every file or directory of the
+// basis tree missing from it TREE_OP_DELETED.
+const (
+	TREE_OP_END byte = iota
+	// TREE_OP_UNCHANGED is followed by the path, mode and digest of a file
+	// found at the same path in the basis tree.
+	TREE_OP_UNCHANGED
+	// TREE_OP_RENAMED is followed by the path, mode, basis path and digest
+	// of a file found at another path in the basis tree, which it was
+	// renamed or copied from.
+	TREE_OP_RENAMED
+	// TREE_OP_ADDED is followed by the path and mode of a file missing from
+	// the basis tree and the delta of the file against an empty one.
+	TREE_OP_ADDED
+	// TREE_OP_CHANGED is followed by the path and mode of a file and its
+	// delta against the file at the same path in the basis tree.
+	TREE_OP_CHANGED
+	// TREE_OP_DELETED is followed by the path of a file or directory of the
+	// basis tree missing from the new tree.
+	TREE_OP_DELETED
+	// TREE_OP_DIRECTORY is followed by the path and mode of a directory of
+	// the new tree, so empty ones are recreated too.
+	TREE_OP_DIRECTORY
+)
+
+var ErrInvalidPath = errors.New("invalid path in tree")
+
+// TreeSignature writes the path and signature of every regular file and the
+// path of every directory under basis to signature, in lexical order. Other
+// files than regular ones and directories, such as symbolic links, are left
+// out and passed to opts.Skipped. Trees are only written in the plain
+// format.
+func TreeSignature(basis fs.FS, signature io.Writer, opts SignatureOptions) error {
+	return TreeSignatureContext(context.Background(), basis, signature, opts)
+}
+
+// TreeSignatureContext is like TreeSignature but stops once ctx is done,
+// returning its error.
+func TreeSignatureContext(ctx context.Context, basis fs.FS, signature io.Writer, opts SignatureOptions) error {
+	if opts.Format != FORMAT_PLAIN {
+		return fmt.Errorf("%w: trees are only written in the plain format", ErrUnsupportedFormat)
+	}
+	_, err := signature.Write(treeHeaderToBytes(TREE_SIGNATURE_MAGIC))
+	if err != nil {
+		return err
+	}
+	err = walkTree(basis, opts.Skipped, func(name string, info fs.FileInfo) error {
+		if info.IsDir() {
+			_, err := signature.Write(append(appendString(nil, name), TREE_ENTRY_DIRECTORY))
+			return err
+		}
+		file, err := openReaderAt(basis, name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = signature.Write(append(appendString(nil, name), TREE_ENTRY_FILE))
+		if err != nil {
+			return err
+		}
+		chunks := newChunkWriter(signature)
+		err = plainSignature(ctx, file, chunks, opts)
+		if err != nil {
+			return err
+		}
+		return chunks.Close()
+	})
+	if err != nil {
+		return err
+	}
+	// Paths are never empty, so an empty one ends the signature.
+	_, err = signature.Write(appendString(nil, ""))
+	return err
+}
+
+// TreeDelta compares every regular file under newTree with the files of the
+// tree signature, writing a tree delta that records files found unchanged
+// at the same path or renamed from another path, by their content, added
+// and changed files with their deltas, the directories of newTree and
+// deleted files and directories. Other files than regular ones and
+// directories are left out and passed to opts.Skipped. The signature is read
+// as newTree is walked, so only the embedded signature of the file being
+// compared is held in memory. Files at paths missing from the basis tree
+// come last, once the digests of all basis files are known to find renamed
+// ones. Files are read once, but for added ones as long as a basis file.
+func TreeDelta(signature io.Reader, newTree fs.FS, delta io.Writer, opts DeltaOptions) error {
+	return TreeDeltaContext(context.Background(), signature, newTree, delta, opts)
+}
+
+// TreeDeltaContext is like TreeDelta but stops once ctx is done, returning
+// its error.
+func TreeDeltaContext(ctx context.Context, signature io.Reader, newTree fs.FS, delta io.Writer, opts DeltaOptions) error {
+	if opts.Format != FORMAT_PLAIN {
+		return fmt.Errorf("%w: trees are only written in the plain format", ErrUnsupportedFormat)
+	}
+	basis, err := newTreeSignatureReader(signature)
+	if err != nil {
+		return err
+	}
+	// Renamed files are taken from the first basis file of the signature.
+	namesByDigest := map[string]string{}
+	basisLengths := map[uint64]bool{}
+	keepDigest := func(name string, digest FileDigest) {
+		basisLengths[digest.Length] = true
+		if _, ok := namesByDigest[string(digest.ToBytes())]; !ok {
+			namesByDigest[string(digest.ToBytes())] = name
+		}
+	}
+	// skipBasis reads past the basis entry, which the new tree replaces or
+	// misses.
+	skipBasis := func() error {
+		name, directory := basis.name, basis.directory
+		digest, _, err := basis.skip()
+		if err == nil && !directory {
+			keepDigest(name, digest)
+		}
+		return err
+	}
+
+	_, err = delta.Write(treeHeaderToBytes(TREE_DELTA_MAGIC))
+	if err != nil {
+		return err
+	}
+	var added []treeNewFile
+	err = walkTree(newTree, opts.Skipped, func(name string, info fs.FileInfo) error {
+		for !basis.done && compareTreePaths(basis.name, name) < 0 {
+			_, err := delta.Write(appendString([]byte{TREE_OP_DELETED}, basis.name))
+			if err != nil {
+				return err
+			}
+			if err = skipBasis(); err != nil {
+				return err
+			}
+		}
+		found := !basis.done && basis.name == name
+		if info.IsDir() {
+			if found {
+				if err := skipBasis(); err != nil {
+					return err
+				}
+			}
+			_, err := delta.Write(treeEntryToBytes(TREE_OP_DIRECTORY, name, info.Mode(), "", nil))
+			return err
+		}
+		if !found || basis.directory {
+			if found {
+				if err := skipBasis(); err != nil {
+					return err
+				}
+			}
+			added = append(added, treeNewFile{name: name, mode: info.Mode(), length: uint64(info.Size())})
+			return nil
+		}
+		basisSignature, basisDigest, err := basis.read()
+		if err != nil {
+			return err
+		}
+		keepDigest(name, basisDigest)
+		// The file is read once, its digest telling whether it changed once
+		// its delta is calculated.
+		pending := &pendingDelta{w: delta, entry: treeEntryToBytes(TREE_OP_CHANGED, name, info.Mode(), "", nil)}
+		digest, err := writeTreeFileDelta(ctx, bytes.NewReader(basisSignature), newTree, name, pending, opts)
+		if err != nil {
+			return err
+		}
+		if !pending.started && digest.Equal(basisDigest) {
+			_, err = delta.Write(treeEntryToBytes(TREE_OP_UNCHANGED, name, info.Mode(), "", &digest))
+			return err
+		}
+		return pending.flush()
+	})
+	if err != nil {
+		return err
+	}
+	for !basis.done {
+		_, err := delta.Write(appendString([]byte{TREE_OP_DELETED}, basis.name))
+		if err != nil {
+			return err
+		}
+		if err = skipBasis(); err != nil {
+			return err
+		}
+	}
+	if err = basis.end(); err != nil {
+		return err
+	}
+
+	emptySignature := bytes.Buffer{}
+	err = plainSignature(ctx, bytes.NewReader(nil), &emptySignature, SignatureOptions{Jobs: 1})
+	if err != nil {
+		return err
+	}
+	for _, file := range added {
+		// Only files as long as a basis file can be renamed, their digest
+		// is calculated first, reading them a second time if added.
+		if basisLengths[file.length] {
+			digest, err := treeFileDigest(newTree, file.name)
+			if err != nil {
+				return err
+			}
+			if renamedFrom, renamed := namesByDigest[string(digest.ToBytes())]; renamed {
+				_, err = delta.Write(treeEntryToBytes(TREE_OP_RENAMED, file.name, file.mode, renamedFrom, &digest))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		_, err = delta.Write(treeEntryToBytes(TREE_OP_ADDED, file.name, file.mode, "", nil))
+		if err != nil {
+			return err
+		}
+		_, err = writeTreeFileDelta(ctx, bytes.NewReader(emptySignature.Bytes()), newTree, file.name, delta, opts)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = delta.Write([]byte{TREE_OP_END})
+	return err
+}
+
+// treeNewFile is a file of the new tree at a path missing from the basis
+// tree.
+type treeNewFile struct {
+	name   string
+	mode   fs.FileMode
+	length uint64
+}
+
+// TreePatch applies a tree delta on top of basis, passing every file of the
+// new tree to create with its path, mode and a function writing its
+// content, which create has to call. Directories are passed with
+// fs.ModeDir set in their mode and a nil function, before the files under
+// them. Files copied from basis are checked
+// against the digest recorded in the delta like patched ones are, returning
+// ErrBasisMismatch when they differ. Paths are relative, slash separated
+// and never leave the tree, so create can join them to a directory.
+func TreePatch(
+	basis fs.FS,
+	delta io.Reader,
+	create func(name string, mode fs.FileMode, fill func(io.Writer) error) error,
+	opts PatchOptions,
+) error {
+	return TreePatchContext(context.Background(), basis, delta, create, opts)
+}
+
+// TreePatchContext is like TreePatch but stops once ctx is done, returning
+// its error.
+func TreePatchContext(
+	ctx context.Context,
+	basis fs.FS,
+	delta io.Reader,
+	create func(name string, mode fs.FileMode, fill func(io.Writer) error) error,
+	opts PatchOptions,
+) error {
+	if opts.Format != FORMAT_PLAIN {
+		return fmt.Errorf("%w: trees are only written in the plain format", ErrUnsupportedFormat)
+	}
+	r := bufio.NewReader(delta)
+	err := readTreeHeader(r, TREE_DELTA_MAGIC)
+	if err != nil {
+		return truncatedRecord(err, "header")
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		entry, err := readTreeDeltaEntry(r)
+		if err != nil {
+			return err
+		}
+		switch entry.Op {
+		case TREE_OP_END:
+			return expectEnd(r)
+		case TREE_OP_UNCHANGED, TREE_OP_RENAMED:
+			from := entry.From
+			if entry.Op == TREE_OP_UNCHANGED {
+				from = entry.Name
+			}
+			err = create(entry.Name, entry.Mode, func(w io.Writer) error {
+				return copyTreeFile(basis, from, *entry.Digest, w)
+			})
+		case TREE_OP_ADDED, TREE_OP_CHANGED:
+			err = patchTreeFile(ctx, basis, entry.Name, entry.Op == TREE_OP_ADDED, newChunkReader(r), entry.Mode, create, opts)
+		case TREE_OP_DIRECTORY:
+			err = create(entry.Name, entry.Mode, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// patchTreeFile creates the file name by patching the basis file at the same
+// path, or an empty one if added, with the embedded delta.
+func patchTreeFile(
+	ctx context.Context,
+	basis fs.FS,
+	name string,
+	added bool,
+	delta *chunkReader,
+	mode fs.FileMode,
+	create func(name string, mode fs.FileMode, fill func(io.Writer) error) error,
+	opts PatchOptions,
+) error {
+	var basisFile io.ReaderAt = bytes.NewReader(nil)
+	if !added {
+		file, err := openReaderAt(basis, name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		basisFile = file
+	}
+	err := create(name, mode, func(w io.Writer) error {
+		return plainPatch(ctx, basisFile, delta, w, opts)
+	})
+	if err != nil {
+		return err
+	}
+	// Compressed bodies can end before the chunks holding them.
+	return expectEnd(delta)
+}
+
+// copyTreeFile writes the basis file name to w, checking its digest.
+func copyTreeFile(basis fs.FS, name string, expected FileDigest, w io.Writer) error {
+	file, err := basis.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	digest := newDigestWriter()
+	_, err = io.Copy(io.MultiWriter(w, digest), file)
+	if err != nil {
+		return err
+	}
+	if !digest.Digest().Equal(expected) {
+		return fmt.Errorf("%w: %s", ErrBasisMismatch, name)
+	}
+	return nil
+}
+
+// TreeEntry is a file or directory of a tree signature or delta.
+type TreeEntry struct {
+	// Op is the operation of entries of deltas and TREE_OP_END in
+	// signatures.
+	Op   byte
+	Name string
+	// Mode has fs.ModeDir set for directories. Signatures and deleted
+	// entries hold no permissions.
+	Mode fs.FileMode
+	// From is the basis path of renamed files.
+	From string
+	// Digest is the digest of the files of signatures and of unchanged and
+	// renamed files.
+	Digest *FileDigest
+	// Length is the length of the embedded signature or delta.
+	Length uint64
+}
+
+// ReadTreeSignature reads the entries of a tree signature, in the order
+// TreeSignature walks the tree: lexical order, with the entries under a
+// directory right after it.
+func ReadTreeSignature(signature io.Reader) ([]TreeEntry, error) {
+	s, err := newTreeSignatureReader(signature)
+	if err != nil {
+		return nil, err
+	}
+	var entries []TreeEntry
+	for !s.done {
+		entry := TreeEntry{Name: s.name}
+		directory := s.directory
+		digest, length, err := s.skip()
+		if err != nil {
+			return nil, err
+		}
+		entry.Length = length
+		if directory {
+			entry.Mode = fs.ModeDir
+		} else {
+			entry.Digest = &digest
+		}
+		entries = append(entries, entry)
+	}
+	return entries, s.end()
+}
+
+// ReadTreeDelta reads the entries of a tree delta, skipping their embedded
+// deltas.
+func ReadTreeDelta(delta io.Reader) ([]TreeEntry, error) {
+	r := bufio.NewReader(delta)
+	err := readTreeHeader(r, TREE_DELTA_MAGIC)
+	if err != nil {
+		return nil, truncatedRecord(err, "header")
+	}
+	var entries []TreeEntry
+	for {
+		entry, err := readTreeDeltaEntry(r)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Op == TREE_OP_END {
+			return entries, expectEnd(r)
+		}
+		if entry.Op == TREE_OP_ADDED || entry.Op == TREE_OP_CHANGED {
+			length, err := io.Copy(io.Discard, newChunkReader(r))
+			if err != nil {
+				return nil, err
+			}
+			entry.Length = uint64(length)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// readTreeDeltaEntry reads an entry of a tree delta up to its embedded
+// delta, if any.
+func readTreeDeltaEntry(r *bufio.Reader) (TreeEntry, error) {
+	op, err := r.ReadByte()
+	if err != nil {
+		return TreeEntry{}, truncatedRecord(err, "opcode")
+	}
+	entry := TreeEntry{Op: op}
+	if op == TREE_OP_END {
+		return entry, nil
+	}
+	if op > TREE_OP_DIRECTORY {
+		return entry, fmt.Errorf("%w: %d", ErrUnknownOpcode, op)
+	}
+	if entry.Name, err = readTreePath(r); err != nil {
+		return entry, err
+	}
+	if op == TREE_OP_DELETED {
+		return entry, nil
+	}
+	mode, err := readUvarint(r, "mode")
+	if err != nil {
+		return entry, err
+	}
+	entry.Mode = fs.FileMode(mode) & fs.ModePerm
+	if op == TREE_OP_DIRECTORY {
+		entry.Mode |= fs.ModeDir
+	}
+	if op == TREE_OP_RENAMED {
+		if entry.From, err = readTreePath(r); err != nil {
+			return entry, err
+		}
+	}
+	if op == TREE_OP_UNCHANGED || op == TREE_OP_RENAMED {
+		digest := make([]byte, FILE_DIGEST_SIZE)
+		if _, err = io.ReadFull(r, digest); err != nil {
+			return entry, truncatedRecord(err, "file digest")
+		}
+		fileDigest := fileDigestFromBytes(digest)
+		entry.Digest = &fileDigest
+	}
+	return entry, nil
+}
+
+// treeSignatureReader reads the entries of a tree signature one at a time,
+// refusing entries out of the order walkTree visits paths in.
+type treeSignatureReader struct {
+	r *bufio.Reader
+	// name and directory describe the current entry, until done.
+	name      string
+	directory bool
+	done      bool
+}
+
+func newTreeSignatureReader(signature io.Reader) (*treeSignatureReader, error) {
+	r := bufio.NewReader(signature)
+	err := readTreeHeader(r, TREE_SIGNATURE_MAGIC)
+	if errors.Is(err, ErrNotSignature) || errors.Is(err, ErrUnsupportedSignatureVersion) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, truncatedSignature(err)
+	}
+	s := &treeSignatureReader{r: r}
+	return s, s.next()
+}
+
+// next reads the path and kind of the next entry.
+func (s *treeSignatureReader) next() error {
+	length, err := binary.ReadUvarint(s.r)
+	if err != nil {
+		return truncatedSignature(err)
+	}
+	if length == 0 {
+		s.done = true
+		return nil
+	}
+	name, err := readTreePathOfLength(s.r, length)
+	if err != nil {
+		return truncatedSignature(err)
+	}
+	if s.name != "" && compareTreePaths(s.name, name) >= 0 {
+		return fmt.Errorf("%w: %s after %s", ErrNotSignature, name, s.name)
+	}
+	kind, err := s.r.ReadByte()
+	if err != nil {
+		return truncatedSignature(err)
+	}
+	if kind != TREE_ENTRY_FILE && kind != TREE_ENTRY_DIRECTORY {
+		return fmt.Errorf("%w: entry kind %d of %s", ErrNotSignature, kind, name)
+	}
+	s.name, s.directory = name, kind == TREE_ENTRY_DIRECTORY
+	return nil
+}
+
+// read returns the embedded signature of the current file and the digest
+// in its trailer, moving to the next entry.
+func (s *treeSignatureReader) read() ([]byte, FileDigest, error) {
+	content, err := io.ReadAll(newChunkReader(s.r))
+	if err != nil {
+		return nil, FileDigest{}, truncatedSignature(err)
+	}
+	if len(content) < SIGNATURE_HEADER_SIZE+SIGNATURE_TRAILER_SIZE {
+		return nil, FileDigest{}, fmt.Errorf("%w: %s", ErrTruncatedSignature, s.name)
+	}
+	return content, fileDigestFromBytes(content[len(content)-SIGNATURE_TRAILER_SIZE:]), s.next()
+}
+
+// skip reads past the current entry, returning the digest and length of
+// the embedded signature of files.
+func (s *treeSignatureReader) skip() (FileDigest, uint64, error) {
+	if s.directory {
+		return FileDigest{}, 0, s.next()
+	}
+	trailer := &trailerWriter{}
+	length, err := io.Copy(trailer, newChunkReader(s.r))
+	if err != nil {
+		return FileDigest{}, 0, truncatedSignature(err)
+	}
+	if length < SIGNATURE_HEADER_SIZE+SIGNATURE_TRAILER_SIZE {
+		return FileDigest{}, 0, fmt.Errorf("%w: %s", ErrTruncatedSignature, s.name)
+	}
+	return fileDigestFromBytes(trailer.bytes), uint64(length), s.next()
+}
+
+// end checks that nothing follows the signature.
+func (s *treeSignatureReader) end() error {
+	return expectEnd(s.r)
+}
+
+// trailerWriter keeps the last SIGNATURE_TRAILER_SIZE bytes written to it.
+type trailerWriter struct {
+	bytes []byte
+}
+
+func (t *trailerWriter) Write(p []byte) (int, error) {
+	t.bytes = append(t.bytes, p...)
+	if len(t.bytes) > SIGNATURE_TRAILER_SIZE {
+		t.bytes = append(t.bytes[:0], t.bytes[len(t.bytes)-SIGNATURE_TRAILER_SIZE:]...)
+	}
+	return len(p), nil
+}
+
+// compareTreePaths orders paths the way walkTree visits them, lexically but
+// with the paths under a directory right after it: "a", "a/b", "a-b".
+func compareTreePaths(a, b string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		switch {
+		case a[i] == b[i]:
+			continue
+		case a[i] == '/':
+			return -1
+		case b[i] == '/':
+			return 1
+		case a[i] < b[i]:
+			return -1
+		}
+		return 1
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return 0
+}
+
+// truncatedSignature turns running out of a tree signature into
+// ErrTruncatedSignature.
+func truncatedSignature(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrTruncatedDelta) {
+		return ErrTruncatedSignature
+	}
+	return err
+}
+
+// writeTreeFileDelta writes the delta of the file name of newTree against
+// signature to delta as chunks, returning the digest of the file.
+func writeTreeFileDelta(ctx context.Context, signature io.Reader, newTree fs.FS, name string, delta io.Writer, opts DeltaOptions) (FileDigest, error) {
+	file, err := newTree.Open(name)
+	if err != nil {
+		return FileDigest{}, err
+	}
+	defer file.Close()
+
+	chunks := newChunkWriter(delta)
+	digest, err := plainDelta(ctx, signature, file, chunks, opts)
+	if err != nil {
+		return FileDigest{}, err
+	}
+	return digest, chunks.Close()
+}
+
+// pendingDelta holds back the embedded delta of a file while it is at most
+// TREE_CHUNK_LENGTH long, writing entry before it once it is longer or
+// flushed. Deltas of unchanged files, merged copies, stay that short.
+type pendingDelta struct {
+	w       io.Writer
+	entry   []byte
+	buffer  []byte
+	started bool
+}
+
+func (p *pendingDelta) Write(b []byte) (int, error) {
+	if !p.started && len(p.buffer)+len(b) <= TREE_CHUNK_LENGTH {
+		p.buffer = append(p.buffer, b...)
+		return len(b), nil
+	}
+	if err := p.flush(); err != nil {
+		return 0, err
+	}
+	return p.w.Write(b)
+}
+
+// flush writes entry and the delta held back, unless done already.
+func (p *pendingDelta) flush() error {
+	if p.started {
+		return nil
+	}
+	p.started = true
+	_, err := p.w.Write(append(p.entry, p.buffer...))
+	return err
+}
+
+func treeFileDigest(tree fs.FS, name string) (FileDigest, error) {
+	file, err := tree.Open(name)
+	if err != nil {
+		return FileDigest{}, err
+	}
+	defer file.Close()
+	return calculateFileDigest(file)
+}
+
+// walkTree calls fn with the path of every regular file and directory under
+// tree but tree itself in lexical order, and skipped, if set, with the path
+// and type of other files.
+func walkTree(tree fs.FS, skipped func(name string, mode fs.FileMode), fn func(name string, info fs.FileInfo) error) error {
+	return fs.WalkDir(tree, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		if !entry.IsDir() && !entry.Type().IsRegular() {
+			if skipped != nil {
+				skipped(name, entry.Type())
+			}
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		return fn(name, info)
+	})
+}
+
+type readerAtFile interface {
+	fs.File
+	io.ReaderAt
+}
+
+// openReaderAt opens the file name of tree, which has to support ReadAt
+// like the files of os.DirFS do.
+func openReaderAt(tree fs.FS, name string) (readerAtFile, error) {
+	file, err := tree.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	readerAt, ok := file.(readerAtFile)
+	if !ok {
+		file.Close()
+		return nil, fmt.Errorf("%s: file does not support ReadAt", name)
+	}
+	return readerAt, nil
+}
+
+func treeHeaderToBytes(magic uint32) []byte {
+	bytes := make([]byte, TREE_HEADER_SIZE)
+	binary.BigEndian.PutUint32(bytes[0:4], magic)
+	binary.BigEndian.PutUint16(bytes[4:6], TREE_VERSION)
+	return bytes
+}
+
+// readTreeHeader reads the header of a tree signature or delta, returning
+// the errors of signatures or deltas depending on magic.
+func readTreeHeader(r io.Reader, magic uint32) error {
+	bytes := make([]byte, TREE_HEADER_SIZE)
+	_, err := io.ReadFull(r, bytes)
+	if err != nil {
+		return err
+	}
+	notTree, unsupportedVersion := ErrNotDelta, ErrUnsupportedDeltaVersion
+	if magic == TREE_SIGNATURE_MAGIC {
+		notTree, unsupportedVersion = ErrNotSignature, ErrUnsupportedSignatureVersion
+	}
+	if binary.BigEndian.Uint32(bytes[0:4]) != magic {
+		return fmt.Errorf("%w: not a tree", notTree)
+	}
+	if version := binary.BigEndian.Uint16(bytes[4:6]); version != TREE_VERSION {
+		return fmt.Errorf("%w: tree version %d", unsupportedVersion, version)
+	}
+	return nil
+}
+
+// treeEntryToBytes returns an entry of a tree delta. from and digest are
+// only written when given.
+func treeEntryToBytes(op byte, name string, mode fs.FileMode, from string, digest *FileDigest) []byte {
+	bytes := appendString([]byte{op}, name)
+	bytes = appendUvarint(bytes, uint64(mode.Perm()))
+	if from != "" {
+		bytes = appendString(bytes, from)
+	}
+	if digest != nil {
+		bytes = append(bytes, digest.ToBytes()...)
+	}
+	return bytes
+}
+
+func appendUvarint(bytes []byte, v uint64) []byte {
+	buffer := make([]byte, binary.MaxVarintLen64)
+	return append(bytes, buffer[:binary.PutUvarint(buffer, v)]...)
+}
+
+func appendString(bytes []byte, s string) []byte {
+	bytes = appendUvarint(bytes, uint64(len(s)))
+	return append(bytes, s...)
+}
+
+func readTreePath(r *bufio.Reader) (string, error) {
+	length, err := readUvarint(r, "path length")
+	if err != nil {
+		return "", err
+	}
+	return readTreePathOfLength(r, length)
+}
+
+// readTreePathOfLength reads a path, refusing paths that are not relative
+// and slash separated or leave the tree with "..".
+func readTreePathOfLength(r io.Reader, length uint64) (string, error) {
+	if length > MAX_TREE_PATH_LENGTH {
+		return "", fmt.Errorf("%w: %d bytes long", ErrInvalidPath, length)
+	}
+	bytes := make([]byte, length)
+	_, err := io.ReadFull(r, bytes)
+	if err != nil {
+		return "", truncatedRecord(err, "path")
+	}
+	name := string(bytes)
+	if !fs.ValidPath(name) || name == "." {
+		return "", fmt.Errorf("%w: %q", ErrInvalidPath, name)
+	}
+	return name, nil
+}
+
+// chunkWriter embeds a signature or delta of unknown length in a tree
+// signature or delta as chunks of a uvarint length followed by as many
+// bytes, ending with an empty chunk once closed.
+type chunkWriter struct {
+	*bufio.Writer
+	w io.Writer
+}
+
+func newChunkWriter(w io.Writer) *chunkWriter {
+	return &chunkWriter{
+		Writer: bufio.NewWriterSize(chunkFramer{w}, TREE_CHUNK_LENGTH),
+		w:      w,
+	}
+}
+
+// Close writes the remaining chunk and the empty one, without closing the
+// underlying writer.
+func (c *chunkWriter) Close() error {
+	err := c.Flush()
+	if err != nil {
+		return err
+	}
+	_, err = c.w.Write([]byte{0})
+	return err
+}
+
+type chunkFramer struct {
+	w io.Writer
+}
+
+func (f chunkFramer) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	_, err := f.w.Write(appendUvarint(nil, uint64(len(p))))
+	if err != nil {
+		return 0, err
+	}
+	return f.w.Write(p)
+}
+
+// chunkReader reads data embedded by chunkWriter, up to the empty chunk.
+type chunkReader struct {
+	r         *bufio.Reader
+	remaining uint64
+	done      bool
+}
+
+func newChunkReader(r *bufio.Reader) *chunkReader {
+	return &chunkReader{r: r}
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.remaining == 0 {
+		length, err := readUvarint(c.r, "chunk length")
+		if err != nil {
+			return 0, err
+		}
+		if length == 0 {
+			c.done = true
+			return 0, io.EOF
+		}
+		c.remaining = length
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= uint64(n)
+	if errors.Is(err, io.EOF) {
+		err = truncatedRecord(err, "chunk")
+	}
+	return n, err
+}
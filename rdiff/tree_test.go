@@ -0,0 +1,282 @@
+package rdiff
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"math/rand"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// createdFile is a file or directory passed to the create function of
+// TreePatch.
+type createdFile struct {
+	mode    fs.FileMode
+	content string
+}
+
+func treePatch(basis fs.FS, delta io.Reader) (map[string]createdFile, error) {
+	files := map[string]createdFile{}
+	err := TreePatch(basis, delta, func(name string, mode fs.FileMode, fill func(io.Writer) error) error {
+		if mode.IsDir() {
+			files[name] = createdFile{mode: mode}
+			return nil
+		}
+		content := strings.Builder{}
+		if err := fill(&content); err != nil {
+			return err
+		}
+		files[name] = createdFile{mode: mode, content: content.String()}
+		return nil
+	}, PatchOptions{})
+	return files, err
+}
+
+// openCountingFS counts how many times every file is opened.
+type openCountingFS struct {
+	fs.FS
+	opens map[string]int
+}
+
+func (c *openCountingFS) Open(name string) (fs.File, error) {
+	c.opens[name]++
+	return c.FS.Open(name)
+}
+
+func treeDelta(t *testing.T, basis, newTree fs.FS) []byte {
+	t.Helper()
+	signature := bytes.Buffer{}
+	assert.NoError(t, TreeSignature(basis, &signature, SignatureOptions{BlockLength: 16}))
+	delta := bytes.Buffer{}
+	assert.NoError(t, TreeDelta(&signature, newTree, &delta, DeltaOptions{Compression: COMPRESSION_GZIP}))
+	return delta.Bytes()
+}
+
+// treeOps returns the operation and path of every entry of delta.
+func treeOps(t *testing.T, delta []byte) []string {
+	t.Helper()
+	names := map[byte]string{
+		TREE_OP_UNCHANGED: "unchanged",
+		TREE_OP_RENAMED:   "renamed",
+		TREE_OP_ADDED:     "added",
+		TREE_OP_CHANGED:   "changed",
+		TREE_OP_DELETED:   "deleted",
+		TREE_OP_DIRECTORY: "directory",
+	}
+	entries, err := ReadTreeDelta(bytes.NewReader(delta))
+	assert.NoError(t, err)
+	var ops []string
+	for _, entry := range entries {
+		ops = append(ops, names[entry.Op]+" "+entry.Name)
+	}
+	return ops
+}
+
+func TestTree(t *testing.T) {
+	long := strings.Repeat("Imagine you have two files, A and B. ", 100)
+	basis := fstest.MapFS{
+		"unchanged":      {Data: []byte("same content"), Mode: 0644},
+		"dir/changed":    {Data: []byte(long), Mode: 0644},
+		"dir/old-name":   {Data: []byte("renamed content"), Mode: 0600},
+		"deleted":        {Data: []byte("deleted content"), Mode: 0644},
+		"deleted-dir":    {Mode: fs.ModeDir | 0755},
+		"dir/sub/mode":   {Data: []byte("mode"), Mode: 0644},
+		"dir/sub/copied": {Data: []byte("copied content"), Mode: 0644},
+	}
+	newTree := fstest.MapFS{
+		"unchanged":      {Data: []byte("same content"), Mode: 0644},
+		"dir/changed":    {Data: []byte(strings.Replace(long, "two", "three", 3)), Mode: 0644},
+		"new-name":       {Data: []byte("renamed content"), Mode: 0600},
+		"added":          {Data: []byte("added content"), Mode: 0755},
+		"dir/sub/mode":   {Data: []byte("mode"), Mode: 0755},
+		"dir/sub/copied": {Data: []byte("copied content"), Mode: 0644},
+		"copy":           {Data: []byte("copied content"), Mode: 0644},
+		"empty":          {Data: nil, Mode: 0644},
+		"empty-dir":      {Mode: fs.ModeDir | 0700},
+	}
+
+	t.Run("should recreate new tree", func(t *testing.T) {
+		delta := treeDelta(t, basis, newTree)
+		assert.Equal(t, []string{
+			"deleted deleted",
+			"deleted deleted-dir",
+			"directory dir",
+			"changed dir/changed",
+			"deleted dir/old-name",
+			"directory dir/sub",
+			"unchanged dir/sub/copied",
+			"unchanged dir/sub/mode",
+			"directory empty-dir",
+			"unchanged unchanged",
+			"added added",
+			"renamed copy",
+			"added empty",
+			"renamed new-name",
+		}, treeOps(t, delta))
+
+		files, err := treePatch(basis, bytes.NewReader(delta))
+		assert.NoError(t, err)
+		// MapFS makes up the parent directories missing from it.
+		expected := map[string]createdFile{
+			"dir":     {mode: fs.ModeDir | 0555},
+			"dir/sub": {mode: fs.ModeDir | 0555},
+		}
+		for name, file := range newTree {
+			expected[name] = createdFile{mode: file.Mode, content: string(file.Data)}
+		}
+		assert.Equal(t, expected, files)
+	})
+
+	t.Run("should recreate tree from empty one", func(t *testing.T) {
+		delta := treeDelta(t, fstest.MapFS{}, newTree)
+		files, err := treePatch(fstest.MapFS{}, bytes.NewReader(delta))
+		assert.NoError(t, err)
+		assert.Len(t, files, len(newTree)+2)
+		assert.Equal(t, createdFile{mode: fs.ModeDir | 0700}, files["empty-dir"])
+	})
+
+	t.Run("should read entries of signature", func(t *testing.T) {
+		signature := bytes.Buffer{}
+		assert.NoError(t, TreeSignature(basis, &signature, SignatureOptions{}))
+		entries, err := ReadTreeSignature(&signature)
+		assert.NoError(t, err)
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+			assert.Equal(t, entry.Mode.IsDir(), entry.Digest == nil, entry.Name)
+		}
+		assert.Equal(t, []string{"deleted", "deleted-dir", "dir", "dir/changed", "dir/old-name", "dir/sub", "dir/sub/copied", "dir/sub/mode", "unchanged"}, names)
+		assert.Equal(t, uint64(len("renamed content")), entries[4].Digest.Length)
+	})
+
+	t.Run("should add file replacing basis directory", func(t *testing.T) {
+		dirBasis := fstest.MapFS{"replaced/file": {Data: []byte("file"), Mode: 0644}}
+		fileTree := fstest.MapFS{"replaced": {Data: []byte("file"), Mode: 0644}}
+		delta := treeDelta(t, dirBasis, fileTree)
+		assert.Equal(t, []string{"deleted replaced/file", "renamed replaced"}, treeOps(t, delta))
+
+		files, err := treePatch(dirBasis, bytes.NewReader(delta))
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]createdFile{"replaced": {mode: 0644, content: "file"}}, files)
+	})
+
+	t.Run("should match paths in walk order", func(t *testing.T) {
+		// "a-b" sorts before "a/b" but is walked after it.
+		tree := fstest.MapFS{
+			"a/b": {Data: []byte("under a"), Mode: 0644},
+			"a-b": {Data: []byte("next to a"), Mode: 0644},
+		}
+		delta := treeDelta(t, tree, tree)
+		assert.Equal(t, []string{"directory a", "unchanged a/b", "unchanged a-b"}, treeOps(t, delta))
+	})
+
+	t.Run("should refuse signature out of order", func(t *testing.T) {
+		signature := treeHeaderToBytes(TREE_SIGNATURE_MAGIC)
+		signature = append(appendString(signature, "b"), TREE_ENTRY_DIRECTORY)
+		signature = append(appendString(signature, "a"), TREE_ENTRY_DIRECTORY)
+		signature = appendString(signature, "")
+		_, err := ReadTreeSignature(bytes.NewReader(signature))
+		assert.ErrorIs(t, err, ErrNotSignature)
+		err = TreeDelta(bytes.NewReader(signature), newTree, io.Discard, DeltaOptions{})
+		assert.ErrorIs(t, err, ErrNotSignature)
+	})
+
+	t.Run("should refuse changed basis file", func(t *testing.T) {
+		delta := treeDelta(t, basis, newTree)
+		for _, name := range []string{"dir/changed", "dir/old-name", "unchanged"} {
+			changedBasis := fstest.MapFS{}
+			for n, file := range basis {
+				changedBasis[n] = file
+			}
+			changedBasis[name] = &fstest.MapFile{Data: []byte("other"), Mode: 0644}
+			_, err := treePatch(changedBasis, bytes.NewReader(delta))
+			assert.ErrorIs(t, err, ErrBasisMismatch, name)
+		}
+	})
+
+	t.Run("should skip symbolic links", func(t *testing.T) {
+		tree := fstest.MapFS{
+			"file": {Data: []byte("target"), Mode: 0644},
+			"link": {Data: []byte("file"), Mode: fs.ModeSymlink},
+		}
+		var skipped []string
+		skip := func(name string, mode fs.FileMode) {
+			skipped = append(skipped, name)
+			assert.Equal(t, fs.ModeSymlink, mode)
+		}
+		signature := bytes.Buffer{}
+		assert.NoError(t, TreeSignature(tree, &signature, SignatureOptions{Skipped: skip}))
+		entries, err := ReadTreeSignature(bytes.NewReader(signature.Bytes()))
+		assert.NoError(t, err)
+		assert.Len(t, entries, 1)
+		delta := bytes.Buffer{}
+		assert.NoError(t, TreeDelta(&signature, tree, &delta, DeltaOptions{Skipped: skip}))
+		assert.Equal(t, []string{"unchanged file"}, treeOps(t, delta.Bytes()))
+		assert.Equal(t, []string{"link", "link"}, skipped)
+	})
+
+	t.Run("should write delta longer than held back one", func(t *testing.T) {
+		random := rand.New(rand.NewSource(1))
+		oldContent := make([]byte, 3*TREE_CHUNK_LENGTH)
+		random.Read(oldContent)
+		newContent := make([]byte, len(oldContent))
+		random.Read(newContent)
+		oldTree := fstest.MapFS{"file": {Data: oldContent, Mode: 0644}}
+		delta := treeDelta(t, oldTree, fstest.MapFS{"file": {Data: newContent, Mode: 0644}})
+		assert.Equal(t, []string{"changed file"}, treeOps(t, delta))
+
+		files, err := treePatch(oldTree, bytes.NewReader(delta))
+		assert.NoError(t, err)
+		assert.Equal(t, string(newContent), files["file"].content)
+	})
+
+	t.Run("should read new files once", func(t *testing.T) {
+		signature := bytes.Buffer{}
+		assert.NoError(t, TreeSignature(basis, &signature, SignatureOptions{BlockLength: 16}))
+		counting := &openCountingFS{FS: newTree, opens: map[string]int{}}
+		assert.NoError(t, TreeDelta(&signature, counting, io.Discard, DeltaOptions{}))
+		for name, file := range newTree {
+			if !file.Mode.IsDir() {
+				assert.Equal(t, 1, counting.opens[name], name)
+			}
+		}
+	})
+
+	t.Run("should refuse single file signature", func(t *testing.T) {
+		signature := bytes.Buffer{}
+		assert.NoError(t, Signature(strings.NewReader(long), &signature, SignatureOptions{}))
+		err := TreeDelta(&signature, newTree, io.Discard, DeltaOptions{})
+		assert.ErrorIs(t, err, ErrNotSignature)
+	})
+
+	t.Run("should refuse truncated signature", func(t *testing.T) {
+		signature := bytes.Buffer{}
+		assert.NoError(t, TreeSignature(basis, &signature, SignatureOptions{}))
+		err := TreeDelta(bytes.NewReader(signature.Bytes()[:signature.Len()-1]), newTree, io.Discard, DeltaOptions{})
+		assert.ErrorIs(t, err, ErrTruncatedSignature)
+	})
+
+	delta := treeDelta(t, basis, newTree)
+	escaping := append(treeHeaderToBytes(TREE_DELTA_MAGIC), treeEntryToBytes(TREE_OP_UNCHANGED, "../escaped", 0644, "", &FileDigest{Hash: make([]byte, 32)})...)
+	tcs := []struct {
+		name     string
+		delta    []byte
+		expected error
+	}{
+		{name: "should refuse truncated delta", delta: delta[:len(delta)-1], expected: ErrTruncatedDelta},
+		{name: "should refuse trailing data", delta: append(append([]byte{}, delta...), 0), expected: ErrTrailingData},
+		{name: "should refuse path leaving tree", delta: escaping, expected: ErrInvalidPath},
+		{name: "should refuse single file delta", delta: NewDeltaHeader(FileDigest{}, COMPRESSION_NONE).ToBytes(), expected: ErrNotDelta},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := treePatch(basis, bytes.NewReader(tc.delta))
+			assert.ErrorIs(t, err, tc.expected)
+			assert.True(t, IsInvalidInput(err))
+		})
+	}
+}
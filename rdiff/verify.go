@@ -0,0 +1,169 @@
+package rdiff
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Verify applies delta on top of basis like Patch does, comparing the
+// recreated file with target instead of writing it. A nil target relies on
+// the digest of the target file recorded in plain deltas; librsync deltas
+// record none, so they are only checked to apply. When the recreated file
+// differs from target, the returned error wraps ErrTargetDiffers and tells
+// the offset of the first difference and the operation writing it.
+func Verify(basis io.ReaderAt, delta io.Reader, target io.Reader, opts PatchOptions) error {
+	return VerifyContext(context.Background(), basis, delta, target, opts)
+}
+
+// VerifyContext is like Verify but stops once ctx is done, returning its
+// error.
+func VerifyContext(ctx context.Context, basis io.ReaderAt, delta io.Reader, target io.Reader, opts PatchOptions) error {
+	if target == nil {
+		return PatchContext(ctx, basis, delta, io.Discard, opts)
+	}
+	comparison := &targetComparison{target: target}
+	log := opLog{}
+	opts.observe = func(chunk DeltaChunk) {
+		log.add(chunk, atomic.LoadUint64(&comparison.matched))
+	}
+	err := PatchContext(ctx, basis, delta, comparison, opts)
+	if err == nil {
+		err = comparison.end()
+	}
+	if !errors.Is(err, ErrTargetDiffers) {
+		return err
+	}
+	if op, ok := log.find(comparison.matched); ok {
+		return fmt.Errorf("%w at offset %d, written by operation %d: %s", ErrTargetDiffers, comparison.matched, op.index, op)
+	}
+	return fmt.Errorf("%w at offset %d: target file is longer", ErrTargetDiffers, comparison.matched)
+}
+
+// targetComparison compares data written to it with target, failing with
+// ErrTargetDiffers at the first difference. matched is the number of bytes
+// found equal and, once it failed, the offset of the difference.
+type targetComparison struct {
+	target  io.Reader
+	matched uint64
+	buffer  []byte
+}
+
+func (t *targetComparison) Write(p []byte) (int, error) {
+	if cap(t.buffer) < len(p) {
+		t.buffer = make([]byte, len(p))
+	}
+	expected := t.buffer[:len(p)]
+	readBytes, err := io.ReadFull(t.target, expected)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, err
+	}
+	for i := 0; i < readBytes; i++ {
+		if p[i] != expected[i] {
+			atomic.AddUint64(&t.matched, uint64(i))
+			return i, ErrTargetDiffers
+		}
+	}
+	atomic.AddUint64(&t.matched, uint64(readBytes))
+	if readBytes < len(p) {
+		return readBytes, ErrTargetDiffers
+	}
+	return len(p), nil
+}
+
+// end fails with ErrTargetDiffers if target goes on after all data written.
+func (t *targetComparison) end() error {
+	_, err := io.ReadFull(t.target, make([]byte, 1))
+	if err == nil {
+		return ErrTargetDiffers
+	}
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+// loggedOp is a delta operation writing length bytes at offset of the
+// recreated file.
+type loggedOp struct {
+	index  int
+	offset uint64
+	length uint64
+	from   uint64
+	copy   bool
+}
+
+func (op loggedOp) String() string {
+	if op.copy {
+		return fmt.Sprintf("COPY of %d bytes from %d", op.length, op.from)
+	}
+	return fmt.Sprintf("LITERAL of %d bytes", op.length)
+}
+
+// opLog keeps the operations of a delta whose data has not been matched
+// yet, so that a difference can be traced back to its operation without
+// keeping all of them.
+type opLog struct {
+	ops  []loggedOp
+	next int
+	end  uint64
+}
+
+// add logs chunk and forgets operations ending before matched.
+func (l *opLog) add(chunk DeltaChunk, matched uint64) {
+	forgotten := 0
+	for forgotten < len(l.ops) && l.ops[forgotten].offset+l.ops[forgotten].length <= matched {
+		forgotten++
+	}
+	l.ops = l.ops[forgotten:]
+
+	op := loggedOp{index: l.next, offset: l.end, length: chunk.Len(), copy: !chunk.IsLiteral()}
+	if op.copy {
+		op.from, _ = chunk.Range()
+	}
+	l.ops = append(l.ops, op)
+	l.next++
+	l.end += op.length
+}
+
+// find returns the logged operation writing the byte at offset.
+func (l *opLog) find(offset uint64) (loggedOp, bool) {
+	for _, op := range l.ops {
+		if offset >= op.offset && offset < op.offset+op.length {
+			return op, true
+		}
+	}
+	return loggedOp{}, false
+}
+
+// observed returns deltaReader passing every chunk it sends to
+// opts.observe first, or deltaReader itself if nothing observes chunks.
+func (opts PatchOptions) observed(deltaReader func(context.Context, chan DeltaChunk) error) func(context.Context, chan DeltaChunk) error {
+	if opts.observe == nil {
+		return deltaReader
+	}
+	return func(ctx context.Context, c chan DeltaChunk) error {
+		defer close(c)
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		read := make(chan DeltaChunk)
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- deltaReader(ctx, read)
+		}()
+		for chunk := range read {
+			opts.observe(chunk)
+			if err := sendDeltaChunk(ctx, c, chunk); err != nil {
+				cancel()
+				for range read {
+				}
+				<-errChan
+				return err
+			}
+		}
+		return <-errChan
+	}
+}
@@ -0,0 +1,64 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrUnexpectedStatus   = errors.New("unexpected HTTP status")
+	ErrRangesNotSupported = errors.New("server does not support range requests")
+	ErrUnexpectedRange    = errors.New("server returned another range")
+)
+
+// Get returns the body of the file at url.
+func Get(ctx context.Context, client *http.Client, url string) (io.ReadCloser, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("%w: GET %s: %s", ErrUnexpectedStatus, url, response.Status)
+	}
+	return response.Body, nil
+}
+
+// RangeFetcher returns a function reading the byte range [from, to) of the
+// file at url with an HTTP Range request, as rdiff.Fetch takes. Servers
+// answering with the whole file are refused with ErrRangesNotSupported
+// rather than downloading it for every range.
+func RangeFetcher(client *http.Client, url string) func(ctx context.Context, from, to uint64) (io.ReadCloser, error) {
+	return func(ctx context.Context, from, to uint64) (io.ReadCloser, error) {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", from, to-1))
+		response, err := client.Do(request)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case response.StatusCode == http.StatusOK:
+			err = fmt.Errorf("%w: GET %s", ErrRangesNotSupported, url)
+		case response.StatusCode != http.StatusPartialContent:
+			err = fmt.Errorf("%w: GET %s: %s", ErrUnexpectedStatus, url, response.Status)
+		case !strings.HasPrefix(response.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/", from, to-1)):
+			err = fmt.Errorf("%w: %q for %d-%d", ErrUnexpectedRange, response.Header.Get("Content-Range"), from, to-1)
+		}
+		if err != nil {
+			response.Body.Close()
+			return nil, err
+		}
+		return response.Body, nil
+	}
+}
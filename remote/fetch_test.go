@@ -0,0 +1,74 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRangeFetcher(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/file":
+			http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(content))
+		case "/whole":
+			io.WriteString(w, content)
+		case "/other":
+			w.Header().Set("Content-Range", "bytes 0-9/1000")
+			w.WriteHeader(http.StatusPartialContent)
+			io.WriteString(w, content[:10])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	t.Run("should read range", func(t *testing.T) {
+		body, err := RangeFetcher(server.Client(), server.URL+"/file")(context.Background(), 15, 32)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer body.Close()
+		read, err := io.ReadAll(body)
+		assert.NoError(t, err)
+		assert.Equal(t, content[15:32], string(read))
+	})
+
+	tcs := []struct {
+		name     string
+		path     string
+		expected error
+	}{
+		{name: "should refuse server ignoring ranges", path: "/whole", expected: ErrRangesNotSupported},
+		{name: "should refuse other range", path: "/other", expected: ErrUnexpectedRange},
+		{name: "should refuse missing file", path: "/missing", expected: ErrUnexpectedStatus},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := RangeFetcher(server.Client(), server.URL+tc.path)(context.Background(), 15, 32)
+			assert.ErrorIs(t, err, tc.expected)
+		})
+	}
+
+	t.Run("should get whole file", func(t *testing.T) {
+		body, err := Get(context.Background(), server.Client(), server.URL+"/whole")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer body.Close()
+		read, err := io.ReadAll(body)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal([]byte(content), read))
+
+		_, err = Get(context.Background(), server.Client(), server.URL+"/missing")
+		assert.ErrorIs(t, err, ErrUnexpectedStatus)
+	})
+}
@@ -0,0 +1,372 @@
+package remote
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"plain-rdiff/rdiff"
+)
+
+// Endpoints of Handler, all taking POST requests.
+const (
+	SIGNATURE_ENDPOINT = "/signature"
+	DELTA_ENDPOINT     = "/delta"
+	PATCH_ENDPOINT     = "/patch/"
+)
+
+// Parts of the multipart/form-data bodies of delta requests, in this order.
+const (
+	SIGNATURE_PART = "signature"
+	NEW_FILE_PART  = "new"
+)
+
+// DEFAULT_MAX_BODY_LENGTH is the default of Handler.MaxBodyLength.
+const DEFAULT_MAX_BODY_LENGTH = 256 << 20
+
+var (
+	// ErrBadRequest is returned for requests with invalid parameters or
+	// bodies that are not as expected.
+	ErrBadRequest = errors.New("bad request")
+	// ErrBodyTooLarge is returned for request bodies longer than
+	// Handler.MaxBodyLength.
+	ErrBodyTooLarge = errors.New("request body too large")
+)
+
+var errNotSequential = errors.New("basis read out of order")
+
+// Handler exposes signature, delta and patch over HTTP:
+//
+//	POST /signature?format=&block-size=&hash=&strong-length=
+//	    returns the signature of the request body
+//	POST /delta?format=&compress=
+//	    returns the delta of the new part of a multipart/form-data body
+//	    against its signature part, which has to come first
+//	POST /patch/<name>?format=
+//	    applies the delta in the request body to the server-side file name
+//	    and returns the length and SHA-256 of the result as JSON
+//
+// Query parameters take the values of the flags of the same names of the
+// command line and default to the same. Failures are answered with 400 for
+// invalid requests, signatures and deltas, 404 for missing files, 409 for
+// deltas of other basis files, 413 for too large bodies and 500 otherwise.
+// A failure once the response started aborts it, so clients see a
+// truncated response.
+//
+// Request bodies are read as they arrive and responses are streamed at the
+// same time, enabling full duplex on HTTP/1. Behind HTTP/1 ResponseWriters
+// not supporting it, which would stop reading the request body once the
+// response starts, responses are held in memory until the request body is
+// read. Signatures are much smaller than the file they describe, deltas at
+// most slightly longer than the new file.
+type Handler struct {
+	// Open opens the server-side file name for patch requests, or an empty
+	// basis if there is none yet. Patch requests are refused unless Open
+	// and Create are set.
+	Open func(name string) (io.ReaderAt, func() error, error)
+	// Create replaces the server-side file name with the one fill writes.
+	Create func(name string, fill func(io.Writer) error) error
+	// MaxBodyLength bounds the length of request bodies, and so of the
+	// responses held in memory without full duplex, and defaults to
+	// DEFAULT_MAX_BODY_LENGTH.
+	MaxBodyLength int64
+}
+
+func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	maxBodyLength := h.MaxBodyLength
+	if maxBodyLength <= 0 {
+		maxBodyLength = DEFAULT_MAX_BODY_LENGTH
+	}
+	r.Body = &limitedBody{ReadCloser: r.Body, limit: maxBodyLength, remaining: maxBodyLength}
+	response := &responseStream{w: w}
+	if r.ProtoMajor < 2 && http.NewResponseController(w).EnableFullDuplex() != nil {
+		response.buffer = &bytes.Buffer{}
+	}
+	var err error
+	switch {
+	case r.URL.Path == SIGNATURE_ENDPOINT:
+		err = h.signature(response, r)
+	case r.URL.Path == DELTA_ENDPOINT:
+		err = h.delta(response, r)
+	case strings.HasPrefix(r.URL.Path, PATCH_ENDPOINT) && h.Open != nil && h.Create != nil:
+		err = h.patch(response, r, strings.TrimPrefix(r.URL.Path, PATCH_ENDPOINT))
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err == nil {
+		err = response.flush()
+	}
+	if err == nil {
+		return
+	}
+	if response.started {
+		panic(http.ErrAbortHandler)
+	}
+	http.Error(w, err.Error(), statusCode(err))
+}
+
+func statusCode(err error) int {
+	switch {
+	case errors.Is(err, ErrBadRequest), rdiff.IsInvalidInput(err):
+		return http.StatusBadRequest
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, rdiff.ErrBasisMismatch), errors.Is(err, rdiff.ErrTargetMismatch):
+		return http.StatusConflict
+	case errors.Is(err, ErrBodyTooLarge):
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+func (h Handler) signature(response *responseStream, r *http.Request) error {
+	opts, err := signatureOptions(r.URL.Query())
+	if err != nil {
+		return err
+	}
+	basis := &sequentialReaderAt{r: r.Body, size: r.ContentLength}
+	opts.Jobs = 1
+	if r.ContentLength < 0 && opts.BlockLength == rdiff.AUTO_BLOCK_LENGTH {
+		opts.BlockLength = 0
+	}
+	response.w.Header().Set("Content-Type", "application/octet-stream")
+	return rdiff.SignatureContext(r.Context(), basis, response, opts)
+}
+
+func (h Handler) delta(response *responseStream, r *http.Request) error {
+	opts, err := deltaOptions(r.URL.Query())
+	if err != nil {
+		return err
+	}
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return fmt.Errorf("%w: expected multipart/form-data body", ErrBadRequest)
+	}
+	parts := multipart.NewReader(r.Body, params["boundary"])
+	signature, err := nextPart(parts, SIGNATURE_PART)
+	if err != nil {
+		return err
+	}
+	response.w.Header().Set("Content-Type", "application/octet-stream")
+	return rdiff.DeltaContext(r.Context(), signature, &nextPartReader{parts: parts, name: NEW_FILE_PART}, response, opts)
+}
+
+// patchResponse describes the file written by a patch request.
+type patchResponse struct {
+	Length uint64 `json:"length"`
+	SHA256 string `json:"sha256"`
+}
+
+func (h Handler) patch(response *responseStream, r *http.Request, name string) error {
+	format, err := queryFormat(r.URL.Query())
+	if err != nil {
+		return err
+	}
+	basis, closeBasis, err := h.Open(name)
+	if err != nil {
+		return err
+	}
+	defer closeBasis()
+
+	digest := &digestWriter{hash: sha256.New()}
+	err = h.Create(name, func(w io.Writer) error {
+		return rdiff.PatchContext(r.Context(), basis, r.Body, io.MultiWriter(w, digest), rdiff.PatchOptions{Format: format})
+	})
+	if err != nil {
+		return err
+	}
+	response.w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(response).Encode(patchResponse{
+		Length: digest.length,
+		SHA256: hex.EncodeToString(digest.hash.Sum(nil)),
+	})
+}
+
+// limitedBody fails reads with ErrBodyTooLarge once more than limit bytes
+// were read.
+type limitedBody struct {
+	io.ReadCloser
+	limit     int64
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, fmt.Errorf("%w: over %d bytes", ErrBodyTooLarge, b.limit)
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), fmt.Errorf("%w: over %d bytes", ErrBodyTooLarge, b.limit)
+	}
+	return n, err
+}
+
+// sequentialReaderAt passes a request body to Signature, which reads its
+// basis in order with a single job.
+type sequentialReaderAt struct {
+	r      io.Reader
+	offset int64
+	size   int64
+}
+
+func (s *sequentialReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	if offset != s.offset {
+		return 0, fmt.Errorf("%w: %d instead of %d", errNotSequential, offset, s.offset)
+	}
+	n, err := io.ReadFull(s.r, p)
+	s.offset += int64(n)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Size lets Signature pick the block length from the content length.
+func (s *sequentialReaderAt) Size() int64 {
+	return s.size
+}
+
+func nextPart(parts *multipart.Reader, name string) (*multipart.Part, error) {
+	part, err := parts.NextPart()
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading %s part: %v", ErrBadRequest, name, err)
+	}
+	if part.FormName() != name {
+		return nil, fmt.Errorf("%w: %q part instead of %s", ErrBadRequest, part.FormName(), name)
+	}
+	return part, nil
+}
+
+// nextPartReader reads the next part, which has to be named name, once the
+// previous one is read.
+type nextPartReader struct {
+	parts *multipart.Reader
+	name  string
+	part  *multipart.Part
+}
+
+func (p *nextPartReader) Read(b []byte) (int, error) {
+	if p.part == nil {
+		part, err := nextPart(p.parts, p.name)
+		if err != nil {
+			return 0, err
+		}
+		p.part = part
+	}
+	return p.part.Read(b)
+}
+
+// responseStream tells whether the response started, after which its
+// status cannot change anymore. With a buffer the response is held there
+// until flushed.
+type responseStream struct {
+	w       http.ResponseWriter
+	started bool
+	buffer  *bytes.Buffer
+}
+
+func (s *responseStream) Write(p []byte) (int, error) {
+	if s.buffer != nil {
+		return s.buffer.Write(p)
+	}
+	if len(p) > 0 {
+		s.started = true
+	}
+	return s.w.Write(p)
+}
+
+// flush writes the buffered response.
+func (s *responseStream) flush() error {
+	if s.buffer == nil {
+		return nil
+	}
+	buffer := s.buffer
+	s.buffer = nil
+	_, err := s.Write(buffer.Bytes())
+	return err
+}
+
+type digestWriter struct {
+	hash   hash.Hash
+	length uint64
+}
+
+func (d *digestWriter) Write(p []byte) (int, error) {
+	d.length += uint64(len(p))
+	return d.hash.Write(p)
+}
+
+func signatureOptions(query url.Values) (rdiff.SignatureOptions, error) {
+	opts := rdiff.SignatureOptions{}
+	var err error
+	if opts.Format, err = queryFormat(query); err != nil {
+		return opts, err
+	}
+	if blockSize := query.Get("block-size"); blockSize == "auto" {
+		opts.BlockLength = rdiff.AUTO_BLOCK_LENGTH
+	} else if blockSize != "" {
+		opts.BlockLength, err = strconv.Atoi(blockSize)
+		if err != nil || opts.BlockLength <= 0 || opts.BlockLength > rdiff.MAX_BLOCK_LENGTH {
+			return opts, fmt.Errorf("%w: invalid block size: %s", ErrBadRequest, blockSize)
+		}
+	}
+	if hash := query.Get("hash"); hash != "" {
+		opts.StrongHash, err = rdiff.ParseStrongHash(hash)
+		if err != nil {
+			return opts, fmt.Errorf("%w: %v", ErrBadRequest, err)
+		}
+	}
+	if strongLength := query.Get("strong-length"); strongLength != "" {
+		opts.StrongHashLength, err = strconv.Atoi(strongLength)
+		if err != nil || opts.StrongHashLength < 0 {
+			return opts, fmt.Errorf("%w: invalid strong length: %s", ErrBadRequest, strongLength)
+		}
+	}
+	return opts, nil
+}
+
+func deltaOptions(query url.Values) (rdiff.DeltaOptions, error) {
+	opts := rdiff.DeltaOptions{}
+	var err error
+	if opts.Format, err = queryFormat(query); err != nil {
+		return opts, err
+	}
+	if compress := query.Get("compress"); compress != "" {
+		opts.Compression, err = rdiff.ParseCompression(compress)
+		if err != nil {
+			return opts, fmt.Errorf("%w: %v", ErrBadRequest, err)
+		}
+	}
+	return opts, nil
+}
+
+func queryFormat(query url.Values) (rdiff.Format, error) {
+	format := query.Get("format")
+	if format == "" {
+		return rdiff.FORMAT_PLAIN, nil
+	}
+	f, err := rdiff.ParseFormat(format)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	return f, nil
+}
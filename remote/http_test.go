@@ -0,0 +1,240 @@
+package remote
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"plain-rdiff/rdiff"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryFiles are the server-side files of a Handler.
+type memoryFiles struct {
+	mutex sync.Mutex
+	files map[string][]byte
+}
+
+func (m *memoryFiles) handler() Handler {
+	return Handler{
+		Open: func(name string) (io.ReaderAt, func() error, error) {
+			m.mutex.Lock()
+			defer m.mutex.Unlock()
+			return bytes.NewReader(m.files[name]), func() error { return nil }, nil
+		},
+		Create: func(name string, fill func(io.Writer) error) error {
+			content := bytes.Buffer{}
+			if err := fill(&content); err != nil {
+				return err
+			}
+			m.mutex.Lock()
+			defer m.mutex.Unlock()
+			m.files[name] = content.Bytes()
+			return nil
+		},
+	}
+}
+
+func post(t *testing.T, client *http.Client, url, contentType string, body io.Reader) (int, []byte) {
+	t.Helper()
+	response, err := client.Post(url, contentType, body)
+	if !assert.NoError(t, err) {
+		return 0, nil
+	}
+	defer response.Body.Close()
+	content, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	return response.StatusCode, content
+}
+
+// deltaRequest returns a multipart/form-data body with signature and newFile
+// parts and its content type.
+func deltaRequest(signature, newFile []byte) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	part, _ := w.CreateFormFile(SIGNATURE_PART, SIGNATURE_PART)
+	part.Write(signature)
+	part, _ = w.CreateFormFile(NEW_FILE_PART, NEW_FILE_PART)
+	part.Write(newFile)
+	w.Close()
+	return body, w.FormDataContentType()
+}
+
+func TestHandler(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	content := make([]byte, 300_000)
+	random.Read(content)
+	changed := append([]byte{}, content...)
+	copy(changed[100_000:], "changed")
+	changed = append(changed, "appended"...)
+
+	expectedSignature := bytes.Buffer{}
+	assert.NoError(t, rdiff.Signature(bytes.NewReader(content), &expectedSignature, rdiff.SignatureOptions{BlockLength: 1024}))
+
+	t.Run("should return signature over HTTP/1 and HTTP/2", func(t *testing.T) {
+		server := httptest.NewUnstartedServer(Handler{})
+		server.EnableHTTP2 = true
+		server.StartTLS()
+		defer server.Close()
+
+		for _, proto := range []int{1, 2} {
+			client := server.Client()
+			if proto == 1 {
+				tlsConfig := client.Transport.(*http.Transport).TLSClientConfig.Clone()
+				tlsConfig.NextProtos = []string{"http/1.1"}
+				client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+			}
+			// io.MultiReader hides the length of the body, so it is streamed.
+			status, signature := post(t, client, server.URL+SIGNATURE_ENDPOINT+"?block-size=1024", "", io.MultiReader(bytes.NewReader(content)))
+			assert.Equal(t, http.StatusOK, status)
+			assert.True(t, bytes.Equal(expectedSignature.Bytes(), signature), "HTTP/%d", proto)
+		}
+	})
+
+	t.Run("should stream HTTP/1 response while reading request", func(t *testing.T) {
+		server := httptest.NewServer(Handler{})
+		defer server.Close()
+
+		// Signatures are written once a segment of the basis is read.
+		long := bytes.Repeat(content, 8)
+		expected := bytes.Buffer{}
+		assert.NoError(t, rdiff.Signature(bytes.NewReader(long), &expected, rdiff.SignatureOptions{BlockLength: 1024}))
+		body, bodyWriter := io.Pipe()
+		defer bodyWriter.Close()
+		go bodyWriter.Write(long[:2*rdiff.SIGNATURE_SEGMENT_LENGTH])
+		responses := make(chan *http.Response, 1)
+		go func() {
+			response, err := server.Client().Post(server.URL+SIGNATURE_ENDPOINT+"?block-size=1024", "", body)
+			assert.NoError(t, err)
+			responses <- response
+		}()
+
+		select {
+		case response := <-responses:
+			defer response.Body.Close()
+			assert.Equal(t, http.StatusOK, response.StatusCode)
+			start := make([]byte, 1024)
+			_, err := io.ReadFull(response.Body, start)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(expected.Bytes()[:len(start)], start))
+		case <-time.After(5 * time.Second):
+			t.Fatal("no response before the end of the request body")
+		}
+	})
+
+	t.Run("should return delta patching old file into new one", func(t *testing.T) {
+		server := httptest.NewServer(Handler{})
+		defer server.Close()
+
+		body, contentType := deltaRequest(expectedSignature.Bytes(), changed)
+		status, delta := post(t, server.Client(), server.URL+DELTA_ENDPOINT+"?compress=gzip", contentType, body)
+		assert.Equal(t, http.StatusOK, status)
+
+		patched := bytes.Buffer{}
+		assert.NoError(t, rdiff.Patch(bytes.NewReader(content), bytes.NewReader(delta), &patched, rdiff.PatchOptions{}))
+		assert.True(t, bytes.Equal(changed, patched.Bytes()))
+	})
+
+	t.Run("should patch server-side file", func(t *testing.T) {
+		files := &memoryFiles{files: map[string][]byte{"dir/file": content}}
+		server := httptest.NewServer(files.handler())
+		defer server.Close()
+
+		delta := bytes.Buffer{}
+		assert.NoError(t, rdiff.Delta(bytes.NewReader(expectedSignature.Bytes()), bytes.NewReader(changed), &delta, rdiff.DeltaOptions{}))
+		status, body := post(t, server.Client(), server.URL+PATCH_ENDPOINT+"dir/file", "application/octet-stream", &delta)
+		assert.Equal(t, http.StatusOK, status)
+
+		response := patchResponse{}
+		assert.NoError(t, json.Unmarshal(body, &response))
+		digest := sha256.Sum256(changed)
+		assert.Equal(t, patchResponse{Length: uint64(len(changed)), SHA256: hex.EncodeToString(digest[:])}, response)
+		assert.True(t, bytes.Equal(changed, files.files["dir/file"]))
+	})
+
+	otherSignature := bytes.Buffer{}
+	assert.NoError(t, rdiff.Signature(strings.NewReader("other"), &otherSignature, rdiff.SignatureOptions{}))
+	otherDelta := bytes.Buffer{}
+	assert.NoError(t, rdiff.Delta(&otherSignature, bytes.NewReader(changed), &otherDelta, rdiff.DeltaOptions{}))
+	deltaBody, deltaContentType := deltaRequest([]byte("not a signature"), changed)
+	swappedBody := &bytes.Buffer{}
+	swapped := multipart.NewWriter(swappedBody)
+	swapped.WriteField(NEW_FILE_PART, "new")
+	swapped.Close()
+
+	tcs := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        io.Reader
+		expected    int
+	}{
+		{name: "should refuse other methods", method: http.MethodGet, path: SIGNATURE_ENDPOINT, expected: http.StatusMethodNotAllowed},
+		{name: "should refuse unknown endpoint", method: http.MethodPost, path: "/unknown", expected: http.StatusNotFound},
+		{name: "should refuse invalid block size", method: http.MethodPost, path: SIGNATURE_ENDPOINT + "?block-size=0", expected: http.StatusBadRequest},
+		{name: "should refuse too long block size", method: http.MethodPost, path: SIGNATURE_ENDPOINT + "?block-size=16777217", expected: http.StatusBadRequest},
+		{name: "should refuse unknown format", method: http.MethodPost, path: SIGNATURE_ENDPOINT + "?format=other", expected: http.StatusBadRequest},
+		{name: "should refuse delta request without multipart body", method: http.MethodPost, path: DELTA_ENDPOINT, contentType: "text/plain", body: strings.NewReader("new"), expected: http.StatusBadRequest},
+		{name: "should refuse new file before signature", method: http.MethodPost, path: DELTA_ENDPOINT, contentType: swapped.FormDataContentType(), body: swappedBody, expected: http.StatusBadRequest},
+		{name: "should refuse invalid signature", method: http.MethodPost, path: DELTA_ENDPOINT, contentType: deltaContentType, body: deltaBody, expected: http.StatusBadRequest},
+		{name: "should refuse delta of other basis", method: http.MethodPost, path: PATCH_ENDPOINT + "file", body: &otherDelta, expected: http.StatusConflict},
+		{name: "should refuse invalid delta", method: http.MethodPost, path: PATCH_ENDPOINT + "file", body: strings.NewReader("not a delta"), expected: http.StatusBadRequest},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			files := &memoryFiles{files: map[string][]byte{"file": content}}
+			request := httptest.NewRequest(tc.method, tc.path, tc.body)
+			request.Header.Set("Content-Type", tc.contentType)
+			recorder := httptest.NewRecorder()
+			files.handler().ServeHTTP(recorder, request)
+			assert.Equal(t, tc.expected, recorder.Code, recorder.Body.String())
+			assert.Equal(t, content, files.files["file"])
+		})
+	}
+
+	t.Run("should refuse too large body", func(t *testing.T) {
+		files := &memoryFiles{files: map[string][]byte{"file": content}}
+		delta := bytes.Buffer{}
+		assert.NoError(t, rdiff.Delta(bytes.NewReader(expectedSignature.Bytes()), bytes.NewReader(changed), &delta, rdiff.DeltaOptions{}))
+		for path, body := range map[string][]byte{SIGNATURE_ENDPOINT: content, PATCH_ENDPOINT + "file": delta.Bytes()} {
+			handler := files.handler()
+			handler.MaxBodyLength = int64(len(body)) - 1
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)))
+			assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code, path)
+		}
+		assert.Equal(t, content, files.files["file"])
+	})
+
+	t.Run("should refuse patch unless files are set", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		Handler{}.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, PATCH_ENDPOINT+"file", strings.NewReader("")))
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+	})
+
+	t.Run("should report missing file", func(t *testing.T) {
+		handler := Handler{
+			Open: func(string) (io.ReaderAt, func() error, error) {
+				return nil, nil, &fs.PathError{Op: "open", Path: "file", Err: fs.ErrNotExist}
+			},
+			Create: func(string, func(io.Writer) error) error { return nil },
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, PATCH_ENDPOINT+"file", strings.NewReader("")))
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+		assert.Equal(t, "open file: file does not exist\n", recorder.Body.String())
+	})
+}
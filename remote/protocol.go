@@ -0,0 +1,274 @@
+package remote
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// PROTOCOL_VERSION is sent with every request, servers refuse other
+// versions.
+const PROTOCOL_VERSION byte = 1
+
+// Frames are a type byte, a big-endian uint32 payload length and the
+// payload. Streams are DATA frames terminated by an END frame, or by an
+// ERROR frame carrying the message of the peer's failure.
+const (
+	FRAME_REQUEST byte = 1
+	FRAME_DATA    byte = 2
+	FRAME_END     byte = 3
+	FRAME_ACK     byte = 4
+	FRAME_ERROR   byte = 5
+
+	FRAME_HEADER_SIZE = 5
+	// MAX_FRAME_LENGTH is the maximal payload length of a frame.
+	MAX_FRAME_LENGTH = 64 << 10
+)
+
+// Operations of requests. The client of a push sends its file to the server,
+// the client of a pull receives the server's file.
+const (
+	OP_PUSH byte = 1
+	OP_PULL byte = 2
+)
+
+var (
+	ErrRemote                     = errors.New("remote error")
+	ErrUnexpectedFrame            = errors.New("unexpected frame")
+	ErrFrameTooLong               = errors.New("frame too long")
+	ErrUnsupportedProtocolVersion = errors.New("unsupported protocol version")
+	ErrUnknownOperation           = errors.New("unknown operation")
+)
+
+// Request opens a session for the file at Path, relative to the root the
+// server serves.
+type Request struct {
+	Op   byte
+	Path string
+}
+
+func WriteRequest(w io.Writer, request Request) error {
+	payload := append([]byte{PROTOCOL_VERSION, request.Op}, request.Path...)
+	return writeFrame(w, FRAME_REQUEST, payload)
+}
+
+func ReadRequest(r io.Reader) (Request, error) {
+	payload, err := readFrame(r, FRAME_REQUEST)
+	if err != nil {
+		return Request{}, err
+	}
+	if len(payload) < 2 {
+		return Request{}, fmt.Errorf("%w: request of %d bytes", ErrUnexpectedFrame, len(payload))
+	}
+	if payload[0] != PROTOCOL_VERSION {
+		return Request{}, fmt.Errorf("%w: %d", ErrUnsupportedProtocolVersion, payload[0])
+	}
+	request := Request{Op: payload[1], Path: string(payload[2:])}
+	if request.Op != OP_PUSH && request.Op != OP_PULL {
+		return Request{}, fmt.Errorf("%w: %d", ErrUnknownOperation, request.Op)
+	}
+	return request, nil
+}
+
+// DeadlineConn gives every frame read from or written to Conn Timeout to
+// complete, so peers that stop sending or reading, or trickle frames, do not
+// hold the session forever. Gaps between frames count too, such as while
+// the peer calculates a delta.
+type DeadlineConn struct {
+	net.Conn
+	Timeout time.Duration
+}
+
+// frameDeadliner is implemented by connections setting deadlines per frame.
+type frameDeadliner interface {
+	startReadingFrame() error
+	startWritingFrame() error
+}
+
+func (c *DeadlineConn) startReadingFrame() error {
+	return c.SetReadDeadline(time.Now().Add(c.Timeout))
+}
+
+func (c *DeadlineConn) startWritingFrame() error {
+	return c.SetWriteDeadline(time.Now().Add(c.Timeout))
+}
+
+func writeFrame(w io.Writer, frameType byte, payload []byte) error {
+	if d, ok := w.(frameDeadliner); ok {
+		if err := d.startWritingFrame(); err != nil {
+			return err
+		}
+	}
+	frame := make([]byte, FRAME_HEADER_SIZE, FRAME_HEADER_SIZE+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
+
+// writeError sends the message of err to the peer, truncated to fit a
+// frame.
+func writeError(w io.Writer, err error) error {
+	message := err.Error()
+	if len(message) > MAX_FRAME_LENGTH {
+		message = message[:MAX_FRAME_LENGTH]
+	}
+	return writeFrame(w, FRAME_ERROR, []byte(message))
+}
+
+func readFrameHeader(r io.Reader) (byte, int, error) {
+	if d, ok := r.(frameDeadliner); ok {
+		if err := d.startReadingFrame(); err != nil {
+			return 0, 0, err
+		}
+	}
+	header := make([]byte, FRAME_HEADER_SIZE)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, 0, unexpectedEOF(err)
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > MAX_FRAME_LENGTH {
+		return 0, 0, fmt.Errorf("%w: %d bytes", ErrFrameTooLong, length)
+	}
+	return header[0], int(length), nil
+}
+
+// readFrame reads a whole frame of the expected type, returning the message
+// of ERROR frames as an error wrapping ErrRemote.
+func readFrame(r io.Reader, expected byte) ([]byte, error) {
+	frameType, length, err := readFrameHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	switch frameType {
+	case expected:
+		return payload, nil
+	case FRAME_ERROR:
+		return nil, fmt.Errorf("%w: %s", ErrRemote, payload)
+	}
+	return nil, fmt.Errorf("%w: %d instead of %d", ErrUnexpectedFrame, frameType, expected)
+}
+
+// unexpectedEOF turns the end of the connection in the middle of a session
+// into io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// streamWriter sends data written to it in DATA frames of up to
+// MAX_FRAME_LENGTH bytes and an END frame on Close.
+type streamWriter struct {
+	w      io.Writer
+	buffer []byte
+}
+
+func newStreamWriter(w io.Writer) *streamWriter {
+	return &streamWriter{w: w, buffer: make([]byte, 0, MAX_FRAME_LENGTH)}
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(s.buffer[len(s.buffer):cap(s.buffer)], p)
+		s.buffer = s.buffer[:len(s.buffer)+n]
+		p = p[n:]
+		written += n
+		if len(s.buffer) == cap(s.buffer) {
+			if err := s.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (s *streamWriter) flush() error {
+	if len(s.buffer) == 0 {
+		return nil
+	}
+	err := writeFrame(s.w, FRAME_DATA, s.buffer)
+	s.buffer = s.buffer[:0]
+	return err
+}
+
+func (s *streamWriter) Close() error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+	return writeFrame(s.w, FRAME_END, nil)
+}
+
+// streamReader reads the payloads of DATA frames up to the END frame.
+type streamReader struct {
+	r         io.Reader
+	remaining int
+	err       error
+}
+
+func newStreamReader(r io.Reader) *streamReader {
+	return &streamReader{r: r}
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	for s.remaining == 0 {
+		frameType, length, err := readFrameHeader(s.r)
+		if err != nil {
+			s.err = err
+			return 0, err
+		}
+		switch frameType {
+		case FRAME_DATA:
+			s.remaining = length
+		case FRAME_END:
+			s.err = io.EOF
+			if length != 0 {
+				s.err = fmt.Errorf("%w: END of %d bytes", ErrUnexpectedFrame, length)
+			}
+		case FRAME_ERROR:
+			message := make([]byte, length)
+			_, err := io.ReadFull(s.r, message)
+			s.err = fmt.Errorf("%w: %s", ErrRemote, message)
+			if err != nil {
+				s.err = unexpectedEOF(err)
+			}
+		default:
+			s.err = fmt.Errorf("%w: %d in stream", ErrUnexpectedFrame, frameType)
+		}
+		if s.err != nil {
+			return 0, s.err
+		}
+	}
+	if len(p) > s.remaining {
+		p = p[:s.remaining]
+	}
+	n, err := s.r.Read(p)
+	s.remaining -= n
+	if err != nil {
+		s.err = unexpectedEOF(err)
+		if n == 0 {
+			return 0, s.err
+		}
+	}
+	return n, nil
+}
+
+// drain reads the rest of the stream, returning nil if it ended with END.
+func (s *streamReader) drain() error {
+	_, err := io.Copy(io.Discard, s)
+	return err
+}
@@ -0,0 +1,105 @@
+// Package remote synchronizes files between hosts with a small framed
+// protocol on top of the rdiff package.
+//
+// A client opens a session with a request naming a file on the server. The
+// receiver of the file, the server for a push and the client for a pull,
+// streams the signature of its copy. The sender streams the plain delta of
+// its copy against that signature. The receiver patches its copy and
+// acknowledges with the SHA-256 of the result, which the sender compares
+// with its own.
+//
+// Handler serves signatures, deltas and patches over HTTP, and RangeFetcher
+// reads blocks of files published over HTTP next to their signature for
+// rdiff.Fetch.
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+
+	"plain-rdiff/rdiff"
+)
+
+// Send is the sender side of a session: it reads the receiver's signature
+// from conn, writes the delta of newFile to conn and waits for the
+// acknowledgement, returning rdiff.ErrTargetMismatch if the receiver ended
+// up with another file. Failures are reported to the receiver before
+// returning; conn should be closed once Send returns an error.
+func Send(ctx context.Context, conn io.ReadWriter, newFile io.Reader, opts rdiff.DeltaOptions) error {
+	opts.Format = rdiff.FORMAT_PLAIN
+	signature := newStreamReader(conn)
+	delta := newStreamWriter(conn)
+	hash := sha256.New()
+	err := rdiff.DeltaContext(ctx, signature, io.TeeReader(newFile, hash), delta, opts)
+	if err == nil {
+		err = delta.Close()
+	}
+	if err != nil {
+		// The receiver only reads the delta once it sent the whole signature.
+		if signature.drain() == nil {
+			writeError(conn, err)
+		}
+		return err
+	}
+
+	ack, err := readFrame(conn, FRAME_ACK)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(ack, hash.Sum(nil)) {
+		return rdiff.ErrTargetMismatch
+	}
+	return nil
+}
+
+// Receive is the receiver side of a session: it writes the signature of
+// basis to conn, reads the delta from conn and passes a function patching
+// basis with it to create, which has to write the recreated file to the
+// given writer. The recreated file is acknowledged once create returns.
+// Failures are reported to the sender before returning; conn should be
+// closed once Receive returns an error.
+func Receive(
+	ctx context.Context,
+	conn io.ReadWriter,
+	basis io.ReaderAt,
+	create func(fill func(io.Writer) error) error,
+	opts rdiff.SignatureOptions,
+) error {
+	opts.Format = rdiff.FORMAT_PLAIN
+	signature := newStreamWriter(conn)
+	err := rdiff.SignatureContext(ctx, basis, signature, opts)
+	if err == nil {
+		err = signature.Close()
+	}
+	if err != nil {
+		// The sender reads the whole signature before writing the delta.
+		writeError(conn, err)
+		return err
+	}
+
+	delta := newStreamReader(conn)
+	hash := sha256.New()
+	err = create(func(w io.Writer) error {
+		return rdiff.PatchContext(ctx, basis, delta, io.MultiWriter(w, hash), rdiff.PatchOptions{})
+	})
+	if err != nil {
+		if delta.drain() == nil {
+			writeError(conn, err)
+		}
+		return err
+	}
+	return writeFrame(conn, FRAME_ACK, hash.Sum(nil))
+}
+
+// Reject refuses request with err. The signature of a pull is read first so
+// that the client is done writing when the error arrives.
+func Reject(conn io.ReadWriter, request Request, err error) error {
+	if request.Op == OP_PULL {
+		if drainErr := newStreamReader(conn).drain(); drainErr != nil {
+			return drainErr
+		}
+	}
+	return writeError(conn, err)
+}
@@ -0,0 +1,211 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"plain-rdiff/rdiff"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// session runs Send of newFile and Receive on top of basis over net.Pipe,
+// returning the received file and the errors of both sides.
+func session(
+	newFile io.Reader,
+	basis []byte,
+	create func(fill func(io.Writer) error) error,
+) (sendErr, receiveErr error) {
+	sender, receiver := net.Pipe()
+	errChan := make(chan error, 1)
+	go func() {
+		defer sender.Close()
+		errChan <- Send(context.Background(), sender, newFile, rdiff.DeltaOptions{})
+	}()
+	receiveErr = Receive(context.Background(), receiver, bytes.NewReader(basis), create, rdiff.SignatureOptions{BlockLength: 64})
+	receiver.Close()
+	return <-errChan, receiveErr
+}
+
+func TestSession(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	content := make([]byte, 300_000)
+	random.Read(content)
+	changed := append([]byte{}, content...)
+	copy(changed[100_000:], "changed")
+	changed = append(changed, "appended"...)
+
+	tcs := []struct {
+		name    string
+		basis   []byte
+		newFile []byte
+	}{
+		{name: "should transfer changed file", basis: content, newFile: changed},
+		{name: "should transfer identical file", basis: content, newFile: content},
+		{name: "should transfer new file", basis: nil, newFile: changed},
+		{name: "should transfer empty file", basis: content, newFile: nil},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			received := bytes.Buffer{}
+			sendErr, receiveErr := session(bytes.NewReader(tc.newFile), tc.basis, func(fill func(io.Writer) error) error {
+				return fill(&received)
+			})
+			assert.NoError(t, sendErr)
+			assert.NoError(t, receiveErr)
+			assert.True(t, bytes.Equal(tc.newFile, received.Bytes()))
+		})
+	}
+
+	t.Run("should report receiver failure to sender", func(t *testing.T) {
+		createErr := errors.New("disk full")
+		sendErr, receiveErr := session(bytes.NewReader(changed), content, func(func(io.Writer) error) error {
+			return createErr
+		})
+		assert.ErrorIs(t, receiveErr, createErr)
+		assert.ErrorIs(t, sendErr, ErrRemote)
+		assert.Contains(t, sendErr.Error(), "disk full")
+	})
+
+	t.Run("should report sender failure to receiver", func(t *testing.T) {
+		readErr := errors.New("read failed")
+		newFile := io.MultiReader(bytes.NewReader(changed), iotest.ErrReader(readErr))
+		sendErr, receiveErr := session(newFile, content, func(fill func(io.Writer) error) error {
+			return fill(io.Discard)
+		})
+		assert.ErrorIs(t, sendErr, readErr)
+		assert.ErrorIs(t, receiveErr, ErrRemote)
+		assert.Contains(t, receiveErr.Error(), "read failed")
+	})
+}
+
+func TestReject(t *testing.T) {
+	tcs := []struct {
+		name string
+		op   byte
+	}{
+		{name: "should refuse push with error", op: OP_PUSH},
+		{name: "should refuse pull once signature is read", op: OP_PULL},
+	}
+	for _, tc := range tcs {
+		op := tc.op
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			errChan := make(chan error, 1)
+			go func() {
+				defer server.Close()
+				request, err := ReadRequest(server)
+				if err != nil {
+					errChan <- err
+					return
+				}
+				assert.Equal(t, Request{Op: op, Path: "dir/file"}, request)
+				errChan <- Reject(server, request, errors.New("no such file"))
+			}()
+
+			assert.NoError(t, WriteRequest(client, Request{Op: op, Path: "dir/file"}))
+			var err error
+			if op == OP_PUSH {
+				err = Send(context.Background(), client, strings.NewReader("content"), rdiff.DeltaOptions{})
+			} else {
+				err = Receive(context.Background(), client, strings.NewReader("old"), func(fill func(io.Writer) error) error {
+					return fill(io.Discard)
+				}, rdiff.SignatureOptions{})
+			}
+			client.Close()
+			assert.ErrorIs(t, err, ErrRemote)
+			assert.Contains(t, err.Error(), "no such file")
+			assert.NoError(t, <-errChan)
+		})
+	}
+}
+
+func TestReadRequest(t *testing.T) {
+	tcs := []struct {
+		name     string
+		frame    []byte
+		expected error
+	}{
+		{name: "should refuse other protocol version", frame: []byte{FRAME_REQUEST, 0, 0, 0, 3, 9, OP_PUSH, 'f'}, expected: ErrUnsupportedProtocolVersion},
+		{name: "should refuse unknown operation", frame: []byte{FRAME_REQUEST, 0, 0, 0, 3, PROTOCOL_VERSION, 9, 'f'}, expected: ErrUnknownOperation},
+		{name: "should refuse other frame", frame: []byte{FRAME_DATA, 0, 0, 0, 0}, expected: ErrUnexpectedFrame},
+		{name: "should refuse frame above maximal length", frame: []byte{FRAME_REQUEST, 0, 1, 0, 1}, expected: ErrFrameTooLong},
+		{name: "should return error on truncated frame", frame: []byte{FRAME_REQUEST, 0, 0, 0, 3, PROTOCOL_VERSION}, expected: io.ErrUnexpectedEOF},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ReadRequest(bytes.NewReader(tc.frame))
+			assert.ErrorIs(t, err, tc.expected)
+		})
+	}
+}
+
+func TestDeadlineConn(t *testing.T) {
+	t.Run("should time out frame that does not arrive", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		_, err := ReadRequest(&DeadlineConn{Conn: server, Timeout: 10 * time.Millisecond})
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+
+	t.Run("should time out frame that is not read", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		err := writeFrame(&DeadlineConn{Conn: server, Timeout: 10 * time.Millisecond}, FRAME_ACK, nil)
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+
+	t.Run("should give every frame the timeout", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go func() {
+			w := newStreamWriter(client)
+			// Longer than the timeout in total, not per frame.
+			for i := 0; i < 4; i++ {
+				time.Sleep(50 * time.Millisecond)
+				w.Write(make([]byte, MAX_FRAME_LENGTH))
+			}
+			w.Close()
+		}()
+		_, err := io.Copy(io.Discard, newStreamReader(&DeadlineConn{Conn: server, Timeout: 100 * time.Millisecond}))
+		assert.NoError(t, err)
+	})
+}
+
+func TestStream(t *testing.T) {
+	t.Run("should split stream in frames of maximal length", func(t *testing.T) {
+		data := make([]byte, 2*MAX_FRAME_LENGTH+10)
+		rand.New(rand.NewSource(1)).Read(data)
+		framed := bytes.Buffer{}
+		w := newStreamWriter(&framed)
+		_, err := w.Write(data[:5])
+		assert.NoError(t, err)
+		_, err = w.Write(data[5:])
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+		assert.Equal(t, len(data)+4*FRAME_HEADER_SIZE, framed.Len())
+
+		read, err := io.ReadAll(newStreamReader(iotest.OneByteReader(&framed)))
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(data, read))
+	})
+
+	t.Run("should return error of truncated stream", func(t *testing.T) {
+		framed := bytes.Buffer{}
+		w := newStreamWriter(&framed)
+		w.Write([]byte("data"))
+		assert.NoError(t, w.flush())
+
+		_, err := io.ReadAll(newStreamReader(&framed))
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+}
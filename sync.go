@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"plain-rdiff/rdiff"
+	"plain-rdiff/remote"
+)
+
+// DEFAULT_PORT is the TCP port serve listens on and push and pull connect to
+// by default.
+const DEFAULT_PORT = 8730
+
+// DEFAULT_TIMEOUT is the default time serve gives every frame of a session,
+// long enough for clients calculating the delta of a large unchanged file.
+const DEFAULT_TIMEOUT = 5 * time.Minute
+
+// DEFAULT_LISTEN_HOST is the host serve and http listen on by default, so
+// they are not reachable from other machines unless asked to.
+const DEFAULT_LISTEN_HOST = "localhost"
+
+var (
+	errReadOnly    = errors.New("files are read-only, the server was not started with --writable")
+	errOutsideRoot = errors.New("path leads outside the served directory")
+)
+
+// parseRemoteFile splits host:path operands of push and pull. IPv6 hosts are
+// written in brackets.
+func parseRemoteFile(operand string) (string, string, error) {
+	separator := strings.Index(operand, ":")
+	if strings.HasPrefix(operand, "[") {
+		separator = strings.Index(operand, "]:") + 1
+	}
+	if separator <= 0 || separator == len(operand)-1 {
+		return "", "", usageError(fmt.Sprintf("invalid remote file, expected host:path: %s", operand))
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(operand[:separator], "["), "]")
+	return host, operand[separator+1:], nil
+}
+
+// servedPath returns the path of a requested file under root. Requested
+// paths are relative to root and cannot leave it with "..". Symbolic links
+// are resolved, and requests leading outside root through them are refused
+// with errOutsideRoot.
+func servedPath(root, requested string) (string, error) {
+	cleaned := path.Clean("/" + requested)
+	if cleaned == "/" {
+		return "", fmt.Errorf("invalid path: %q", requested)
+	}
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := resolveSymlinks(filepath.Join(resolvedRoot, filepath.FromSlash(cleaned)))
+	if err != nil {
+		return "", withoutServedPath(remote.Request{Path: requested}, err)
+	}
+	relative, err := filepath.Rel(resolvedRoot, resolved)
+	if err != nil || relative == "." || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %q", errOutsideRoot, requested)
+	}
+	return resolved, nil
+}
+
+// resolveSymlinks resolves the symbolic links of filePath like
+// filepath.EvalSymlinks, keeping the missing trailing elements of paths of
+// files yet to be created and following dangling links.
+func resolveSymlinks(filePath string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(filePath)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return resolved, err
+	}
+	if info, err := os.Lstat(filePath); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		target, err := os.Readlink(filePath)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(filePath), target)
+		}
+		return resolveSymlinks(target)
+	}
+	parent := filepath.Dir(filePath)
+	if parent == filePath {
+		return filePath, nil
+	}
+	resolvedParent, err := resolveSymlinks(parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolvedParent, filepath.Base(filePath)), nil
+}
+
+// serveFlow serves files under root to pull requests and, if writable,
+// replaces them on push requests. Sessions are dropped once a frame takes
+// longer than timeout.
+func serveFlow(ctx context.Context, address, root string, writable bool, timeout time.Duration) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	stop := closeOnDone(ctx, listener)
+	defer stop()
+	log.Printf("serving %s on %s", root, listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		go func() {
+			err := serveConn(ctx, conn, root, writable, timeout)
+			if err != nil {
+				log.Printf("%s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// serveConn serves a push or pull request of a client for a file under
+// root, closing conn once done. Push requests are refused unless writable,
+// and every frame has timeout to arrive or be read.
+func serveConn(ctx context.Context, conn net.Conn, root string, writable bool, timeout time.Duration) error {
+	defer conn.Close()
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+	conn = &remote.DeadlineConn{Conn: conn, Timeout: timeout}
+
+	request, err := remote.ReadRequest(conn)
+	if err != nil {
+		return err
+	}
+	if request.Op == remote.OP_PUSH && !writable {
+		remote.Reject(conn, request, errReadOnly)
+		return errReadOnly
+	}
+	filePath, err := servedPath(root, request.Path)
+	if err != nil {
+		remote.Reject(conn, request, err)
+		return err
+	}
+	switch request.Op {
+	case remote.OP_PUSH:
+		basis, closeBasis, openErr := openBasis(filePath)
+		if openErr != nil {
+			remote.Reject(conn, request, withoutServedPath(request, openErr))
+			return openErr
+		}
+		defer closeBasis()
+		err = receiveFile(ctx, conn, basis, filePath)
+	case remote.OP_PULL:
+		file, openErr := GetFileReader(filePath)
+		if openErr != nil {
+			remote.Reject(conn, request, withoutServedPath(request, openErr))
+			return openErr
+		}
+		defer file.Close()
+		err = remote.Send(ctx, conn, file, rdiff.DeltaOptions{})
+	}
+	return sessionError(ctx, err)
+}
+
+// withoutServedPath replaces the path under root of errors opening the
+// requested file with the requested path, so clients do not learn about root.
+func withoutServedPath(request remote.Request, err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return &fs.PathError{Op: pathErr.Op, Path: request.Path, Err: pathErr.Err}
+	}
+	return err
+}
+
+func pushFlow(ctx context.Context, localFilePath, remoteFile string, port int) error {
+	host, remotePath, err := parseRemoteFile(remoteFile)
+	if err != nil {
+		return err
+	}
+	localFile, err := GetInputReader(localFilePath)
+	if err != nil {
+		return err
+	}
+	defer localFile.Close()
+
+	conn, err := dial(ctx, host, port)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return push(ctx, conn, localFile, remotePath)
+}
+
+func pullFlow(ctx context.Context, remoteFile, localFilePath string, port int) error {
+	host, remotePath, err := parseRemoteFile(remoteFile)
+	if err != nil {
+		return err
+	}
+	conn, err := dial(ctx, host, port)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return pull(ctx, conn, remotePath, localFilePath)
+}
+
+// push sends localFile to the server at conn, which replaces its file at
+// remotePath with it.
+func push(ctx context.Context, conn net.Conn, localFile io.Reader, remotePath string) error {
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	err := remote.WriteRequest(conn, remote.Request{Op: remote.OP_PUSH, Path: remotePath})
+	if err == nil {
+		err = remote.Send(ctx, conn, localFile, rdiff.DeltaOptions{})
+	}
+	return sessionError(ctx, err)
+}
+
+// pull replaces the file at localFilePath with the file at remotePath of
+// the server at conn.
+func pull(ctx context.Context, conn net.Conn, remotePath, localFilePath string) error {
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	basis, closeBasis, err := openBasis(localFilePath)
+	if err != nil {
+		return err
+	}
+	defer closeBasis()
+
+	err = remote.WriteRequest(conn, remote.Request{Op: remote.OP_PULL, Path: remotePath})
+	if err == nil {
+		err = receiveFile(ctx, conn, basis, localFilePath)
+	}
+	return sessionError(ctx, err)
+}
+
+// openBasis opens the file at filePath to be replaced by a received one, or
+// an empty basis if there is none yet.
+func openBasis(filePath string) (io.ReaderAt, func() error, error) {
+	file, err := GetFileReader(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return bytes.NewReader(nil), func() error { return nil }, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, file.Close, nil
+}
+
+// receiveFile replaces the file at filePath with the one sent over conn,
+// patching basis.
+func receiveFile(ctx context.Context, conn net.Conn, basis io.ReaderAt, filePath string) error {
+	return remote.Receive(ctx, conn, basis, func(fill func(io.Writer) error) error {
+		return CreateAndFillFile(filePath, fill)
+	}, rdiff.SignatureOptions{})
+}
+
+func dial(ctx context.Context, host string, port int) (net.Conn, error) {
+	dialer := net.Dialer{}
+	return dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// closeOnDone closes c once ctx is done, unblocking its reads and writes,
+// until the returned function is called.
+func closeOnDone(ctx context.Context, c io.Closer) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// sessionError returns the error of ctx rather than the one of the
+// connection it closed.
+func sessionError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"plain-rdiff/remote"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// withServer runs client against serveConn serving root writable over
+// net.Pipe and returns the errors of both.
+func withServer(root string, client func(net.Conn) error) (clientErr, serverErr error) {
+	return withServerOf(root, true, client)
+}
+
+func withServerOf(root string, writable bool, client func(net.Conn) error) (clientErr, serverErr error) {
+	clientConn, serverConn := net.Pipe()
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- serveConn(context.Background(), serverConn, root, writable, DEFAULT_TIMEOUT)
+	}()
+	clientErr = client(clientConn)
+	clientConn.Close()
+	return clientErr, <-errChan
+}
+
+func TestSync(t *testing.T) {
+	oldContent := strings.Repeat("Imagine you have two files, A and B. ", 1000)
+	newContent := strings.Replace(oldContent, "two", "three", 7) + "and more"
+
+	t.Run("should push new and changed files", func(t *testing.T) {
+		root := t.TempDir()
+		for _, content := range []string{oldContent, newContent} {
+			clientErr, serverErr := withServer(root, func(conn net.Conn) error {
+				return push(context.Background(), conn, strings.NewReader(content), "dir/../file")
+			})
+			assert.NoError(t, clientErr)
+			assert.NoError(t, serverErr)
+			assertFileContent(t, filepath.Join(root, "file"), content)
+		}
+	})
+
+	t.Run("should pull new and changed files", func(t *testing.T) {
+		root := t.TempDir()
+		local := filepath.Join(t.TempDir(), "local")
+		for _, content := range []string{oldContent, newContent} {
+			assert.NoError(t, os.WriteFile(filepath.Join(root, "file"), []byte(content), 0600))
+
+			clientErr, serverErr := withServer(root, func(conn net.Conn) error {
+				return pull(context.Background(), conn, "/file", local)
+			})
+			assert.NoError(t, clientErr)
+			assert.NoError(t, serverErr)
+			assertFileContent(t, local, content)
+		}
+	})
+
+	t.Run("should keep requests under root", func(t *testing.T) {
+		root := t.TempDir()
+		clientErr, serverErr := withServer(filepath.Join(root, "served"), func(conn net.Conn) error {
+			return push(context.Background(), conn, strings.NewReader(newContent), "../file")
+		})
+		assert.ErrorIs(t, clientErr, remote.ErrRemote)
+		assert.Error(t, serverErr)
+		assertDirEntries(t, root)
+	})
+
+	t.Run("should refuse push unless writable", func(t *testing.T) {
+		root := t.TempDir()
+		clientErr, serverErr := withServerOf(root, false, func(conn net.Conn) error {
+			return push(context.Background(), conn, strings.NewReader(newContent), "file")
+		})
+		assert.ErrorIs(t, clientErr, remote.ErrRemote)
+		assert.ErrorIs(t, serverErr, errReadOnly)
+		assertDirEntries(t, root)
+	})
+
+	t.Run("should follow symbolic links staying under root", func(t *testing.T) {
+		root := t.TempDir()
+		assert.NoError(t, os.Mkdir(filepath.Join(root, "dir"), 0700))
+		assert.NoError(t, os.Symlink("dir", filepath.Join(root, "link")))
+		clientErr, serverErr := withServer(root, func(conn net.Conn) error {
+			return push(context.Background(), conn, strings.NewReader(newContent), "link/file")
+		})
+		assert.NoError(t, clientErr)
+		assert.NoError(t, serverErr)
+		assertFileContent(t, filepath.Join(root, "dir", "file"), newContent)
+	})
+
+	t.Run("should refuse symbolic links leading outside root", func(t *testing.T) {
+		root := t.TempDir()
+		outside := t.TempDir()
+		assert.NoError(t, os.Symlink(outside, filepath.Join(root, "dir")))
+		assert.NoError(t, os.Symlink(filepath.Join(outside, "file"), filepath.Join(root, "file")))
+		for _, requested := range []string{"dir/file", "file"} {
+			clientErr, serverErr := withServer(root, func(conn net.Conn) error {
+				return push(context.Background(), conn, strings.NewReader(newContent), requested)
+			})
+			assert.ErrorIs(t, clientErr, remote.ErrRemote)
+			assert.ErrorIs(t, serverErr, errOutsideRoot)
+		}
+		assertDirEntries(t, outside)
+	})
+
+	t.Run("should report missing file to client", func(t *testing.T) {
+		dir := t.TempDir()
+		clientErr, serverErr := withServer(t.TempDir(), func(conn net.Conn) error {
+			return pull(context.Background(), conn, "missing", filepath.Join(dir, "local"))
+		})
+		assert.ErrorIs(t, clientErr, remote.ErrRemote)
+		assert.Equal(t, "remote error: open missing: no such file or directory", clientErr.Error())
+		assert.ErrorIs(t, serverErr, os.ErrNotExist)
+		assertDirEntries(t, dir)
+	})
+
+	t.Run("should stop once context is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		err := push(ctx, clientConn, strings.NewReader(newContent), "file")
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestParseRemoteFile(t *testing.T) {
+	tcs := []struct {
+		name         string
+		operand      string
+		expectedHost string
+		expectedPath string
+	}{
+		{name: "should split host and path", operand: "host:dir/file", expectedHost: "host", expectedPath: "dir/file"},
+		{name: "should keep colons of path", operand: "host:a:b", expectedHost: "host", expectedPath: "a:b"},
+		{name: "should unbracket IPv6 host", operand: "[::1]:file", expectedHost: "::1", expectedPath: "file"},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			host, path, err := parseRemoteFile(tc.operand)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedHost, host)
+			assert.Equal(t, tc.expectedPath, path)
+		})
+	}
+
+	for _, operand := range []string{"file", ":file", "host:", "[::1]file"} {
+		t.Run("should refuse "+operand, func(t *testing.T) {
+			_, _, err := parseRemoteFile(operand)
+			assert.Equal(t, EXIT_USAGE, exitCode(err))
+		})
+	}
+}
+
+func assertFileContent(t *testing.T, path, expected string) {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, string(content))
+}
+
+func TestServeTimeout(t *testing.T) {
+	t.Run("should drop client sending no request", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		err := serveConn(context.Background(), serverConn, t.TempDir(), false, 10*time.Millisecond)
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+
+	t.Run("should drop client not reading", func(t *testing.T) {
+		root := t.TempDir()
+		assert.NoError(t, os.WriteFile(filepath.Join(root, "file"), []byte("content"), 0600))
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		// Pushes the file but never reads the signature of the server.
+		go remote.WriteRequest(clientConn, remote.Request{Op: remote.OP_PUSH, Path: "file"})
+		err := serveConn(context.Background(), serverConn, root, true, 10*time.Millisecond)
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+}
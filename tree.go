@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"plain-rdiff/rdiff"
+)
+
+// isDir returns whether path is a directory, in which case signature, delta
+// and patch work on the tree under it.
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// checkTreeFormat refuses formats other than the plain one, the only one
+// trees are written in, before any file is read.
+func checkTreeFormat(format rdiff.Format) error {
+	if format != rdiff.FORMAT_PLAIN {
+		return usageError(fmt.Sprintf("trees are only written in the plain format, not %s", format))
+	}
+	return nil
+}
+
+// warnSkipped warns about the files left out of trees.
+func warnSkipped(name string, mode os.FileMode) {
+	log.Printf("warning: skipping %s, neither a regular file nor a directory", name)
+}
+
+func treeSignatureFlow(ctx context.Context, oldDirPath, signatureFilePath string, opts rdiff.SignatureOptions) error {
+	opts.Skipped = warnSkipped
+	return CreateAndFillFile(signatureFilePath, func(w io.Writer) error {
+		return rdiff.TreeSignatureContext(ctx, os.DirFS(oldDirPath), w, opts)
+	})
+}
+
+func treeDeltaFlow(ctx context.Context, signatureFilePath, newDirPath, deltaFilePath string, opts rdiff.DeltaOptions) error {
+	signatureFile, err := GetInputReader(signatureFilePath)
+	if err != nil {
+		return err
+	}
+	defer signatureFile.Close()
+
+	opts.Skipped = warnSkipped
+	return CreateAndFillFile(deltaFilePath, func(w io.Writer) error {
+		return rdiff.TreeDeltaContext(ctx, signatureFile, os.DirFS(newDirPath), w, opts)
+	})
+}
+
+func treePatchFlow(ctx context.Context, basisDirPath, deltaFilePath, newDirPath string, opts rdiff.PatchOptions) error {
+	deltaFile, err := GetInputReader(deltaFilePath)
+	if err != nil {
+		return err
+	}
+	defer deltaFile.Close()
+
+	return CreateAndFillTree(newDirPath, func(create func(string, os.FileMode, func(io.Writer) error) error) error {
+		return rdiff.TreePatchContext(ctx, os.DirFS(basisDirPath), deltaFile, create, opts)
+	})
+}
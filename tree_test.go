@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"plain-rdiff/rdiff"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTree creates files with the given contents under dir.
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+func assertTree(t *testing.T, dir string, expected map[string]string) {
+	t.Helper()
+	actual := map[string]string{}
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		name, _ := filepath.Rel(dir, path)
+		actual[filepath.ToSlash(name)] = string(content)
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestTreeFlows(t *testing.T) {
+	long := strings.Repeat("Imagine you have two files, A and B. ", 1000)
+	oldTree := map[string]string{"a": "unchanged", "dir/b": long, "dir/c": "renamed", "d": "deleted"}
+	newTree := map[string]string{"a": "unchanged", "dir/b": strings.Replace(long, "two", "three", 7), "e/c": "renamed", "f": "added"}
+
+	t.Run("should recreate new tree", func(t *testing.T) {
+		dir := t.TempDir()
+		oldDir, newDir := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+		writeTree(t, oldDir, oldTree)
+		writeTree(t, newDir, newTree)
+		assert.NoError(t, os.Chmod(filepath.Join(newDir, "f"), 0755))
+		assert.NoError(t, os.Mkdir(filepath.Join(newDir, "g"), 0700))
+
+		signature, delta, patched := filepath.Join(dir, "sig"), filepath.Join(dir, "delta"), filepath.Join(dir, "patched")
+		ctx := context.Background()
+		assert.NoError(t, treeSignatureFlow(ctx, oldDir, signature, rdiff.SignatureOptions{}))
+		assert.NoError(t, treeDeltaFlow(ctx, signature, newDir, delta, rdiff.DeltaOptions{}))
+		assert.NoError(t, treePatchFlow(ctx, oldDir, delta, patched, rdiff.PatchOptions{}))
+		assertTree(t, patched, newTree)
+		info, err := os.Stat(filepath.Join(patched, "f"))
+		assert.NoError(t, err)
+		assert.Equal(t, fs.FileMode(0755), info.Mode().Perm())
+		info, err = os.Stat(filepath.Join(patched, "g"))
+		assert.NoError(t, err)
+		assert.True(t, info.IsDir())
+		assert.Equal(t, fs.FileMode(0700), info.Mode().Perm())
+
+		// Patching the basis tree in place replaces it.
+		assert.NoError(t, treePatchFlow(ctx, oldDir, delta, oldDir, rdiff.PatchOptions{}))
+		assertTree(t, oldDir, newTree)
+		assertDirEntries(t, dir, "old", "new", "sig", "delta", "patched")
+	})
+
+	t.Run("should skip symbolic links with a warning", func(t *testing.T) {
+		dir := t.TempDir()
+		oldDir, newDir := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+		writeTree(t, oldDir, oldTree)
+		writeTree(t, newDir, newTree)
+		assert.NoError(t, os.Symlink("a", filepath.Join(newDir, "link")))
+		warnings := strings.Builder{}
+		log.SetOutput(&warnings)
+		defer log.SetOutput(os.Stderr)
+
+		signature, delta, patched := filepath.Join(dir, "sig"), filepath.Join(dir, "delta"), filepath.Join(dir, "patched")
+		ctx := context.Background()
+		assert.NoError(t, treeSignatureFlow(ctx, oldDir, signature, rdiff.SignatureOptions{}))
+		assert.NoError(t, treeDeltaFlow(ctx, signature, newDir, delta, rdiff.DeltaOptions{}))
+		assert.NoError(t, treePatchFlow(ctx, oldDir, delta, patched, rdiff.PatchOptions{}))
+		assertTree(t, patched, newTree)
+		assert.Contains(t, warnings.String(), "skipping link")
+	})
+
+	t.Run("should leave no tree when patch fails", func(t *testing.T) {
+		dir := t.TempDir()
+		fillErr := errors.New("fill failed")
+		err := CreateAndFillTree(filepath.Join(dir, "out"), func(create func(string, fs.FileMode, func(io.Writer) error) error) error {
+			err := create("dir/file", 0644, func(w io.Writer) error {
+				_, err := w.Write([]byte("partial"))
+				return err
+			})
+			assert.NoError(t, err)
+			return fillErr
+		})
+		assert.ErrorIs(t, err, fillErr)
+		assertDirEntries(t, dir)
+	})
+
+	t.Run("should refuse tree patch to standard output", func(t *testing.T) {
+		dir := t.TempDir()
+		writeTree(t, dir, oldTree)
+		err := run(context.Background(), []string{MODE_PATCH, dir, filepath.Join(dir, "a"), STDIO_OPERAND})
+		assert.Equal(t, EXIT_USAGE, exitCode(err))
+	})
+	t.Run("should refuse librsync format for trees", func(t *testing.T) {
+		dir := t.TempDir()
+		writeTree(t, dir, oldTree)
+		signature := filepath.Join(t.TempDir(), "sig")
+		assert.NoError(t, treeSignatureFlow(context.Background(), dir, signature, rdiff.SignatureOptions{}))
+		for _, args := range [][]string{
+			{MODE_SIGNATURE, "--format=librsync", dir, filepath.Join(t.TempDir(), "sig")},
+			{MODE_DELTA, "--format=librsync", signature, dir, filepath.Join(t.TempDir(), "delta")},
+			{MODE_PATCH, "--format=librsync", dir, signature, filepath.Join(t.TempDir(), "new")},
+		} {
+			err := run(context.Background(), args)
+			assert.Equal(t, EXIT_USAGE, exitCode(err), args[0])
+		}
+	})
+}